@@ -2,7 +2,6 @@ package fs
 
 import (
 	"bytes"
-	"hash/fnv" // non-cryptographic hash functions
 )
 
 // Block contains a portion of a file and the hash corresponding
@@ -24,8 +23,7 @@ func (b *Block) DeepEquals(b2 *Block) bool {
 	return bytes.Equal(b.Content, b2.Content)
 }
 
-// Equals compares two blocks by comparing their hashes, vulnerable
-// to hash collisions
+// Equals compares two blocks by comparing their hashes
 func (b *Block) Equals(b2 *Block) bool {
 	if b == b2 {
 		return true
@@ -36,11 +34,20 @@ func (b *Block) Equals(b2 *Block) bool {
 	return b.Hash() == b2.Hash()
 }
 
-// Hash uses the hash/fnv package to generate the hash of the Block Content
-func (b *Block) Hash() uint64 {
-	hfn := fnv.New64a()
-	hfn.Write(b.Content)
-	return hfn.Sum64()
+// Hash generates the hash of the Block Content using DefaultHash
+func (b *Block) Hash() string {
+	return b.HashWith(DefaultHash)
+}
+
+// HashWith generates the hex encoded hash of the Block Content using
+// algorithm, an empty string is returned if the algorithm is unknown
+func (b *Block) HashWith(algorithm string) string {
+	return hashContent(algorithm, b.Content)
+}
+
+// IsZero checks if every byte of the content of the Block is zero
+func (b *Block) IsZero() bool {
+	return isZero(b.Content)
 }
 
 // Size returns the number of bytes in the content of a Block
@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Chunker decides where the content of a file is cut into blocks
+type Chunker interface {
+	// Cut returns the length of the block found at the beginning of data,
+	// data will be at most MaxSize bytes long
+	Cut(data []byte) int
+	// MaxSize is the size of the biggest block the chunker can produce
+	MaxSize() int64
+	// Name is stored in each Summary to identify the chunker used
+	Name() string
+}
+
+// fixedChunker cuts files in blocks of the same size
+type fixedChunker struct {
+	size int64
+}
+
+// Cut returns the size of the block or the length of data if it is shorter
+func (c fixedChunker) Cut(data []byte) int {
+	if int64(len(data)) < c.size {
+		return len(data)
+	}
+	return int(c.size)
+}
+
+// MaxSize returns the size of the blocks
+func (c fixedChunker) MaxSize() int64 {
+	return c.size
+}
+
+// Name returns ChunkerFixed
+func (c fixedChunker) Name() string {
+	return ChunkerFixed
+}
+
+// cdcChunker is a content-defined chunker based on FastCDC: a gear hash
+// is rolled over the content and a block ends where the hash matches a mask.
+// Boundaries depend only on nearby bytes, so they survive insertions and
+// deletions made in other parts of the file
+type cdcChunker struct {
+	min   int
+	avg   int
+	max   int
+	maskS uint64 // used before avg, harder to match
+	maskL uint64 // used after avg, easier to match
+}
+
+// Cut looks for the first boundary in data
+func (c cdcChunker) Cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// MaxSize returns the size of the biggest block
+func (c cdcChunker) MaxSize() int64 {
+	return int64(c.max)
+}
+
+// Name returns ChunkerCDC
+func (c cdcChunker) Name() string {
+	return ChunkerCDC
+}
+
+// gearTable maps each byte to a random value, it must be the same in every
+// peer so it is generated from a fixed seed (splitmix64)
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x5a6b616261)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// GetChunker returns the Chunker identified by name, an empty name
+// refers to the fixed size chunker used before chunkers were recorded.
+// blockSize is the size of fixed blocks or the average size of
+// content-defined blocks, BlockSize is used if it is 0
+func GetChunker(name string, blockSize int64) (Chunker, error) {
+	if blockSize == 0 {
+		blockSize = BlockSize
+	}
+	if blockSize < MinBlockSize {
+		return nil, fmt.Errorf("Block size must be at least %dB, got %dB",
+			MinBlockSize, blockSize)
+	}
+	switch name {
+	case "", ChunkerFixed:
+		return fixedChunker{size: blockSize}, nil
+	case ChunkerCDC:
+		bits := uint(bits.Len64(uint64(blockSize)) - 1) // log2(blockSize)
+		return cdcChunker{
+			min:   int(blockSize / cdcMinRatio),
+			avg:   int(blockSize),
+			max:   int(blockSize * cdcMaxRatio),
+			maskS: topBits(bits + 2),
+			maskL: topBits(bits - 2),
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown chunker: '%s'", name)
+}
+
+// chunkReader cuts the content read from a reader into blocks, keeping
+// in memory only what the chunker needs to find the next boundary
+type chunkReader struct {
+	r       io.Reader
+	chunker Chunker
+	buf     []byte
+	eof     bool
+}
+
+// newChunkReader creates a chunkReader that uses c to divide r
+func newChunkReader(r io.Reader, c Chunker) *chunkReader {
+	return &chunkReader{
+		r:       r,
+		chunker: c,
+		buf:     make([]byte, 0, 2*c.MaxSize()),
+	}
+}
+
+// next returns the content of the next block or io.EOF
+func (cr *chunkReader) next() ([]byte, error) {
+	max := int(cr.chunker.MaxSize())
+	// fill the buffer so the chunker can see a whole block
+	for !cr.eof && len(cr.buf) < max {
+		n, err := cr.r.Read(cr.buf[len(cr.buf):cap(cr.buf)])
+		cr.buf = cr.buf[:len(cr.buf)+n]
+		if err == io.EOF {
+			cr.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(cr.buf) == 0 {
+		return nil, io.EOF
+	}
+	n := cr.chunker.Cut(cr.buf[:minInt(len(cr.buf), max)])
+	content := make([]byte, n)
+	copy(content, cr.buf[:n])
+	cr.buf = cr.buf[:copy(cr.buf, cr.buf[n:])]
+	return content, nil
+}
+
+// split reads r until EOF and calls fn with each of the blocks found by c
+func split(r io.Reader, c Chunker, fn func([]byte) error) error {
+	cr := newChunkReader(r, c)
+	for {
+		content, err := cr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(content); err != nil {
+			return err
+		}
+	}
+}
+
+// topBits returns a mask with the n most significant bits set
+func topBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// minInt returns the smallest of two ints
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
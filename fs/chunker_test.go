@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestGetChunker retrieves known chunkers and an unknown one
+func TestGetChunker(t *testing.T) {
+	for _, name := range []string{"", ChunkerFixed, ChunkerCDC} {
+		if _, err := GetChunker(name, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := GetChunker("unknown", 0); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestSplit checks that the blocks produced by both chunkers rebuild the
+// original content and don't exceed the maximum size
+func TestSplit(t *testing.T) {
+	content := make([]byte, 3*BlockSize+42)
+	rand.Read(content)
+	for _, name := range []string{ChunkerFixed, ChunkerCDC} {
+		c, _ := GetChunker(name, 0)
+		rebuilt := make([]byte, 0, len(content))
+		err := split(bytes.NewReader(content), c, func(b []byte) error {
+			if int64(len(b)) > c.MaxSize() {
+				t.Fatalf("%s: block of %dB is too big", name, len(b))
+			}
+			rebuilt = append(rebuilt, b...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, rebuilt) {
+			t.Fatalf("%s: content was not rebuilt", name)
+		}
+	}
+}
+
+// TestSplit_Insertion inserts a byte at the beginning of some content and
+// checks that only the first content-defined block changes
+func TestSplit_Insertion(t *testing.T) {
+	content := make([]byte, 12*BlockSize)
+	rand.Read(content)
+	edited := append([]byte{42}, content...)
+
+	c, _ := GetChunker(ChunkerCDC, 0)
+	hashes := func(content []byte) []string {
+		h := make([]string, 0)
+		split(bytes.NewReader(content), c, func(b []byte) error {
+			h = append(h, (&Block{Content: b}).Hash())
+			return nil
+		})
+		return h
+	}
+	s1 := &Summary{Chunker: ChunkerCDC, Blocks: hashes(content)}
+	s2 := &Summary{Chunker: ChunkerCDC, Blocks: hashes(edited)}
+
+	diff, change := s1.Diff(s2)
+	if !change {
+		t.FailNow()
+	}
+	changed := 0
+	for _, b := range diff {
+		if b != "" {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Fatalf("Expected 1 changed block, got %d of %d", changed, len(diff))
+	}
+}
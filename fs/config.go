@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Config stores the settings of a synchronized directory. It is kept in
+// the Index so the same settings are used each time the directory is scanned
+type Config struct {
+	BlockSize int64             `json:"block_size,omitempty"` // (average) size of blocks in Bytes
+	Chunker   string            `json:"chunker,omitempty"`    // name of the Chunker
+	Conflicts []ConflictRule    `json:"conflicts,omitempty"`  // resolution policies of Merge
+	Device    string            `json:"device,omitempty"`     // ID of this device in versions
+	Encoding  string            `json:"encoding,omitempty"`   // IndexEncodingJSON or IndexEncodingBinary
+	Hash      string            `json:"hash,omitempty"`       // algorithm used to hash blocks
+	Mergers   map[string]string `json:"mergers,omitempty"`    // MergerText or MergerJSON of each extension merged by Merge
+	Paranoid  bool              `json:"paranoid,omitempty"`   // rehash every file on each scan
+	Retention Retention         `json:"retention"`            // history kept by Index.Prune
+	Store     bool              `json:"store,omitempty"`      // keep blocks in a Store
+	Symlinks  string            `json:"symlinks,omitempty"`   // SymlinksIgnore, SymlinksFollow or SymlinksPreserve
+}
+
+// MakeConfig creates a Config with the default settings
+func MakeConfig() Config {
+	return Config{BlockSize: BlockSize, Chunker: ChunkerFixed, Hash: DefaultHash}
+}
+
+// NegotiateConfig decides the Config used to synchronize a directory with a
+// peer. An index without files adopts the block size of the other one,
+// otherwise both block sizes must be equal
+func NegotiateConfig(local *Index, remote *Index) (Config, error) {
+	c := local.Config
+	if c.blockSize() == remote.Config.blockSize() {
+		return c, nil
+	}
+	if len(local.Files) == 0 {
+		c.BlockSize = remote.Config.blockSize()
+		return c, nil
+	}
+	return c, fmt.Errorf("Block sizes do not match: local is %dB remote is %dB",
+		c.blockSize(), remote.Config.blockSize())
+}
+
+// Resolver returns the Resolver used by Merge to resolve conflicts with the
+// policies of Conflicts, invalid rules are skipped
+func (c Config) Resolver() Resolver {
+	var rules conflictRules
+	for _, r := range c.Conflicts {
+		if r.Validate() != nil {
+			continue
+		}
+		glob, _ := parseIgnoreRule("", r.Glob)
+		rules.globs = append(rules.globs, glob)
+		rules.resolvers = append(rules.resolvers, r.resolver())
+	}
+	return rules
+}
+
+// Validate checks that every setting of the Config is supported
+func (c Config) Validate() error {
+	if c.BlockSize%1024 != 0 {
+		return fmt.Errorf("Block size must be a multiple of 1kB, got %dB", c.BlockSize)
+	}
+	chunker, err := GetChunker(c.Chunker, c.BlockSize)
+	if err != nil {
+		return err
+	}
+	// blocks are sent with their size in kB
+	if chunker.MaxSize() > MaxBlockSize {
+		return fmt.Errorf("Block size is too big: %dB", c.BlockSize)
+	}
+	if c.Hash != "" && !StrongHash(c.Hash) {
+		return fmt.Errorf("Hash algorithm '%s' can't be used to index files", c.Hash)
+	}
+	if err := c.Retention.Validate(); err != nil {
+		return err
+	}
+	for _, r := range c.Conflicts {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	for ext, name := range c.Mergers {
+		if !strings.HasPrefix(ext, ".") || ext != strings.ToLower(ext) {
+			return fmt.Errorf("Invalid extension of merger: '%s'", ext)
+		}
+		if _, found := namedMergers[name]; !found {
+			return fmt.Errorf("Unknown merger: '%s'", name)
+		}
+	}
+	// the content of the files merged is read from the store
+	if len(c.Mergers) > 0 && !c.Store {
+		return fmt.Errorf("Mergers need the blocks of the files to be stored")
+	}
+	switch c.Encoding {
+	case "", IndexEncodingBinary, IndexEncodingJSON:
+	default:
+		return fmt.Errorf("Unknown index encoding: '%s'", c.Encoding)
+	}
+	switch c.Symlinks {
+	case "", SymlinksFollow, SymlinksIgnore, SymlinksPreserve:
+	default:
+		return fmt.Errorf("Unknown symlink policy: '%s'", c.Symlinks)
+	}
+	return nil
+}
+
+// blockSize returns the size of blocks, BlockSize if none is set
+func (c Config) blockSize() int64 {
+	if c.BlockSize == 0 {
+		return BlockSize
+	}
+	return c.BlockSize
+}
+
+// hash returns the algorithm used to hash blocks, indices written before
+// the algorithm was configurable are rehashed with DefaultHash
+func (c Config) hash() string {
+	if c.Hash == "" {
+		return DefaultHash
+	}
+	return c.Hash
+}
+
+// mergers returns the Merger of each extension in Mergers, unknown mergers
+// are skipped
+func (c Config) mergers() map[string]Merger {
+	m := make(map[string]Merger, len(c.Mergers))
+	for ext, name := range c.Mergers {
+		if merger, found := namedMergers[name]; found {
+			m[ext] = merger
+		}
+	}
+	return m
+}
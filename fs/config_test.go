@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"testing"
+)
+
+// TestConfig_Validate checks supported and unsupported settings
+func TestConfig_Validate(t *testing.T) {
+	valid := []Config{
+		MakeConfig(),
+		{},
+		{BlockSize: 128 * 1024, Chunker: ChunkerCDC, Hash: HashBLAKE2b},
+		{BlockSize: 8 * 1024 * 1024, Chunker: ChunkerFixed},
+		{Symlinks: SymlinksPreserve},
+		{Encoding: IndexEncodingBinary},
+		{Retention: Retention{Confirmed: true, MaxParents: 8}},
+		{Conflicts: []ConflictRule{{Glob: "*.txt", Policy: ConflictNewest}, {Policy: ConflictKeepBoth}}},
+		{Mergers: map[string]string{".txt": MergerText, ".json": MergerJSON}, Store: true},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	invalid := []Config{
+		{BlockSize: 1000},                                  // not a multiple of 1kB
+		{BlockSize: 1024},                                  // too small
+		{BlockSize: 64 * 1024 * 1024},                      // too big to be sent
+		{BlockSize: 32 * 1024 * 1024, Chunker: ChunkerCDC}, // biggest block too big
+		{Chunker: "unknown"},
+		{Hash: HashFNV64a},
+		{Symlinks: "copy"},
+		{Encoding: "xml"},
+		{Retention: Retention{MaxParents: -1}},
+		{Conflicts: []ConflictRule{{Policy: "merge"}}},
+		{Conflicts: []ConflictRule{{Policy: ConflictDevice}}},         // no device
+		{Mergers: map[string]string{".txt": MergerText}},              // no store
+		{Mergers: map[string]string{".txt": "diff3"}, Store: true},    // unknown merger
+		{Mergers: map[string]string{"txt": MergerText}, Store: true},  // not an extension
+		{Mergers: map[string]string{".TXT": MergerText}, Store: true}, // not lower case
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("Invalid config accepted: %v", c)
+		}
+	}
+}
+
+// TestNegotiateConfig negotiates the block size of an empty and a
+// non-empty index
+func TestNegotiateConfig(t *testing.T) {
+	local, _ := MakeIndex()
+	remote, _ := MakeIndex()
+	remote.Config.BlockSize = 128 * 1024
+
+	// empty index adopts the remote block size
+	c, err := NegotiateConfig(local, remote)
+	if err != nil || c.BlockSize != remote.Config.BlockSize {
+		t.FailNow()
+	}
+
+	// equal block sizes, the default one is used if none is set
+	local.Add(&Summary{ID: "id", Path: "/path"})
+	remote.Config.BlockSize = 0
+	if _, err = NegotiateConfig(local, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	// different block sizes
+	local.Config.BlockSize = 8 * 1024 * 1024
+	if _, err = NegotiateConfig(local, remote); err == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,233 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ConflictRule decides how the conflicts of the files matching Glob are
+// resolved, the first matching rule of Config.Conflicts is used
+//	Device:	ID of the device preferred by ConflictDevice
+//	Glob:	gitignore-style pattern, as in IgnoreFile, empty matches every file.
+//		A leading '!' matches the files the rest of the pattern doesn't
+//	Policy:	ConflictKeepBoth, ConflictNewest, ConflictLocal or ConflictDevice
+type ConflictRule struct {
+	Device string `json:"device,omitempty"`
+	Glob   string `json:"glob,omitempty"`
+	Policy string `json:"policy"`
+}
+
+// Validate checks that the policy of the rule is known and its glob valid
+func (r ConflictRule) Validate() error {
+	switch r.Policy {
+	case ConflictKeepBoth, ConflictNewest, ConflictLocal:
+	case ConflictDevice:
+		if r.Device == "" {
+			return fmt.Errorf("Conflict policy '%s' needs a device", r.Policy)
+		}
+	default:
+		return fmt.Errorf("Unknown conflict policy: '%s'", r.Policy)
+	}
+	if _, ok := parseIgnoreRule("", r.Glob); r.Glob != "" && !ok {
+		return fmt.Errorf("Invalid glob in conflict rule: '%s'", r.Glob)
+	}
+	return nil
+}
+
+// resolver returns the Resolver of the policy of the rule
+func (r ConflictRule) resolver() Resolver {
+	switch r.Policy {
+	case ConflictNewest:
+		return KeepNewest{}
+	case ConflictLocal:
+		return KeepLocal{}
+	case ConflictDevice:
+		return PreferDevice{Device: r.Device}
+	}
+	return KeepBoth{}
+}
+
+// Resolver decides which summaries are kept when two devices change the
+// same file concurrently. local is the summary of the Index being merged
+// into, both have the same path. The summaries kept replace the file in the
+// merged Index and must have different paths
+type Resolver interface {
+	Resolve(local *Summary, remote *Summary) []*Summary
+}
+
+// KeepBoth keeps both changes: the newest one in the path of the file and
+// the other one renamed as a conflict copy, see conflictPath. Directories
+// keep their path and files are renamed instead
+type KeepBoth struct{}
+
+// Resolve keeps both summaries, renaming one of them
+func (KeepBoth) Resolve(local *Summary, remote *Summary) []*Summary {
+	kept, renamed := local, remote
+	if remote.IsDir() || (!local.IsDir() && newer(remote, local)) {
+		kept, renamed = remote, local
+	}
+	copied := *renamed
+	copied.Path = conflictPath(renamed.Path, renamed.ModTime, changedBy(renamed, kept))
+	return []*Summary{kept, &copied}
+}
+
+// KeepLocal keeps the change made by this device and discards the other
+type KeepLocal struct{}
+
+// Resolve keeps the local summary
+func (KeepLocal) Resolve(local *Summary, remote *Summary) []*Summary {
+	return []*Summary{winner(local, remote)}
+}
+
+// KeepNewest keeps the change with the newest modification time and
+// discards the other one
+type KeepNewest struct{}
+
+// Resolve keeps the newest summary, or the one with the lowest ID if both
+// were modified at the same time
+func (KeepNewest) Resolve(local *Summary, remote *Summary) []*Summary {
+	if newer(remote, local) {
+		return []*Summary{winner(remote, local)}
+	}
+	return []*Summary{winner(local, remote)}
+}
+
+// PreferDevice keeps the change made by Device, if neither or both
+// summaries have changes of Device both are kept as KeepBoth does
+type PreferDevice struct {
+	Device string
+}
+
+// Resolve keeps the summary with the changes of the preferred device
+func (p PreferDevice) Resolve(local *Summary, remote *Summary) []*Summary {
+	l, r := local.Version[p.Device], remote.Version[p.Device]
+	switch {
+	case l > r:
+		return []*Summary{winner(local, remote)}
+	case r > l:
+		return []*Summary{winner(remote, local)}
+	}
+	return KeepBoth{}.Resolve(local, remote)
+}
+
+// conflictRules is the Resolver of a Config, which uses the first rule
+// matching the path of the file and KeepBoth if none does
+type conflictRules struct {
+	globs     []ignoreRule
+	resolvers []Resolver
+}
+
+// Resolve resolves the conflict with the policy of the matching rule
+func (c conflictRules) Resolve(local *Summary, remote *Summary) []*Summary {
+	for n, glob := range c.globs {
+		// rules without a glob have no pattern and match every file,
+		// negated rules those their pattern doesn't match
+		if glob.re == nil ||
+			glob.match(local.Path, local.IsDir() && remote.IsDir()) != glob.negate {
+			return c.resolvers[n].Resolve(local, remote)
+		}
+	}
+	return KeepBoth{}.Resolve(local, remote)
+}
+
+// resolverFunc is a function used as a Resolver
+type resolverFunc func(local *Summary, remote *Summary) []*Summary
+
+// Resolve calls f
+func (f resolverFunc) Resolve(local *Summary, remote *Summary) []*Summary {
+	return f(local, remote)
+}
+
+// changedBy returns a short name of the device that made the changes of s
+// that other lacks, the ID of s if it has no Version
+func changedBy(s *Summary, other *Summary) string {
+	device := ""
+	for d, n := range s.Version {
+		if n > other.Version[d] && (device == "" || d < device) {
+			device = d
+		}
+	}
+	if device == "" {
+		device = s.ID
+	}
+	if len(device) > 8 {
+		device = device[:8]
+	}
+	return device
+}
+
+// conflictPath returns the path a conflict copy of the file in p, modified
+// at modTime by device, is kept at. The extension of the file is kept so
+// 'report.docx' becomes 'report.sync-conflict-20060102-150405-device.docx',
+// the date is left out if the modification time is unknown
+func conflictPath(p string, modTime int64, device string) string {
+	stem, ext := splitExt(p)
+	if modTime == 0 {
+		return fmt.Sprintf("%s.sync-conflict-%s%s", stem, device, ext)
+	}
+	date := time.Unix(0, modTime).UTC().Format("20060102-150405")
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s", stem, date, device, ext)
+}
+
+// newer checks if s was modified after s2, or at the same time if its ID
+// is lower, so both peers choose the same summary
+func newer(s *Summary, s2 *Summary) bool {
+	if s.ModTime != s2.ModTime {
+		return s.ModTime > s2.ModTime
+	}
+	return s.ID < s2.ID
+}
+
+// splitExt splits p into the path without its extension and the extension,
+// hidden files such as '.profile' have none
+func splitExt(p string) (string, string) {
+	_, base := path.Split(p)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	return p[:len(p)-len(ext)], ext
+}
+
+// uniqueCopies renames the conflict copies among the summaries kept for the
+// file in p, those in other paths, if a different file already has their
+// path. The ID of the copy is appended to its name, so both peers choose the
+// same one
+func uniqueCopies(p string, kept []*Summary, taken func(*Summary) bool) []*Summary {
+	unique := make([]*Summary, len(kept))
+	for n, s := range kept {
+		unique[n] = s
+		if s.Path == p || !taken(s) {
+			continue
+		}
+		// copies keep the extension of the file, see conflictPath
+		_, ext := splitExt(p)
+		if !strings.HasSuffix(s.Path, ext) {
+			ext = ""
+		}
+		stem := s.Path[:len(s.Path)-len(ext)]
+		short := s.ID
+		if len(short) > 8 {
+			short = short[:8]
+		}
+		renamed := *s
+		renamed.Path = fmt.Sprintf("%s-%s%s", stem, short, ext)
+		if taken(&renamed) {
+			renamed.Path = fmt.Sprintf("%s-%s%s", stem, s.ID, ext)
+		}
+		unique[n] = &renamed
+	}
+	return unique
+}
+
+// winner returns a copy of s with the changes of both versions, so the
+// discarded summary is older than the kept one
+func winner(s *Summary, discarded *Summary) *Summary {
+	won := *s
+	if s.Version != nil || discarded.Version != nil {
+		won.Version = s.Version.Merge(discarded.Version)
+	}
+	return &won
+}
@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// testConflict returns two summaries of a file changed concurrently by
+// devices a and b, b changed it last
+func testConflict(path string) (*Summary, *Summary) {
+	modTime := time.Date(2018, 5, 1, 12, 30, 0, 0, time.UTC).UnixNano()
+	a := &Summary{ID: "f.a", Path: path, Blocks: []string{"1"}, ModTime: modTime,
+		Version: Version{"a": 1}}
+	b := &Summary{ID: "f.b", Path: path, Blocks: []string{"2"}, ModTime: modTime + 1,
+		Version: Version{"b": 1}}
+	return a, b
+}
+
+// TestConflictPath keeps the extension of conflict copies
+func TestConflictPath(t *testing.T) {
+	modTime := time.Date(2018, 5, 1, 12, 30, 0, 0, time.UTC).UnixNano()
+	paths := map[string]string{
+		"report.docx":     "report.sync-conflict-20180501-123000-dev.docx",
+		"a/report.tar.gz": "a/report.tar.sync-conflict-20180501-123000-dev.gz",
+		"a/.profile":      "a/.profile.sync-conflict-20180501-123000-dev",
+		"Makefile":        "Makefile.sync-conflict-20180501-123000-dev",
+	}
+	for p, expected := range paths {
+		if cp := conflictPath(p, modTime, "dev"); cp != expected {
+			t.Fatal(cp)
+		}
+	}
+	// unknown modification times are left out
+	if cp := conflictPath("report.docx", 0, "dev"); cp != "report.sync-conflict-dev.docx" {
+		t.Fatal(cp)
+	}
+}
+
+// TestKeepBoth renames the oldest change
+func TestKeepBoth(t *testing.T) {
+	a, b := testConflict("d/f.txt")
+	for _, kept := range [][]*Summary{KeepBoth{}.Resolve(a, b), KeepBoth{}.Resolve(b, a)} {
+		if len(kept) != 2 || kept[0] != b || kept[1].ID != a.ID ||
+			kept[1].Path != "d/f.sync-conflict-20180501-123000-a.txt" {
+			t.FailNow()
+		}
+	}
+	// directories keep their path
+	dir := &Summary{ID: "f.c", Path: a.Path, Perm: os.ModeDir | 0755, Version: Version{"c": 1}}
+	if kept := (KeepBoth{}).Resolve(dir, b); kept[0] != dir || kept[1].ID != b.ID {
+		t.FailNow()
+	}
+}
+
+// TestKeepLocal keeps the first summary
+func TestKeepLocal(t *testing.T) {
+	a, b := testConflict("f")
+	kept := KeepLocal{}.Resolve(a, b)
+	if len(kept) != 1 || kept[0].ID != a.ID || kept[0].Version.Compare(b.Version) != VersionNewer {
+		t.FailNow()
+	}
+}
+
+// TestKeepNewest keeps the latest change, whatever the order
+func TestKeepNewest(t *testing.T) {
+	a, b := testConflict("f")
+	for _, kept := range [][]*Summary{KeepNewest{}.Resolve(a, b), KeepNewest{}.Resolve(b, a)} {
+		if len(kept) != 1 || kept[0].ID != b.ID || kept[0].Version.Compare(a.Version) != VersionNewer {
+			t.FailNow()
+		}
+	}
+}
+
+// TestPreferDevice keeps the change of the preferred device
+func TestPreferDevice(t *testing.T) {
+	a, b := testConflict("f")
+	if kept := (PreferDevice{Device: "a"}).Resolve(b, a); len(kept) != 1 || kept[0].ID != a.ID {
+		t.FailNow()
+	}
+	// neither changed by the device
+	if kept := (PreferDevice{Device: "c"}).Resolve(a, b); len(kept) != 2 {
+		t.FailNow()
+	}
+}
+
+// TestConfig_Resolver uses the first rule matching the path of the file
+func TestConfig_Resolver(t *testing.T) {
+	c := Config{Conflicts: []ConflictRule{
+		{Policy: "unknown"},
+		{Glob: "*.log", Policy: ConflictNewest},
+		{Glob: "/conf/", Policy: ConflictLocal},
+		{Glob: "docs/**", Policy: ConflictDevice, Device: "a"},
+	}}
+	r := c.Resolver()
+	results := map[string]string{
+		"a/b.log":    "f.b",
+		"conf":       "", // only directories
+		"docs/x/y.z": "f.a",
+		"f":          "",
+	}
+	for path, id := range results {
+		local, remote := testConflict(path)
+		kept := r.Resolve(remote, local)
+		if (id == "" && len(kept) != 2) || (id != "" && (len(kept) != 1 || kept[0].ID != id)) {
+			t.Fatal(path, kept)
+		}
+	}
+
+	// negated globs match the files the rest of the pattern doesn't
+	c.Conflicts = []ConflictRule{{Glob: "!*.txt", Policy: ConflictNewest}}
+	r = c.Resolver()
+	for path, id := range map[string]string{"a.txt": "", "b.md": "f.b", "d/c.txt": ""} {
+		local, remote := testConflict(path)
+		kept := r.Resolve(remote, local)
+		if (id == "" && len(kept) != 2) || (id != "" && (len(kept) != 1 || kept[0].ID != id)) {
+			t.Fatal(path, kept)
+		}
+	}
+
+	// the local index decides the policy of the merge
+	a, b := testConflict("f")
+	i1, _ := MakeIndex(a)
+	i2, _ := MakeIndex(b)
+	i1.Config.Conflicts = []ConflictRule{{Policy: ConflictLocal}}
+	if m, err := Merge(i1, i2); err != nil || len(m.Files) != 1 || m.Files["f"].ID != a.ID {
+		t.FailNow()
+	}
+}
+
+// TestUniqueCopies renames conflict copies whose path is taken, keeping
+// their extension
+func TestUniqueCopies(t *testing.T) {
+	kept := &Summary{ID: "f.a", Path: "d/f.txt"}
+	copied := &Summary{ID: "0123456789", Path: "d/f.sync-conflict-b.txt"}
+	paths := map[string]bool{}
+	taken := func(s *Summary) bool { return paths[s.Path] }
+	if unique := uniqueCopies(kept.Path, []*Summary{kept, copied}, taken); unique[1] != copied {
+		t.FailNow()
+	}
+	paths[copied.Path] = true
+	unique := uniqueCopies(kept.Path, []*Summary{kept, copied}, taken)
+	if unique[0] != kept || unique[1].Path != "d/f.sync-conflict-b-01234567.txt" {
+		t.Fatal(unique[1].Path)
+	}
+	paths[unique[1].Path] = true
+	unique = uniqueCopies(kept.Path, []*Summary{kept, copied}, taken)
+	if unique[1].Path != "d/f.sync-conflict-b-0123456789.txt" || copied.Path != "d/f.sync-conflict-b.txt" {
+		t.Fatal(unique[1].Path)
+	}
+}
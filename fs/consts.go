@@ -1,11 +1,106 @@
 package fs
 
+import "math"
+
 const (
-	// BlockSize defines the size of each block in Bytes
+	// BlockSize defines the default size of each block in Bytes
 	BlockSize int64 = 1024 * 1024 // 1024 kB
 
+	// ChunkerFixed cuts files into blocks of the same size
+	ChunkerFixed = "fixed"
+	// ChunkerCDC cuts files into content-defined blocks of variable size
+	ChunkerCDC = "cdc"
+
+	// DefaultHash is the algorithm used to hash blocks
+	DefaultHash = HashSHA256
+	// HashBLAKE2b identifies 256 bit BLAKE2b hashes
+	HashBLAKE2b = "blake2b-256"
+	// HashFNV64a identifies 64 bit FNV-1a hashes, vulnerable to collisions
+	// and only kept to read older indices
+	HashFNV64a = "fnv64a"
+	// HashSHA256 identifies SHA-256 hashes
+	HashSHA256 = "sha256"
+
+	// ConflictDevice keeps the change made by a chosen device
+	ConflictDevice = "device"
+	// ConflictKeepBoth keeps both changes, one of them as a conflict copy,
+	// the default
+	ConflictKeepBoth = "keep-both"
+	// ConflictLocal keeps the change made by this device
+	ConflictLocal = "local"
+	// ConflictNewest keeps the most recently modified change
+	ConflictNewest = "newest"
+
+	// MergerJSON merges JSON documents key by key, see JSONMerger
+	MergerJSON = "json"
+	// MergerText merges text line by line, see TextMerger
+	MergerText = "text"
+
+	// IgnoreFile is the name of the files listing the paths that are not
+	// synchronized
+	IgnoreFile = ".sakabanignore"
+
+	// SymlinksFollow indexes the targets of symbolic links as if they were
+	// in the path of the link
+	SymlinksFollow = "follow"
+	// SymlinksIgnore skips symbolic links, the default
+	SymlinksIgnore = "ignore"
+	// SymlinksPreserve indexes symbolic links as links, their targets are
+	// synchronized as text
+	SymlinksPreserve = "preserve"
+
+	// IndexEncodingBinary writes indices in a compact binary layout
+	IndexEncodingBinary = "binary"
+	// IndexEncodingJSON writes indices as JSON, the default
+	IndexEncodingJSON = "json"
+	// IndexSchema is the version of the format indices are written in,
+	// indices written in older formats are migrated when they are read
+	IndexSchema = 1
+
 	// SummaryDir is the relative directory the summary is stored at
 	SummaryDir = ".sakaban"
 	// SummaryFile is the relative name of the file containing the summary
 	SummaryFile = "sakaban.json"
+	// SummaryBackupExt is appended to the name of an index file to name the
+	// copy of its previous generation
+	SummaryBackupExt = ".bak"
+	// StoreDir is the directory, inside SummaryDir, of the block Store
+	StoreDir = "blocks"
+	// TmpDir is the directory, inside SummaryDir, files are written to
+	// before they replace the synchronized ones
+	TmpDir = "tmp"
+
+	// MinBlockSize is the smallest block size a directory can be configured with
+	MinBlockSize int64 = 4 * 1024 // 4 kB
+	// MaxBlockSize is the size of the biggest block that can be sent, in kB
+	// that fit in 16 bits
+	MaxBlockSize int64 = math.MaxUint16 * 1024 // 64 MB
+
+	// VersionEqual is the result of comparing a Version with itself
+	VersionEqual = 0
+	// VersionOlder means the Version lacks changes the other one has
+	VersionOlder = 1
+	// VersionNewer means the Version has every change of the other one, and more
+	VersionNewer = 2
+	// VersionConcurrent means both versions have changes the other lacks
+	VersionConcurrent = 3
+
+	// maxIndexFieldSize limits the length of the fields and lists read from
+	// binary indices, which may come from other peers
+	maxIndexFieldSize = 1 << 24
+
+	// maxMergeLines limits the product of the number of lines of two texts
+	// compared by TextMerger, once the lines they share at their start and
+	// end are left aside
+	maxMergeLines = 1 << 22
+	// maxMergeSize limits the size of the files StoreMerger merges
+	maxMergeSize = 16 * 1024 * 1024 // 16 MB
+
+	// moveSimilarity is the fraction of blocks a file created by Update
+	// must share with a missing one to be the same file, moved and changed
+	moveSimilarity = 0.5
+
+	/* content-defined chunking */
+	cdcMinRatio = 4 // smallest block is a quarter of the average
+	cdcMaxRatio = 4 // biggest block is four times the average
 )
@@ -0,0 +1,268 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Signature describes the copy of a file a peer already has, so the peer
+// holding the new version can send only what differs (rsync algorithm)
+//	BlockSize: size of the blocks the copy was divided in
+//	Hash: algorithm used to create Strong
+//	Size: size of the copy in Bytes
+//	Weak: rolling checksum of each block
+//	Strong: hash of each block
+type Signature struct {
+	BlockSize int64    `json:"block_size"`
+	Hash      string   `json:"hash"`
+	Size      int64    `json:"size"`
+	Weak      []uint32 `json:"weak"`
+	Strong    []string `json:"strong"`
+}
+
+// Operation is an instruction to rebuild a file: copy block BlockN of the
+// old copy or, if Literal is not nil, write Literal
+type Operation struct {
+	BlockN  uint64
+	Literal []byte
+}
+
+// Delta lists the operations that turn the old copy of a file into the new one
+type Delta []Operation
+
+// ApplyDelta writes to w the result of applying d to the old copy of a
+// file in basis, divided in blocks of blockSize
+func ApplyDelta(basis string, d Delta, blockSize int64, w io.Writer) error {
+	var file *os.File
+	for _, op := range d {
+		if op.Literal != nil {
+			if _, err := w.Write(op.Literal); err != nil {
+				return err
+			}
+			continue
+		}
+		if file == nil {
+			var err error
+			if file, err = os.Open(basis); err != nil {
+				return err
+			}
+			defer file.Close()
+		}
+		block := io.NewSectionReader(file, int64(op.BlockN)*blockSize, blockSize)
+		if _, err := io.Copy(w, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MakeDelta compares the file in path with the signature of an old copy and
+// returns the operations needed to rebuild it from that copy. A window of
+// the size of a block is rolled over the file looking for blocks whose weak
+// checksum and then strong hash match a block of the old copy, the bytes
+// in between are sent as literals
+func MakeDelta(path string, sig *Signature) (Delta, error) {
+	if err := sig.validate(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bs := int(sig.BlockSize)
+	table := make(map[uint32][]int)
+	for i, weak := range sig.Weak {
+		table[weak] = append(table[weak], i)
+	}
+	// the last block of the old copy may be shorter
+	lastSize := 0
+	if n := len(sig.Weak); n > 0 {
+		lastSize = int(sig.Size - int64(n-1)*sig.BlockSize)
+	}
+
+	d := make(Delta, 0)
+	literal := make([]byte, 0, bs)
+	flush := func() {
+		if len(literal) > 0 {
+			d = append(d, Operation{Literal: literal})
+			literal = make([]byte, 0, bs)
+		}
+	}
+	// match returns the block of the old copy equal to window
+	match := func(weak uint32, window []byte) (int, bool) {
+		candidates, found := table[weak]
+		if !found {
+			return 0, false
+		}
+		strong := hashContent(sig.Hash, window)
+		for _, i := range candidates {
+			if sig.Strong[i] == strong && (i < len(sig.Weak)-1 || len(window) == lastSize) {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	buf := make([]byte, 0, 4*bs)
+	pos := 0
+	eof := false
+	var rs rollingSum
+	rolling := false
+	for {
+		// keep a whole window in the buffer
+		if !eof && len(buf)-pos < bs+1 {
+			buf = buf[:copy(buf, buf[pos:])]
+			pos = 0
+			for !eof && len(buf) < cap(buf) {
+				n, err := file.Read(buf[len(buf):cap(buf)])
+				buf = buf[:len(buf)+n]
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+		n := len(buf) - pos
+		if n == 0 {
+			break
+		}
+		if n < bs {
+			// tail of the file, only the last block of the old copy fits
+			if n == lastSize {
+				if i, found := match(weakSum(buf[pos:]), buf[pos:]); found {
+					flush()
+					d = append(d, Operation{BlockN: uint64(i)})
+					break
+				}
+			}
+			literal = append(literal, buf[pos:]...)
+			break
+		}
+		window := buf[pos : pos+bs]
+		if !rolling {
+			rs = makeRollingSum(window)
+			rolling = true
+		}
+		if i, found := match(rs.sum(), window); found {
+			flush()
+			d = append(d, Operation{BlockN: uint64(i)})
+			pos += bs
+			rolling = false
+			continue
+		}
+		literal = append(literal, buf[pos])
+		if len(literal) == bs {
+			flush()
+		}
+		if pos+bs < len(buf) {
+			rs.roll(buf[pos], buf[pos+bs])
+		} else {
+			rolling = false
+		}
+		pos++
+	}
+	flush()
+	return d, nil
+}
+
+// MakeSignature computes the Signature of the file in path dividing it in
+// blocks of blockSize, hashed with algorithm
+func MakeSignature(path string, blockSize int64, algorithm string) (*Signature, error) {
+	if err := ValidHash(algorithm); err != nil {
+		return nil, err
+	}
+	chunker, err := GetChunker(ChunkerFixed, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	r, err := OpenBlockReader(path, chunker)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	sig := Signature{
+		BlockSize: chunker.MaxSize(),
+		Hash:      algorithm,
+		Weak:      make([]uint32, 0),
+		Strong:    make([]string, 0),
+	}
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sig.Size += int64(b.Size())
+		sig.Weak = append(sig.Weak, weakSum(b.Content))
+		sig.Strong = append(sig.Strong, b.HashWith(algorithm))
+	}
+	return &sig, nil
+}
+
+// Literals returns the number of Bytes sent as literals
+func (d Delta) Literals() int64 {
+	var n int64
+	for _, op := range d {
+		n += int64(len(op.Literal))
+	}
+	return n
+}
+
+// validate checks that a received signature can be used to create a
+// Delta, its block size must be one a Config allows
+func (sig *Signature) validate() error {
+	if sig.BlockSize < MinBlockSize || sig.BlockSize > MaxBlockSize || len(sig.Weak) != len(sig.Strong) {
+		return errors.New("Invalid signature")
+	}
+	if len(sig.Weak) > maxIndexFieldSize {
+		return fmt.Errorf("Too many blocks in signature: %d", len(sig.Weak))
+	}
+	n := int64(len(sig.Weak))
+	if sig.Size > n*sig.BlockSize || (n > 0 && sig.Size <= (n-1)*sig.BlockSize) {
+		return errors.New("Signature size doesn't match its blocks")
+	}
+	return ValidHash(sig.Hash)
+}
+
+// rollingSum is the weak checksum used by rsync: a is the sum of the bytes
+// of the window and b the sum of each byte weighted by its distance to the
+// end of the window, so both can be updated in constant time when the
+// window moves one byte
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+// makeRollingSum computes the checksum of window
+func makeRollingSum(window []byte) rollingSum {
+	rs := rollingSum{n: uint32(len(window))}
+	for i, c := range window {
+		rs.a += uint32(c)
+		rs.b += uint32(len(window)-i) * uint32(c)
+	}
+	return rs
+}
+
+// roll moves the window one byte, out leaves it and in enters it
+func (rs *rollingSum) roll(out byte, in byte) {
+	rs.a += uint32(in) - uint32(out)
+	rs.b += rs.a - rs.n*uint32(out)
+}
+
+// sum returns the checksum of the window
+func (rs rollingSum) sum() uint32 {
+	return (rs.b&0xffff)<<16 | rs.a&0xffff
+}
+
+// weakSum returns the rolling checksum of content
+func weakSum(content []byte) uint32 {
+	return makeRollingSum(content).sum()
+}
@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMakeDelta edits the middle of a file and rebuilds it from the delta
+// of the old copy, only the inserted bytes are sent as literals
+func TestMakeDelta(t *testing.T) {
+	blockSize := int64(MinBlockSize)
+	old := make([]byte, 20*blockSize+123)
+	rand.Read(old)
+	insert := []byte("inserted in the middle")
+	content := append(append(append([]byte{}, old[:5000]...), insert...), old[5000:]...)
+
+	dir := filepath.Join(testDir, "MakeDelta")
+	os.MkdirAll(dir, 0755)
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	ioutil.WriteFile(oldPath, old, 0644)
+	ioutil.WriteFile(newPath, content, 0644)
+
+	sig, err := MakeSignature(oldPath, blockSize, HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Size != int64(len(old)) || len(sig.Weak) != 21 {
+		t.FailNow()
+	}
+	d, err := MakeDelta(newPath, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the block containing the insertion is sent as literals
+	if d.Literals() != blockSize+int64(len(insert)) {
+		t.Fatalf("Expected %dB of literals, got %dB", blockSize+int64(len(insert)), d.Literals())
+	}
+	var buf bytes.Buffer
+	if err = ApplyDelta(oldPath, d, sig.BlockSize, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.FailNow()
+	}
+
+	// nothing in common
+	sig, _ = MakeSignature(muffinPath, blockSize, HashSHA256)
+	d, _ = MakeDelta(newPath, sig)
+	if d.Literals() != int64(len(content)) {
+		t.FailNow()
+	}
+
+	// invalid signatures
+	if _, err = MakeDelta(newPath, &Signature{Hash: HashSHA256}); err == nil {
+		t.FailNow()
+	}
+	if _, err = MakeDelta(newPath, &Signature{BlockSize: blockSize, Hash: "md4"}); err == nil {
+		t.FailNow()
+	}
+	sig = &Signature{BlockSize: blockSize, Hash: HashSHA256, Size: 2 * blockSize,
+		Weak: []uint32{0}, Strong: []string{""}}
+	if _, err = MakeDelta(newPath, sig); err == nil {
+		t.FailNow()
+	}
+	// block sizes a Config doesn't allow
+	for _, size := range []int64{1, MaxBlockSize + 1024, 1 << 50} {
+		sig = &Signature{BlockSize: size, Hash: HashSHA256, Size: size, Weak: []uint32{0}, Strong: []string{""}}
+		if _, err = MakeDelta(newPath, sig); err == nil {
+			t.Fatal(size)
+		}
+	}
+}
+
+// TestFile_WriteDelta replaces a file with the result of applying a delta
+func TestFile_WriteDelta(t *testing.T) {
+	blockSize := int64(MinBlockSize)
+	dir := filepath.Join(testDir, "WriteDelta")
+	os.MkdirAll(dir, 0755)
+	path := filepath.Join(dir, "muffin.jpg")
+	content, _ := ioutil.ReadFile(muffinPath)
+	old := append([]byte{}, content...)
+	copy(old[3*blockSize:], []byte("changed"))
+	ioutil.WriteFile(path, old, 0644)
+
+	sig, _ := MakeSignature(path, blockSize, HashSHA256)
+	d, err := MakeDelta(muffinPath, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := MakeSummaryFromPath(muffinPath, MakeConfig())
+	f := File{Path: path, Perm: 0644}
+
+	// the result doesn't match the summary
+	wrong := *expected
+	wrong.Blocks = append([]string{}, expected.Blocks...)
+	wrong.Blocks[0] = "0"
+	if err = f.WriteDelta(d, blockSize, &wrong); err == nil {
+		t.FailNow()
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, old) {
+		t.FailNow()
+	}
+
+	if err = f.WriteDelta(d, blockSize, expected); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, content) {
+		t.FailNow()
+	}
+}
+
+// TestRollingSum compares a rolled checksum with one computed from scratch
+func TestRollingSum(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.Read(content)
+	window := 100
+	rs := makeRollingSum(content[:window])
+	for i := 1; i+window <= len(content); i++ {
+		rs.roll(content[i-1], content[i+window-1])
+		if rs.sum() != weakSum(content[i:i+window]) {
+			t.FailNow()
+		}
+	}
+}
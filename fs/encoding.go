@@ -0,0 +1,408 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// binaryMagic starts every Index written with IndexEncodingBinary, JSON
+// indices start with '{' so both can be told apart when they are read
+var binaryMagic = []byte("SKBI")
+
+// binaryIndexVersion is the version of the binary layout written by
+// EncodeIndex, older layouts can still be read
+const binaryIndexVersion = 2
+
+// EncodeIndex writes i to w using encoding, IndexEncodingJSON if it is
+// empty. Binary indices are written as they are encoded, without building
+// them in memory. Their layout, after binaryMagic and the version of the
+// layout, is: the schema of the Index, its Config as JSON and the number
+// of files, parents and deletions, each followed by their summaries.
+// Summaries are not stored with their keys, which are their path or ID.
+// Integers are varints, IDs that are UUIDs and hex encoded hashes are
+// stored as the bytes they encode and repeated strings, such as the IDs of
+// devices, are stored once and referenced by their position afterwards
+func EncodeIndex(w io.Writer, i *Index, encoding string) error {
+	switch encoding {
+	case "", IndexEncodingJSON:
+		content, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(content)
+		return err
+	case IndexEncodingBinary:
+	default:
+		return fmt.Errorf("Unknown index encoding: '%s'", encoding)
+	}
+	config, err := json.Marshal(i.Config)
+	if err != nil {
+		return err
+	}
+	e := &indexEncoder{w: bufio.NewWriter(w), symbols: make(map[string]uint64)}
+	e.write(binaryMagic)
+	e.uvarint(binaryIndexVersion)
+	e.uvarint(uint64(i.Schema))
+	e.bytes(config)
+	for _, summaries := range []map[string]*Summary{i.Files, i.Parents, i.Deletions} {
+		keys := make([]string, 0, len(summaries))
+		for k := range summaries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.uvarint(uint64(len(keys)))
+		for _, k := range keys {
+			e.summary(summaries[k])
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// DecodeIndex reads an Index written by EncodeIndex and returns the
+// encoding it was written in, which is detected. Indices are not migrated
+func DecodeIndex(r io.Reader) (*Index, string, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(binaryMagic)); !bytes.Equal(magic, binaryMagic) {
+		i := new(Index)
+		if err := json.NewDecoder(br).Decode(i); err != nil {
+			return nil, "", err
+		}
+		return i, IndexEncodingJSON, nil
+	}
+	br.Discard(len(binaryMagic))
+	d := &indexDecoder{r: br}
+	if d.version = d.uvarint(); d.err == nil && (d.version < 1 || d.version > binaryIndexVersion) {
+		return nil, "", fmt.Errorf("Unsupported binary index version: %d", d.version)
+	}
+	i := new(Index)
+	i.Schema = int(d.uvarint())
+	if config := d.bytes(); d.err == nil {
+		if err := json.Unmarshal(config, &i.Config); err != nil {
+			return nil, "", err
+		}
+	}
+	i.Files = d.summaries(func(s *Summary) string { return s.Path })
+	i.Parents = d.summaries(func(s *Summary) string { return s.ID })
+	i.Deletions = d.summaries(func(s *Summary) string { return s.ID })
+	if d.err != nil {
+		return nil, "", d.err
+	}
+	return i, IndexEncodingBinary, nil
+}
+
+// indexEncoder writes the fields of a binary Index, the first error is
+// kept and the rest of writes are skipped
+type indexEncoder struct {
+	err     error
+	symbols map[string]uint64 // position of each string written by symbol
+	w       *bufio.Writer
+}
+
+// bytes writes the length of b and b
+func (e *indexEncoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.write(b)
+}
+
+// hex writes a hex encoded hash as the bytes it encodes, the lowest bit of
+// the length is set, other strings are written as they are
+func (e *indexEncoder) hex(s string) {
+	if b, err := hex.DecodeString(s); err == nil && s != "" && hex.EncodeToString(b) == s {
+		e.uvarint(uint64(len(b))<<1 | 1)
+		e.write(b)
+		return
+	}
+	e.uvarint(uint64(len(s)) << 1)
+	e.write([]byte(s))
+}
+
+// id writes an ID that is a UUID as its 16 bytes, with a length of 1, other
+// IDs are written as hex does with strings
+func (e *indexEncoder) id(s string) {
+	if id, err := uuid.FromString(s); err == nil && id.String() == s {
+		e.uvarint(1)
+		e.write(id.Bytes())
+		return
+	}
+	e.uvarint(uint64(len(s)) << 1)
+	e.write([]byte(s))
+}
+
+// summary writes every field of s
+func (e *indexEncoder) summary(s *Summary) {
+	e.bytes([]byte(s.Path))
+	e.id(s.ID)
+	e.id(s.Parent)
+	e.uvarint(uint64(s.Perm))
+	e.symbol(s.Hash)
+	e.symbol(s.Chunker)
+	e.varint(s.BlockSize)
+	e.hex(s.Digest)
+	e.varint(s.Size)
+	e.uvarint(s.Inode)
+	e.varint(s.ModTime)
+	e.varint(s.Retired) // since version 2
+	e.bytes([]byte(s.Target))
+	// nil and empty slices are told apart, the length is stored plus one
+	e.uvarint(length(s.Blocks == nil, len(s.Blocks)))
+	for _, block := range s.Blocks {
+		e.hex(block)
+	}
+	e.uvarint(length(s.Sizes == nil, len(s.Sizes)))
+	for _, size := range s.Sizes {
+		e.varint(size)
+	}
+	// sorted, so only the difference with the previous one is stored
+	e.uvarint(length(s.Zeros == nil, len(s.Zeros)))
+	var previous uint64
+	for _, n := range s.Zeros {
+		e.uvarint(n - previous)
+		previous = n
+	}
+	devices := make([]string, 0, len(s.Version))
+	for device := range s.Version {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	e.uvarint(length(s.Version == nil, len(devices)))
+	for _, device := range devices {
+		e.symbol(device)
+		e.uvarint(s.Version[device])
+	}
+}
+
+// symbol writes a string the first time it is written, preceded by a zero,
+// and its position plus one afterwards
+func (e *indexEncoder) symbol(s string) {
+	if n, found := e.symbols[s]; found {
+		e.uvarint(n + 1)
+		return
+	}
+	e.symbols[s] = uint64(len(e.symbols))
+	e.uvarint(0)
+	e.bytes([]byte(s))
+}
+
+// uvarint writes an unsigned integer
+func (e *indexEncoder) uvarint(n uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.write(buf[:binary.PutUvarint(buf[:], n)])
+}
+
+// varint writes a signed integer
+func (e *indexEncoder) varint(n int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.write(buf[:binary.PutVarint(buf[:], n)])
+}
+
+// write writes b unless a previous write failed
+func (e *indexEncoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+// indexDecoder reads the fields written by indexEncoder, the first error
+// is kept and the rest of reads return zero values
+type indexDecoder struct {
+	err     error
+	r       *bufio.Reader
+	symbols []string
+	version uint64 // of the layout, fields added later are not read from older ones
+}
+
+// bytes reads a length and as many bytes, lengths are checked before
+// anything is allocated as indices may come from other peers
+func (d *indexDecoder) bytes() []byte {
+	return d.read(d.uvarint())
+}
+
+// count reads a length written by length, nil is returned as -1
+func (d *indexDecoder) count() int {
+	n := d.uvarint()
+	if n > maxIndexFieldSize {
+		d.fail(fmt.Errorf("Too many elements in index: %d", n))
+		return -1
+	}
+	return int(n) - 1
+}
+
+// fail keeps err unless there is an error already
+func (d *indexDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// hex reads a string written by indexEncoder.hex
+func (d *indexDecoder) hex() string {
+	n := d.uvarint()
+	b := d.read(n >> 1)
+	if n&1 == 1 {
+		return hex.EncodeToString(b)
+	}
+	return string(b)
+}
+
+// id reads an ID written by indexEncoder.id
+func (d *indexDecoder) id() string {
+	n := d.uvarint()
+	if n == 1 {
+		id, err := uuid.FromBytes(d.read(uuid.Size))
+		if err != nil {
+			d.fail(err)
+			return ""
+		}
+		return id.String()
+	}
+	return string(d.read(n >> 1))
+}
+
+// read reads n bytes
+func (d *indexDecoder) read(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > maxIndexFieldSize {
+		d.fail(fmt.Errorf("Index field is too big: %dB", n))
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.fail(err)
+		return nil
+	}
+	return b
+}
+
+// summaries reads a number of summaries and indexes them by key
+func (d *indexDecoder) summaries(key func(*Summary) string) map[string]*Summary {
+	n := d.uvarint()
+	m := make(map[string]*Summary)
+	for ; n > 0 && d.err == nil; n-- {
+		s := d.summary()
+		if _, found := m[key(s)]; found {
+			d.fail(fmt.Errorf("Repeated summary in index: '%s'", key(s)))
+		}
+		m[key(s)] = s
+	}
+	return m
+}
+
+// summary reads a Summary written by indexEncoder.summary
+func (d *indexDecoder) summary() *Summary {
+	s := new(Summary)
+	s.Path = string(d.bytes())
+	s.ID = d.id()
+	s.Parent = d.id()
+	s.Perm = os.FileMode(d.uvarint())
+	s.Hash = d.symbol()
+	s.Chunker = d.symbol()
+	s.BlockSize = d.varint()
+	s.Digest = d.hex()
+	s.Size = d.varint()
+	s.Inode = d.uvarint()
+	s.ModTime = d.varint()
+	if d.version >= 2 {
+		s.Retired = d.varint()
+	}
+	s.Target = string(d.bytes())
+	if n := d.count(); n >= 0 {
+		s.Blocks = make([]string, 0, capacity(n))
+		for ; n > 0 && d.err == nil; n-- {
+			s.Blocks = append(s.Blocks, d.hex())
+		}
+	}
+	if n := d.count(); n >= 0 {
+		s.Sizes = make([]int64, 0, capacity(n))
+		for ; n > 0 && d.err == nil; n-- {
+			s.Sizes = append(s.Sizes, d.varint())
+		}
+		s.cacheOffsets()
+	}
+	if n := d.count(); n >= 0 {
+		s.Zeros = make([]uint64, 0, capacity(n))
+		var previous uint64
+		for ; n > 0 && d.err == nil; n-- {
+			previous += d.uvarint()
+			s.Zeros = append(s.Zeros, previous)
+		}
+	}
+	if n := d.count(); n >= 0 {
+		s.Version = make(Version)
+		for ; n > 0 && d.err == nil; n-- {
+			device := d.symbol()
+			s.Version[device] = d.uvarint()
+		}
+	}
+	return s
+}
+
+// symbol reads a string written by indexEncoder.symbol
+func (d *indexDecoder) symbol() string {
+	n := d.uvarint()
+	if n == 0 {
+		s := string(d.bytes())
+		d.symbols = append(d.symbols, s)
+		return s
+	}
+	if n > uint64(len(d.symbols)) {
+		d.fail(errors.New("Invalid reference in index"))
+		return ""
+	}
+	return d.symbols[n-1]
+}
+
+// uvarint reads an unsigned integer
+func (d *indexDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return n
+}
+
+// varint reads a signed integer
+func (d *indexDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return n
+}
+
+// capacity limits the memory allocated for n elements before they are read
+func capacity(n int) int {
+	if n > 1024 {
+		return 1024
+	}
+	return n
+}
+
+// length returns the length of a slice as written in binary indices: zero
+// if it is nil and its length plus one otherwise
+func length(isNil bool, n int) uint64 {
+	if isNil {
+		return 0
+	}
+	return uint64(n) + 1
+}
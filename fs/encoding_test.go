@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// testEncodingIndex creates an Index using every field of Summary
+func testEncodingIndex() *Index {
+	id1, _ := uuid.NewV4()
+	id2, _ := uuid.NewV4()
+	device, _ := uuid.NewV4()
+	i, _ := MakeIndex(
+		&Summary{ID: id2.String(), Parent: id1.String(), Path: "a/b", Hash: HashSHA256,
+			Chunker: ChunkerCDC, BlockSize: BlockSize, Digest: "00ff", Size: 3 * BlockSize,
+			Inode: 42, ModTime: -1, Perm: 0644, Blocks: []string{"0a0b", "", "0a0b"},
+			Sizes: []int64{BlockSize, BlockSize, BlockSize}, Zeros: []uint64{1, 2},
+			Version: Version{device.String(): 2, "other": 1}},
+		&Summary{ID: "d", Path: "a", Hash: HashSHA256, Perm: os.ModeDir | 0755,
+			Blocks: []string{}, Version: Version{}},
+		&Summary{ID: "l", Path: "l", Perm: os.ModeSymlink | 0777, Target: "a/b",
+			Blocks: []string{}, Version: Version{device.String(): 1}},
+		// hashes of older indices and odd IDs are kept as they are
+		&Summary{ID: "ID", Parent: id1.String() + "x", Path: "c", Hash: HashFNV64a,
+			Blocks: []string{"0A", "abc"}, Digest: "not hex"},
+	)
+	i.Config.Device = device.String()
+	i.AddParent(&Summary{ID: id1.String(), Path: "a/b", Blocks: []string{"0a0b"}})
+	i.AddDeletion(&Summary{ID: id1.String() + "x", Path: "", Blocks: nil})
+	return i
+}
+
+// TestEncodeIndex encodes an Index in every encoding and decodes it, the
+// result must be the same as encoding it as JSON
+func TestEncodeIndex(t *testing.T) {
+	i := testEncodingIndex()
+	expected, _ := json.Marshal(i)
+	sizes := make(map[string]int)
+	for _, encoding := range []string{"", IndexEncodingJSON, IndexEncodingBinary} {
+		var buf bytes.Buffer
+		if err := EncodeIndex(&buf, i, encoding); err != nil {
+			t.Fatal(err)
+		}
+		sizes[encoding] = buf.Len()
+		decoded, detected, err := DecodeIndex(&buf)
+		if err != nil {
+			t.Fatal(encoding, err)
+		}
+		if encoding != "" && detected != encoding {
+			t.Fatal(encoding, detected)
+		}
+		if got, _ := json.Marshal(decoded); !bytes.Equal(got, expected) {
+			t.Fatalf("%s:\n%s\n%s", encoding, got, expected)
+		}
+	}
+	if sizes[IndexEncodingBinary] >= sizes[IndexEncodingJSON]/2 {
+		t.Fatal(sizes)
+	}
+	// the same Index is always encoded the same way
+	var b1, b2 bytes.Buffer
+	EncodeIndex(&b1, i, IndexEncodingBinary)
+	EncodeIndex(&b2, i, IndexEncodingBinary)
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+		t.FailNow()
+	}
+
+	if err := EncodeIndex(&b1, i, "xml"); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestDecodeIndex decodes truncated and corrupted binary indices
+func TestDecodeIndex(t *testing.T) {
+	var buf bytes.Buffer
+	EncodeIndex(&buf, testEncodingIndex(), IndexEncodingBinary)
+	encoded := buf.Bytes()
+	for n := len(binaryMagic); n < len(encoded); n++ {
+		if _, _, err := DecodeIndex(bytes.NewReader(encoded[:n])); err == nil {
+			t.Fatal("Decoded an index truncated at", n)
+		}
+	}
+	// unknown version of the layout
+	corrupted := append(append([]byte{}, binaryMagic...), 42)
+	if _, _, err := DecodeIndex(bytes.NewReader(corrupted)); err == nil {
+		t.FailNow()
+	}
+	// huge lengths are not allocated
+	corrupted = append(append([]byte{}, binaryMagic...), binaryIndexVersion, 1,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	if _, _, err := DecodeIndex(bytes.NewReader(corrupted)); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestWriteIndex_Binary writes and reads a binary Index
+func TestWriteIndex_Binary(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "WriteIndexBinary")
+	os.MkdirAll(unitTestDir, 0755)
+	filename := filepath.Join(unitTestDir, SummaryFile)
+	i := testEncodingIndex()
+	i.Config.Encoding = IndexEncodingBinary
+	if err := WriteIndex(*i, filename); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(filename); !bytes.HasPrefix(content, binaryMagic) {
+		t.FailNow()
+	}
+	read, err := ReadIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := json.Marshal(i)
+	if got, _ := json.Marshal(read); !bytes.Equal(got, expected) {
+		t.Fatalf("\n%s\n%s", got, expected)
+	}
+}
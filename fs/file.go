@@ -1,10 +1,13 @@
 package fs
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -12,35 +15,60 @@ import (
 // File represents a file
 //	ID: unique id of the file
 //	Path: path to the file
+//	Chunker: name of the Chunker used to divide the file
+//	Hash: algorithm used to hash the blocks of the file
+//	BlockSize: size of the blocks given to the Chunker
 //	Blocks: Blocks that form the file
 type File struct {
-	ID     uuid.UUID
-	Parent uuid.UUID
-	Path   string
-	Perm   os.FileMode // permission of the file
-	Blocks []*Block
+	ID        uuid.UUID
+	Parent    uuid.UUID
+	Path      string
+	Perm      os.FileMode // permission of the file
+	Chunker   string
+	Hash      string
+	BlockSize int64
+	Blocks    []*Block
 }
 
 // MakeFile is the default constructor for File
 // it generates an ID and ensures that the path is valid
 func MakeFile(path string) (*File, error) {
+	return MakeFileWithConfig(path, MakeConfig())
+}
+
+// MakeFileWithConfig creates a File whose blocks are cut and hashed as
+// set in c
+func MakeFileWithConfig(path string, c Config) (*File, error) {
 	id, _ := uuid.NewV4()
 	if !IsFile(path) {
 		return nil, fmt.Errorf("Not a valid path to a file: '%s'", path)
 	}
+	if _, err := GetChunker(c.Chunker, c.BlockSize); err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	f := File{ID: id, Path: path, Perm: info.Mode()}
-	blocks, _ := f.Slice()
+	f := File{
+		ID:        id,
+		Path:      path,
+		Perm:      info.Mode(),
+		Chunker:   c.Chunker,
+		Hash:      c.hash(),
+		BlockSize: c.blockSize(),
+	}
+	blocks, err := f.Slice()
+	if err != nil {
+		return nil, err
+	}
 	f.Blocks = blocks
 	return &f, nil
 }
 
 // MakeFileFromSummary creates a File given a Summary
 func MakeFileFromSummary(s *Summary) (*File, error) {
-	f, err := MakeFile(s.Path)
+	f, err := MakeFileWithConfig(s.Path, s.config())
 	if err != nil {
 		return nil, err
 	}
@@ -56,6 +84,7 @@ func MakeFileFromSummary(s *Summary) (*File, error) {
 		}
 	}
 	f.Perm = s.Perm
+	f.Hash = s.Hash
 	return f, nil
 }
 
@@ -93,8 +122,12 @@ func (f *File) Equals(f2 *File) bool {
 	return true
 }
 
-// Slice divides a file into Blocks
+// Slice divides a file into Blocks using the Chunker of the file
 func (f *File) Slice() ([]*Block, error) {
+	chunker, err := GetChunker(f.Chunker, f.BlockSize)
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.Open(f.Path)
 	if err != nil {
 		return nil, err
@@ -102,18 +135,12 @@ func (f *File) Slice() ([]*Block, error) {
 	defer file.Close()
 	blocks := make([]*Block, 0)
 
-	for {
-		bytes := make([]byte, BlockSize)
-		n, err := file.Read(bytes)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		bytes = bytes[:n]
-		block := Block{Content: bytes}
-		blocks = append(blocks, &block)
+	err = split(file, chunker, func(content []byte) error {
+		blocks = append(blocks, &Block{Content: content})
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return blocks, nil
 }
@@ -125,14 +152,120 @@ func (f *File) String() string {
 	return string(b)
 }
 
+// Write replaces the file with the content of its blocks, see WriteVerified
 func (f *File) Write() error {
-	fi, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY, f.Perm)
+	return f.WriteVerified(nil)
+}
+
+// WriteDelta rebuilds the file applying d to its current content, divided
+// in blocks of blockSize. The result replaces the file only if it matches
+// s, s can be nil to skip the check
+func (f *File) WriteDelta(d Delta, blockSize int64, s *Summary) error {
+	return f.replace(s, func(w io.Writer) error {
+		return ApplyDelta(f.Path, d, blockSize, w)
+	})
+}
+
+// WriteVerified replaces the file with the content of its blocks. nil
+// blocks are unchanged and copied from the current file, which must be cut
+// in blocks of fixed size. The result replaces the file only if it matches
+// s, s can be nil to skip the check
+func (f *File) WriteVerified(s *Summary) error {
+	var current *os.File
+	defer func() {
+		if current != nil {
+			current.Close()
+		}
+	}()
+	return f.replace(s, func(w io.Writer) error {
+		for i, b := range f.Blocks {
+			if b != nil {
+				if _, err := w.Write(b.Content); err != nil {
+					return err
+				}
+				continue
+			}
+			if current == nil {
+				chunker, err := GetChunker(f.Chunker, f.BlockSize)
+				if err != nil {
+					return err
+				}
+				if chunker.Name() != ChunkerFixed {
+					return fmt.Errorf("Block %d of '%s' is missing", i, f.Path)
+				}
+				if current, err = os.Open(f.Path); err != nil {
+					return err
+				}
+			}
+			blockSize := Config{BlockSize: f.BlockSize}.blockSize()
+			block := io.NewSectionReader(current, int64(i)*blockSize, blockSize)
+			n, err := io.Copy(w, block)
+			if err != nil {
+				return err
+			}
+			if n != blockSize && i != len(f.Blocks)-1 {
+				return fmt.Errorf("Block %d of '%s' is incomplete", i, f.Path)
+			}
+		}
+		return nil
+	})
+}
+
+// replace writes the new content of the file with fill to a temporary file
+// in the directory returned by tmpDir, missing parent directories are
+// created and runs of zeros are written as holes. The temporary file is
+// checked against s, or against what fill wrote if s is nil, synced to disk
+// and renamed over the file, so a crash never leaves a half-written file.
+// Watchers don't see the replaced file as a local change, they index it
+// with s instead if it isn't nil
+func (f *File) replace(s *Summary, fill func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	dir, err := tmpDir(f.Path)
 	if err != nil {
 		return err
 	}
-	// TODO: avoid rewriting unchanged blocks
-	for _, b := range f.Blocks {
-		fi.Write(b.Content)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	// does nothing once the file is renamed
+	defer os.Remove(tmp.Name())
+
+	// zero blocks are left as holes
+	written, _ := newHash(HashSHA256)
+	w := &sparseWriter{file: tmp, hash: written}
+	if err = fill(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if s != nil {
+		err = s.Verify(tmp.Name())
+	} else {
+		err = verifyDigest(tmp.Name(), HashSHA256, hex.EncodeToString(written.Sum(nil)))
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), f.Perm.Perm()); err != nil {
+		return err
+	}
+	recordWrite(f.Path, tmp.Name(), s)
+	if err = os.Rename(tmp.Name(), f.Path); err != nil {
+		return err
 	}
-	return nil
+	return syncDir(filepath.Dir(f.Path))
 }
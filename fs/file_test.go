@@ -1,7 +1,10 @@
 package fs
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/satori/go.uuid"
@@ -36,7 +39,7 @@ func TestMakeFileFromSummary(t *testing.T) {
 	// different ID and amount of Blocks
 	f2.ID, _ = uuid.NewV4()
 	s2 := MakeSummary(f2)
-	s2.Blocks = []uint64{0, 1}
+	s2.Blocks = []string{"0", "1"}
 	if s.Equals(s2) {
 		t.FailNow()
 	}
@@ -64,9 +67,10 @@ func TestMakeFileFromSummary(t *testing.T) {
 		t.FailNow()
 	}
 
-	// different blocks, same amount
+	// different blocks, same amount, compared block by block without digest
 	s2 = MakeSummary(f)
-	s2.Blocks = make([]uint64, len(s.Blocks))
+	s2.Blocks = make([]string, len(s.Blocks))
+	s2.Digest = ""
 	if s.Equals(s2) {
 		t.FailNow()
 	}
@@ -142,7 +146,7 @@ func TestFile_Slice(t *testing.T) {
 	// Check that the file is sliced into the correct
 	// amount of blocks
 	file, _ := os.Stat(f.Path)
-	blockN := CalcBlockN(file)
+	blockN := CalcBlockN(file, BlockSize)
 
 	if len(blocks) != blockN {
 		t.Fatalf("Incorrect block number after slicing: got %d expected %d",
@@ -170,8 +174,8 @@ func TestFile_Write(t *testing.T) {
 		t.FailNow()
 	}
 
-	// unable to write
-	f.Path = testFailDir + "/muffing.png"
+	// unable to write, the parent directory is a file
+	f.Path = muffinPath + "/muffing.png"
 	if err = f.Write(); err == nil {
 		t.FailNow()
 	}
@@ -182,3 +186,67 @@ func TestFile_Write(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// TestFile_WriteVerified replaces a synchronized file with a shorter one,
+// copying unchanged blocks from it
+func TestFile_WriteVerified(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "WriteVerified")
+	os.MkdirAll(filepath.Join(unitTestDir, SummaryDir), 0755)
+	path := filepath.Join(unitTestDir, "dir", "muffin.jpg")
+
+	// missing parent directories are created
+	f, _ := MakeFileWithConfig(muffinPath, Config{BlockSize: 64 * 1024})
+	f.Path = path
+	if err := f.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keep the first block, change the second one and lose the tail
+	s := MakeSummary(f)
+	f.Blocks = []*Block{nil, &Block{Content: []byte("changed")}}
+	wrong := *s
+	if err := f.WriteVerified(&wrong); err == nil {
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadFile(muffinPath)
+	expected := MakeSummary(&File{Hash: f.Hash, BlockSize: f.BlockSize,
+		Blocks: []*Block{&Block{Content: content[:64*1024]}, f.Blocks[1]}})
+	if err := f.WriteVerified(expected); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(written, append(content[:64*1024], []byte("changed")...)) {
+		t.FailNow()
+	}
+
+	// temporary files are written inside the synchronized directory
+	if tmp, _ := tmpDir(path); tmp != filepath.Join(unitTestDir, SummaryDir, TmpDir) {
+		t.FailNow()
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(unitTestDir, SummaryDir, TmpDir)); len(files) != 0 {
+		t.FailNow()
+	}
+}
+
+// TestMakeFileWithConfig slices a file in blocks of a configured size
+func TestMakeFileWithConfig(t *testing.T) {
+	c := Config{BlockSize: 16 * 1024, Chunker: ChunkerFixed, Hash: HashBLAKE2b}
+	f, err := MakeFileWithConfig(muffinPath, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, _ := os.Stat(f.Path)
+	if len(f.Blocks) != CalcBlockN(file, c.BlockSize) {
+		t.FailNow()
+	}
+	s := MakeSummary(f)
+	if s.BlockSize != c.BlockSize || s.Hash != c.Hash {
+		t.FailNow()
+	}
+
+	// invalid block size
+	c.BlockSize = 1
+	if _, err = MakeFileWithConfig(muffinPath, c); err == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv" // non-cryptographic hash functions
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// digestBlocks returns the hex encoded hash of the content of all the
+// blocks, the digest of the whole file, and its size
+func digestBlocks(algorithm string, blocks []*Block) (string, int64) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", 0
+	}
+	var size int64
+	for _, b := range blocks {
+		h.Write(b.Content)
+		size += int64(b.Size())
+	}
+	return hex.EncodeToString(h.Sum(nil)), size
+}
+
+// hashContent returns the hex encoded hash of content, or an empty string
+// if the algorithm is unknown
+func hashContent(algorithm string, content []byte) string {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return ""
+	}
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// legacyHash converts a FNV-1a hash stored as a number by older indices
+// to its hex encoded form
+func legacyHash(n uint64) string {
+	return fmt.Sprintf("%016x", n)
+}
+
+// newHash returns the hash.Hash identified by algorithm, an empty algorithm
+// refers to the FNV-1a hash used before algorithms were recorded
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "", HashFNV64a:
+		return fnv.New64a(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE2b:
+		return blake2b.New256(nil)
+	}
+	return nil, fmt.Errorf("Unknown hash algorithm: '%s'", algorithm)
+}
+
+// StrongHash checks if algorithm is a cryptographic hash whose digests
+// can be trusted to verify received data
+func StrongHash(algorithm string) bool {
+	return algorithm == HashSHA256 || algorithm == HashBLAKE2b
+}
+
+// ValidHash returns an error if algorithm is unknown
+func ValidHash(algorithm string) error {
+	_, err := newHash(algorithm)
+	return err
+}
@@ -0,0 +1,39 @@
+package fs
+
+import (
+	"hash/fnv"
+	"testing"
+)
+
+// TestNewHash creates each of the supported hashes and an unknown one
+func TestNewHash(t *testing.T) {
+	for _, algorithm := range []string{"", HashFNV64a, HashSHA256, HashBLAKE2b} {
+		if _, err := newHash(algorithm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ValidHash("md4"); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestStrongHash checks that FNV-1a is not trusted to verify data
+func TestStrongHash(t *testing.T) {
+	if StrongHash("") || StrongHash(HashFNV64a) {
+		t.FailNow()
+	}
+	if !StrongHash(HashSHA256) || !StrongHash(HashBLAKE2b) {
+		t.FailNow()
+	}
+}
+
+// TestLegacyHash compares a hash stored as a number by older indices with
+// a generated one
+func TestLegacyHash(t *testing.T) {
+	b := Block{Content: []byte{1, 2, 3}}
+	hfn := fnv.New64a()
+	hfn.Write(b.Content)
+	if legacyHash(hfn.Sum64()) != b.HashWith(HashFNV64a) {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// whence values of lseek to find data and holes in sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// findHoles returns the holes of a file of the given size without reading
+// it, using SEEK_DATA and SEEK_HOLE. The position of file is undefined
+// afterwards
+func findHoles(file *os.File, size int64) ([]extent, error) {
+	holes := make([]extent, 0)
+	var offset int64
+	for offset < size {
+		data, err := file.Seek(offset, seekData)
+		// Seek wraps the error of lseek in a *os.PathError
+		if errors.Is(err, syscall.ENXIO) {
+			// no more data, the rest of the file is a hole
+			data = size
+		} else if err != nil {
+			return nil, err
+		}
+		if data > offset {
+			holes = append(holes, extent{Offset: offset, Length: data - offset})
+		}
+		if data >= size {
+			break
+		}
+		if offset, err = file.Seek(data, seekHole); err != nil {
+			return nil, err
+		}
+	}
+	return holes, nil
+}
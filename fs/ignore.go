@@ -0,0 +1,212 @@
+package fs
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultIgnore lists the patterns ignored in every directory, they are
+// checked before any other rule so they can't be negated
+var DefaultIgnore = []string{"/" + SummaryDir + "/"}
+
+// Ignore decides which paths of a directory are not synchronized using
+// gitignore-style rules read from IgnoreFile files. Paths are relative to
+// the root of the directory and separated by slashes
+type Ignore struct {
+	defaults []ignoreRule
+	rules    []ignoreRule
+}
+
+// ignoreRule is a pattern read from a line of an IgnoreFile
+//	base:		directory of the IgnoreFile, relative to the root
+//	dirOnly:	the pattern ended with a slash and only matches directories
+//	negate:		the pattern started with '!' and includes matching paths
+//	path:		the pattern contains a slash and is matched against the path
+//			relative to base instead of the name of the file
+//	re:		compiled pattern
+type ignoreRule struct {
+	base    string
+	dirOnly bool
+	negate  bool
+	path    bool
+	re      *regexp.Regexp
+}
+
+// MakeIgnore creates an Ignore with the DefaultIgnore rules
+func MakeIgnore() *Ignore {
+	ig := new(Ignore)
+	for _, line := range DefaultIgnore {
+		if r, ok := parseIgnoreRule("", line); ok {
+			ig.defaults = append(ig.defaults, r)
+		}
+	}
+	return ig
+}
+
+// Add adds the rules in lines, read from the IgnoreFile in the directory
+// base, after the existing ones
+func (ig *Ignore) Add(base string, lines ...string) {
+	for _, line := range lines {
+		if r, ok := parseIgnoreRule(base, line); ok {
+			ig.rules = append(ig.rules, r)
+		}
+	}
+}
+
+// AddFile adds the rules of the IgnoreFile in dir, whose path relative to
+// the root is base, replacing the ones read from it before. Missing files
+// are not an error
+func (ig *Ignore) AddFile(dir string, base string) error {
+	rules := ig.rules[:0]
+	for _, r := range ig.rules {
+		if r.base != base {
+			rules = append(rules, r)
+		}
+	}
+	ig.rules = rules
+	file, err := os.Open(filepath.Join(dir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	ig.Add(base, lines...)
+	return nil
+}
+
+// Match checks if path is ignored, either by itself or because one of the
+// directories containing it is. A nil Ignore only applies DefaultIgnore
+func (ig *Ignore) Match(path string, isDir bool) bool {
+	if ig == nil {
+		ig = MakeIgnore()
+	}
+	elements := strings.Split(path, "/")
+	for i := 1; i < len(elements); i++ {
+		if ig.matchOne(strings.Join(elements[:i], "/"), true) {
+			return true
+		}
+	}
+	return ig.matchOne(path, isDir)
+}
+
+// matchOne checks the rules against a single path, the last matching rule
+// decides if it is ignored
+func (ig *Ignore) matchOne(path string, isDir bool) bool {
+	for _, r := range ig.defaults {
+		if r.match(path, isDir) {
+			return true
+		}
+	}
+	ignored := false
+	for _, r := range ig.rules {
+		if r.match(path, isDir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// match checks if the rule matches path
+func (r ignoreRule) match(path string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(path, r.base+"/") {
+			return false
+		}
+		path = path[len(r.base)+1:]
+	}
+	if !r.path {
+		path = path[strings.LastIndex(path, "/")+1:]
+	}
+	return r.re.MatchString(path)
+}
+
+// globToRegexp translates a gitignore glob to a regular expression:
+// '*' and '?' don't match slashes, '**' matches any number of directories
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// parseIgnoreRule parses a line of an IgnoreFile, blank lines and comments
+// don't create rules
+func parseIgnoreRule(base string, line string) (ignoreRule, bool) {
+	r := ignoreRule{base: base}
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// a slash anywhere but at the end anchors the pattern to base
+	if strings.Contains(line, "/") {
+		r.path = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return r, false
+	}
+	re, err := regexp.Compile(globToRegexp(line))
+	if err != nil {
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
@@ -0,0 +1,77 @@
+package fs
+
+import (
+	"testing"
+)
+
+// TestIgnore_Match matches paths against gitignore-style rules
+func TestIgnore_Match(t *testing.T) {
+	ig := MakeIgnore()
+	ig.Add("",
+		"# comment",
+		"",
+		"*.swp",
+		"build/",
+		"/todo.txt",
+		"doc/*.pdf",
+		"**/cache",
+		"logs/**",
+		"*.log",
+		"!important.log",
+		`\!bang`,
+		"file[0-9]",
+	)
+	ig.Add("sub", "*.tmp", "/only-here")
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{SummaryDir, true, true},
+		{SummaryDir + "/" + SummaryFile, false, true},
+		{"a/" + SummaryDir, true, false},
+		{"main.go", false, false},
+		{".main.go.swp", false, true},
+		{"a/b/c.swp", false, true},
+		{"build", true, true},
+		{"build/out", false, true},
+		{"build", false, false},
+		{"todo.txt", false, true},
+		{"a/todo.txt", false, false},
+		{"doc/a.pdf", false, true},
+		{"doc/a/b.pdf", false, false},
+		{"a/doc/a.pdf", false, false},
+		{"cache", true, true},
+		{"a/b/cache", false, true},
+		{"logs/a/b", false, true},
+		{"logs", true, false},
+		{"a.log", false, true},
+		{"important.log", false, false},
+		{"!bang", false, true},
+		{"file1", false, true},
+		{"filea", false, false},
+		{"sub/a.tmp", false, true},
+		{"sub/a/b.tmp", false, true},
+		{"a.tmp", false, false},
+		{"sub/only-here", false, true},
+		{"sub/a/only-here", false, false},
+	}
+	for _, c := range cases {
+		if ig.Match(c.path, c.isDir) != c.ignored {
+			t.Fatal(c.path)
+		}
+	}
+
+	// defaults can't be negated
+	ig.Add("", "!"+SummaryDir+"/")
+	if !ig.Match(SummaryDir, true) {
+		t.FailNow()
+	}
+
+	// a nil Ignore applies the defaults
+	var nilIgnore *Ignore
+	if !nilIgnore.Match(SummaryDir+"/"+SummaryFile, false) || nilIgnore.Match("a", false) {
+		t.FailNow()
+	}
+}
@@ -3,23 +3,36 @@ package fs
 import (
 	"fmt"
 	"os"
-	"reflect"
+	"path/filepath"
+	"sort"
+	"time"
 )
 
 // Index stores multiple Summary structs:
-//	Current files indexed by path
+//	Current files indexed by path, relative to the synchronized directory
 //	Parent files indexed by ID
 //	Deleted files indexed by ID
 type Index struct {
+	// Schema is the format the Index was written in, see IndexSchema
+	Schema  int                 `json:"schema"`
+	Config  Config              `json:"config"`
 	Files   map[string]*Summary `json:"files"`
 	Parents map[string]*Summary `json:"parents"`
 	// TODO: is anything other than the ID of Deletions used?
 	Deletions map[string]*Summary `json:"deletions"`
+	// Ignore lists the paths that are neither indexed nor accepted from
+	// other indices, it is set when the directory is scanned
+	Ignore *Ignore `json:"-"`
+	// Store keeps the blocks of the files if Config.Store is set, it is
+	// set when the directory is scanned and read by Merge to merge files
+	Store *Store `json:"-"`
 }
 
 // MakeIndex creates an Index from a slice of summaries
 func MakeIndex(summaries ...*Summary) (*Index, error) {
 	i := new(Index)
+	i.Schema = IndexSchema
+	i.Config = MakeConfig()
 	i.Files = make(map[string]*Summary)
 	i.Parents = make(map[string]*Summary)
 	i.Deletions = make(map[string]*Summary)
@@ -36,6 +49,7 @@ func MakeIndex(summaries ...*Summary) (*Index, error) {
 // Comparison stores the cahnges made from one index to another
 type Comparison struct {
 	Additions map[string]*Summary
+	Conflicts []string // sorted paths changed concurrently by both indices
 	Deletions []string
 }
 
@@ -72,14 +86,21 @@ func (i *Index) AddParent(summaries ...*Summary) error {
 	return nil
 }
 
-// Compare lists changes from one index (i) to another (ni)
+// Compare lists changes from one index (i) to another (ni), paths ignored
+// by i are left out. Summaries of ni older than those of i are not changes,
+// concurrent ones are listed as conflicts instead of additions, see
+// MergeFile
 func (i *Index) Compare(ni *Index) *Comparison {
 	c := Comparison{}
 	c.Additions = make(map[string]*Summary)
 	c.Deletions = make([]string, 0)
 
-	// deletions
+	// deletions, deepest paths first so directories are emptied before
+	// they are removed
 	for path, sum := range i.Files {
+		if i.Ignore.Match(path, sum.IsDir()) {
+			continue
+		}
 		if _, found := ni.Files[path]; !found {
 			if _, found = ni.Deletions[sum.ID]; found {
 				c.Deletions = append(c.Deletions, path)
@@ -89,17 +110,48 @@ func (i *Index) Compare(ni *Index) *Comparison {
 
 	// additions and modifications
 	for path, sum := range ni.Files {
+		// ignored paths are not accepted from other peers
+		if i.Ignore.Match(path, sum.IsDir()) {
+			continue
+		}
 		if sum2, found := i.Files[path]; found {
 			diff, change := sum2.Diff(sum)
 			if !change {
 				continue
 			}
-			c.Additions[path] = &Summary{Blocks: diff}
+			if sum.Version != nil && sum2.Version != nil {
+				switch sum2.Version.Compare(sum.Version) {
+				case VersionNewer:
+					continue
+				case VersionConcurrent:
+					// directories and links have no content to merge, both
+					// peers keep the summary with the lowest ID
+					if sum.special() || sum2.special() {
+						if sum2.ID < sum.ID {
+							continue
+						}
+						break
+					}
+					c.Conflicts = append(c.Conflicts, path)
+					continue
+				}
+			}
+			// blocks cut by content can't be matched by position
+			if !sum.FixedSize() || !sum2.FixedSize() {
+				c.Additions[path] = sum
+				continue
+			}
+			// unchanged blocks are kept from the local file
+			modified := *sum
+			modified.Blocks = diff
+			c.Additions[path] = &modified
 		} else {
 			c.Additions[path] = sum
 		}
 	}
 
+	sort.Strings(c.Conflicts)
+	sort.Sort(sort.Reverse(sort.StringSlice(c.Deletions)))
 	return &c
 }
 
@@ -114,6 +166,29 @@ func (i *Index) Contains(s *Summary) (string, bool) {
 	return "", false
 }
 
+// Copy returns a copy of the Index, the summaries are shared
+func (i *Index) Copy() *Index {
+	c := &Index{
+		Schema:    i.Schema,
+		Config:    i.Config,
+		Files:     make(map[string]*Summary, len(i.Files)),
+		Parents:   make(map[string]*Summary, len(i.Parents)),
+		Deletions: make(map[string]*Summary, len(i.Deletions)),
+		Ignore:    i.Ignore,
+		Store:     i.Store,
+	}
+	for path, s := range i.Files {
+		c.Files[path] = s
+	}
+	for id, s := range i.Parents {
+		c.Parents[id] = s
+	}
+	for id, s := range i.Deletions {
+		c.Deletions[id] = s
+	}
+	return c
+}
+
 // Delete removes a set of Summary from Index.Files
 func (i *Index) Delete(summaries ...*Summary) error {
 	for _, s := range summaries {
@@ -126,7 +201,7 @@ func (i *Index) Delete(summaries ...*Summary) error {
 }
 
 // DeleteDeletion needs a better name. It removes a set of Summary from
-// Index.Parents. Not used
+// Index.Deletions, see Prune
 func (i *Index) DeleteDeletion(summaries ...*Summary) error {
 	for _, s := range summaries {
 		if _, found := i.Deletions[s.ID]; !found {
@@ -137,8 +212,7 @@ func (i *Index) DeleteDeletion(summaries ...*Summary) error {
 	return nil
 }
 
-// DeleteParent removes a set of Summary from Index.Parents
-// Not used
+// DeleteParent removes a set of Summary from Index.Parents, see Prune
 func (i *Index) DeleteParent(summaries ...*Summary) error {
 	for _, s := range summaries {
 		if _, found := i.Parents[s.ID]; !found {
@@ -187,10 +261,91 @@ func (i *Index) Equals(newIndex *Index) bool {
 	return true
 }
 
+// References counts the summaries in Index.Files and Index.Parents that
+// reference each block, blocks are identified by algorithm and hash
+func (i *Index) References() map[string]int {
+	refs := make(map[string]int)
+	count := func(s *Summary) {
+		for _, hash := range s.Blocks {
+			if hash != "" {
+				refs[blockKey(s.algorithm(), hash)]++
+			}
+		}
+	}
+	for _, s := range i.Files {
+		count(s)
+	}
+	for _, s := range i.Parents {
+		count(s)
+	}
+	return refs
+}
+
+// relativize makes the paths of the summaries of the Index relative to
+// root, indices written by older versions stored absolute paths. Files
+// outside of root, e.g. if the directory was moved, are dropped and will
+// be indexed as new files. Parents and deletions outside of root are kept
+// without a path. Changed summaries are copied, not modified
+func (i *Index) relativize(root string) {
+	files := make(map[string]*Summary, len(i.Files))
+	for path, s := range i.Files {
+		if !filepath.IsAbs(path) {
+			files[path] = s
+			continue
+		}
+		rel, err := RelPath(root, path)
+		if err != nil {
+			continue
+		}
+		moved := *s
+		moved.Path = rel
+		files[rel] = &moved
+	}
+	i.Files = files
+	i.Parents = relativizeMap(root, i.Parents)
+	i.Deletions = relativizeMap(root, i.Deletions)
+}
+
 // Merge compares a summary of a local and a remote directory
-// This function should return the same summary switching s1 and s2
+// This function should return the same summary switching s1 and s2.
+// Files changed by both peers are compared by their Version, concurrent
+// changes are conflicts resolved by the policies of the Config of i1, which
+// keep both files by default. Only ConflictLocal depends on the order.
+// Files with an extension in Config.Mergers are merged if the Store of i1
+// has the blocks of both changes, see StoreMerger
 func Merge(i1 *Index, i2 *Index) (*Index, error) {
+	return MergeWith(i1, i2, i1.resolver())
+}
+
+// MergeFile merges the concurrent changes of the file in path of both
+// indices as Merge does and returns the summaries that replace it in i1
+func MergeFile(i1 *Index, i2 *Index, path string) ([]*Summary, error) {
+	s, ns := i1.Files[path], i2.Files[path]
+	if s == nil || ns == nil || s.Version == nil || ns.Version == nil {
+		return nil, fmt.Errorf("No versions of '%s' to merge", path)
+	}
+	parents, err := mergeSummaryMap(false, i1.Parents, i2.Parents)
+	if err != nil {
+		return nil, err
+	}
+	taken := func(s *Summary) bool {
+		for _, files := range []map[string]*Summary{i1.Files, i2.Files} {
+			if other, found := files[s.Path]; found && other.ID != s.ID {
+				return true
+			}
+		}
+		return false
+	}
+	return uniqueCopies(path, mergeVersions(s, ns, withBase(i1.resolver(), parents)), taken), nil
+}
+
+// MergeWith merges two indices as Merge does, resolving conflicts with r.
+// i1 is the local Index. If r is a BaseResolver and the common ancestor of
+// the summaries in conflict is known it is used to resolve them, see
+// StoreMerger
+func MergeWith(i1 *Index, i2 *Index, r Resolver) (*Index, error) {
 	m, _ := MakeIndex()
+	m.Config = i1.Config
 
 	// merge parents
 	parents, err := mergeSummaryMap(false, i1.Parents, i2.Parents)
@@ -208,30 +363,67 @@ func Merge(i1 *Index, i2 *Index) (*Index, error) {
 			delete(m.Deletions, id)
 		}
 	}
+	// deletions of files whose ID changed, e.g. if their parents were pruned
+	tombstones := tombstonesByPath(m.Deletions)
+	// conflicts are merged with their common ancestor if r can use it
+	resolve := withBase(r, m.Parents)
+	// conflict copies don't replace files of either index, see uniqueCopies
+	taken := func(s *Summary) bool {
+		for _, files := range []map[string]*Summary{m.Files, i1.Files, i2.Files} {
+			if other, found := files[s.Path]; found && other.ID != s.ID {
+				return true
+			}
+		}
+		return false
+	}
+	// the same conflict copy may be kept by both indices, the first error
+	// is kept in err
+	add := func(summaries ...*Summary) {
+		for _, s := range summaries {
+			if other, found := m.Files[s.Path]; found && other.ID == s.ID {
+				continue
+			}
+			if addErr := m.Add(s); addErr != nil && err == nil {
+				err = fmt.Errorf("Can't keep '%s': %s", s.Path, addErr)
+			}
+		}
+	}
 
 	for path, s := range i1.Files {
 		if ns, found := i2.Files[path]; found {
+			// versioned summaries don't need the history of the file
+			if s.Version != nil && ns.Version != nil {
+				add(uniqueCopies(path, mergeVersions(s, ns, resolve), taken)...)
+				continue
+			}
+
 			// same file
 			if s.ID == ns.ID {
-				m.Add(s)
+				add(s)
 				continue
 			}
 
+			// summaries created by older versions are compared by their lines
 			if isDescendant(s, ns, i1.Parents) {
-				m.Add(ns)
+				add(ns)
 				continue
 			}
 			if isDescendant(ns, s, i2.Parents) {
-				m.Add(s)
+				add(s)
+				continue
+			}
+			// directories, and equal links, created by both peers are the same
+			if (s.IsDir() && ns.IsDir()) || (s.IsSymlink() && s.Equals(ns)) {
+				if s.ID < ns.ID {
+					add(s)
+				} else {
+					add(ns)
+				}
 				continue
 			}
 			// branches of the same file
 			if commonRoot(s, ns, m.Parents) {
-				s1 := *s
-				s2 := *ns
-				s1.Path = fmt.Sprintf("%s_%s", s.Path, s.ID)
-				s2.Path = fmt.Sprintf("%s_%s", ns.Path, ns.ID)
-				m.Add(&s1, &s2)
+				add(uniqueCopies(path, resolve.Resolve(s, ns), taken)...)
 				continue
 			}
 		} else {
@@ -240,10 +432,10 @@ func Merge(i1 *Index, i2 *Index) (*Index, error) {
 				continue
 			}
 			// file is now deleted
-			if _, deleted := m.Deletions[s.ID]; deleted {
+			if _, deleted := m.Deletions[s.ID]; deleted || buried(s, tombstones) {
 				continue
 			}
-			m.Add(s)
+			add(s)
 		}
 	}
 
@@ -257,51 +449,180 @@ func Merge(i1 *Index, i2 *Index) (*Index, error) {
 			continue
 		}
 		// file is now deleted
-		if _, deleted := m.Deletions[s.ID]; deleted {
+		if _, deleted := m.Deletions[s.ID]; deleted || buried(s, tombstones) {
 			continue
 		}
-		m.Add(s)
+		add(s)
 	}
 
+	if err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
 // Update compares two IndexSummaries from the same local directory
-// and returns the resulting Index
+// and returns the resulting Index. Each change is recorded in the Version
+// of the changed summary as made by Config.Device, a new one is created if
+// neither Index has it. Moved files, even if they changed, are children of
+// the summary in their previous path, see findMoves
 func Update(oldIndex *Index, newIndex *Index) *Index {
 	u, _ := MakeIndex()
+	u.Config = newIndex.Config
+	u.Ignore = newIndex.Ignore
+	u.Store = newIndex.Store
+	if u.Config.Device == "" {
+		u.Config.Device = oldIndex.Config.Device
+	}
+	if u.Config.Device == "" {
+		u.Config.Device = newDevice()
+	}
+	device := u.Config.Device
+	now := time.Now().UnixNano()
+	// the history of the directory is kept until it is pruned, see Prune
+	for id, s := range oldIndex.Parents {
+		u.Parents[id] = s
+	}
+	for id, s := range oldIndex.Deletions {
+		u.Deletions[id] = s
+	}
+	moves := findMoves(oldIndex, newIndex)
 	// look for old files
-Lookup:
 	for path, s := range oldIndex.Files {
 		ns, found := newIndex.Files[path]
 		// file may have been updated
 		if found {
 			if s.Equals(ns) { // File is equal
-				u.Add(ns)
+				same := *ns
+				same.Version = s.Version
+				u.Add(&same)
 			} else { // File has been updated
 				// TODO: Allow record of child and parents in the same path
-				u.Add(&Summary{ID: ns.ID, Parent: s.ID, Path: path, Blocks: ns.Blocks})
-				u.AddParent(s)
-			}
-		} else {
-			// comparing contents is slow
-			for _, ns := range newIndex.Files {
-				// file has been moved
-				if reflect.DeepEqual(s.Blocks, ns.Blocks) {
-					u.Add(&Summary{ID: ns.ID, Parent: s.ID, Path: ns.Path, Blocks: ns.Blocks})
-					u.AddParent(s)
-					continue Lookup
-				}
+				child := *ns
+				child.Parent = s.ID
+				child.Version = s.Version.Increment(device)
+				u.Add(&child)
+				u.AddParent(retired(s, now))
 			}
-			// file deleted
-			u.AddDeletion(s)
+		} else if to, moved := moves[path]; moved { // File has been moved
+			child := *newIndex.Files[to]
+			child.Parent = s.ID
+			child.Version = s.Version.Increment(device)
+			u.Add(&child)
+			u.AddParent(retired(s, now))
+		} else { // File has been deleted
+			u.AddDeletion(deleted(s, device, now))
 		}
 	}
-	// add missing (newly created) files
+	// add missing (newly created) files, files created where others were
+	// deleted are newer than the deletions so Merge doesn't bury them
+	tombstones := tombstonesByPath(oldIndex.Deletions, u.Deletions)
 	for path, s := range newIndex.Files {
 		if _, found := u.Files[path]; !found {
-			u.Add(s)
+			created := *s
+			for _, d := range tombstones[path] {
+				created.Version = created.Version.Merge(d.Version)
+			}
+			created.Version = created.Version.Increment(device)
+			u.Add(&created)
 		}
 	}
 	return u
 }
+
+// buried checks if a deletion in the path of s, from tombstones indexed
+// by path, has a newer or equal Version, so s was deleted after it was
+// last changed
+func buried(s *Summary, tombstones map[string][]*Summary) bool {
+	if s.Version == nil {
+		return false
+	}
+	for _, d := range tombstones[s.Path] {
+		if d.Version == nil {
+			continue
+		}
+		if c := s.Version.Compare(d.Version); c == VersionOlder || c == VersionEqual {
+			return true
+		}
+	}
+	return false
+}
+
+// deleted returns a copy of s recording its deletion by device at now
+func deleted(s *Summary, device string, now int64) *Summary {
+	d := retired(s, now)
+	d.Version = s.Version.Increment(device)
+	return d
+}
+
+// tombstonesByPath indexes deletions by their path
+func tombstonesByPath(deletions ...map[string]*Summary) map[string][]*Summary {
+	tombstones := make(map[string][]*Summary)
+	for _, m := range deletions {
+		for _, d := range m {
+			if d.Path != "" {
+				tombstones[d.Path] = append(tombstones[d.Path], d)
+			}
+		}
+	}
+	return tombstones
+}
+
+// retired returns a copy of s replaced or deleted at now
+func retired(s *Summary, now int64) *Summary {
+	r := *s
+	r.Retired = now
+	return &r
+}
+
+// resolver returns the Resolver used by Merge, a StoreMerger if files can
+// be merged and the policies of the Config otherwise
+func (i *Index) resolver() Resolver {
+	if len(i.Config.Mergers) == 0 || i.Store == nil {
+		return i.Config.Resolver()
+	}
+	return StoreMerger{
+		Config:   i.Config,
+		Mergers:  i.Config.mergers(),
+		Resolver: i.Config.Resolver(),
+		Store:    i.Store,
+	}
+}
+
+// withBase returns a Resolver that passes the common ancestor of the
+// summaries in conflict, found in parents, to r if it is a BaseResolver
+func withBase(r Resolver, parents map[string]*Summary) Resolver {
+	br, ok := r.(BaseResolver)
+	if !ok {
+		return r
+	}
+	return resolverFunc(func(local *Summary, remote *Summary) []*Summary {
+		if base := commonAncestor(local, remote, parents); base != nil {
+			return br.ResolveBase(base, local, remote)
+		}
+		return br.Resolve(local, remote)
+	})
+}
+
+// mergeVersions decides which summaries are kept when two peers have a file
+// in the same path. The newest one is kept, if the changes are concurrent
+// but both peers made the same change the one with the lowest ID is kept
+// with both versions merged, otherwise it is a conflict resolved by r
+func mergeVersions(s1 *Summary, s2 *Summary, r Resolver) []*Summary {
+	switch s1.Version.Compare(s2.Version) {
+	case VersionOlder:
+		return []*Summary{s2}
+	case VersionNewer:
+		return []*Summary{s1}
+	}
+	// directories created by both peers are the same
+	if s1.ID == s2.ID || s1.Equals(s2) || (s1.IsDir() && s2.IsDir()) {
+		kept := *s1
+		if s2.ID < s1.ID {
+			kept = *s2
+		}
+		kept.Version = s1.Version.Merge(s2.Version)
+		return []*Summary{&kept}
+	}
+	return r.Resolve(s1, s2)
+}
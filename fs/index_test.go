@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"os"
 	"reflect"
 	"testing"
 
@@ -10,7 +11,7 @@ import (
 // TestMakeIndex gives a valid and an invalid set to the
 // Index constructor
 func TestMakeIndex(t *testing.T) {
-	s1 := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s1 := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	s2 := *s1
 	s2.Path = "/s2/path"
 	i, err := MakeIndex(s1, &s2)
@@ -30,7 +31,7 @@ func TestMakeIndex(t *testing.T) {
 // TestIndex_Add adds a new and a repeated summary to the
 // Index
 func TestIndex_Add(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	i, _ := MakeIndex()
 	// new addition
 	err := i.Add(s)
@@ -47,7 +48,7 @@ func TestIndex_Add(t *testing.T) {
 // TestIndex_AddDeletion adds a new and a repeated deletion to the
 // Index
 func TestIndex_AddDeletion(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	i, _ := MakeIndex()
 	// new addition
 	err := i.AddDeletion(s)
@@ -64,7 +65,7 @@ func TestIndex_AddDeletion(t *testing.T) {
 // TestIndex_AddParent adds a new and a repeated parent to the
 // Index
 func TestIndex_AddParent(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	i, _ := MakeIndex()
 	// new addition
 	err := i.AddParent(s)
@@ -82,11 +83,11 @@ func TestIndex_Compare(t *testing.T) {
 	id1, _ := uuid.NewV4()
 	id2, _ := uuid.NewV4()
 	id3, _ := uuid.NewV4()
-	sum1 := Summary{ID: id1.String(), Path: "/1", Blocks: []uint64{1, 2, 3}}
-	sum2 := Summary{ID: id2.String(), Path: "/2", Blocks: []uint64{4, 5, 6}}
-	sum3 := Summary{ID: id3.String(), Path: "/3", Blocks: []uint64{7, 8, 9}}
+	sum1 := Summary{ID: id1.String(), Path: "/1", Blocks: []string{"1", "2", "3"}}
+	sum2 := Summary{ID: id2.String(), Path: "/2", Blocks: []string{"4", "5", "6"}}
+	sum3 := Summary{ID: id3.String(), Path: "/3", Blocks: []string{"7", "8", "9"}}
 
-	sum2_1 := Summary{ID: id2.String(), Path: "/2", Blocks: []uint64{5, 4, 6}}
+	sum2_1 := Summary{ID: id2.String(), Path: "/2", Blocks: []string{"5", "4", "6"}}
 
 	index1, _ := MakeIndex(&sum1, &sum2, &sum3)
 	index2, _ := MakeIndex(&sum1, &sum2_1)
@@ -94,7 +95,7 @@ func TestIndex_Compare(t *testing.T) {
 
 	expected := new(Comparison)
 	expected.Additions = make(map[string]*Summary)
-	expected.Additions["/2"] = &Summary{Blocks: []uint64{5, 4, 0}}
+	expected.Additions["/2"] = &Summary{ID: id2.String(), Path: "/2", Blocks: []string{"5", "4", ""}}
 	expected.Deletions = []string{sum3.Path}
 
 	comparison := index1.Compare(index2)
@@ -102,6 +103,40 @@ func TestIndex_Compare(t *testing.T) {
 	if !reflect.DeepEqual(expected, comparison) {
 		t.FailNow()
 	}
+
+	// ignored paths are neither added nor deleted
+	index1.Ignore = MakeIgnore()
+	index1.Ignore.Add("", "2", "3")
+	comparison = index1.Compare(index2)
+	if len(comparison.Additions) != 0 || len(comparison.Deletions) != 0 {
+		t.FailNow()
+	}
+
+	// patterns of directories only match directories
+	index1.Ignore.Add("", "d/")
+	index2.Add(&Summary{ID: "d.0", Path: "d", Perm: os.ModeDir | 0755},
+		&Summary{ID: "d.1", Path: "d/f"}, &Summary{ID: "f.0", Path: "e/d"})
+	comparison = index1.Compare(index2)
+	if len(comparison.Additions) != 1 || comparison.Additions["e/d"] == nil {
+		t.Fatal(comparison.Additions)
+	}
+
+	// older versions are not changes, concurrent ones are conflicts
+	local, _ := MakeIndex(
+		&Summary{ID: "a.1", Path: "a", Blocks: []string{"1"}, Version: Version{"x": 2}},
+		&Summary{ID: "b.1", Path: "b", Blocks: []string{"1"}, Version: Version{"x": 2}},
+		&Summary{ID: "c.1", Path: "c", Blocks: []string{"1"}, Version: Version{"x": 1}},
+		&Summary{ID: "l.1", Path: "l", Perm: os.ModeSymlink, Target: "a", Version: Version{"x": 2}})
+	remote, _ := MakeIndex(
+		&Summary{ID: "a.0", Path: "a", Blocks: []string{"0"}, Version: Version{"x": 1}},
+		&Summary{ID: "b.2", Path: "b", Blocks: []string{"2"}, Version: Version{"x": 1, "y": 1}},
+		&Summary{ID: "c.2", Path: "c", Blocks: []string{"2"}, Version: Version{"x": 1, "y": 1}},
+		&Summary{ID: "l.0", Path: "l", Perm: os.ModeSymlink, Target: "b", Version: Version{"x": 1, "y": 1}})
+	comparison = local.Compare(remote)
+	if len(comparison.Additions) != 2 || comparison.Additions["c"] == nil || comparison.Additions["l"] == nil ||
+		!reflect.DeepEqual(comparison.Conflicts, []string{"b"}) {
+		t.Fatal(comparison)
+	}
 }
 
 // TestIndex_Contains checks that an Index contains a
@@ -132,7 +167,7 @@ func TestIndex_Contains(t *testing.T) {
 // TestIndex_Delete deletes an existing and a nonexisting summary
 // from the Index
 func TestIndex_Delete(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	i, _ := MakeIndex(s)
 	err := i.Delete(s)
 	if err != nil {
@@ -147,7 +182,7 @@ func TestIndex_Delete(t *testing.T) {
 // TestIndex_DeleteDeletion deletes an existing and a nonexisting deletion
 // from the Index
 func TestIndex_DeleteDeletion(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	i, _ := MakeIndex()
 	i.AddDeletion(s)
 	err := i.DeleteDeletion(s)
@@ -163,7 +198,7 @@ func TestIndex_DeleteDeletion(t *testing.T) {
 // TestIndex_DeleteParent deletes an existing and a nonexisting parent
 // from the Index
 func TestIndex_DeleteParent(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 	i, _ := MakeIndex()
 	i.AddParent(s)
 	err := i.DeleteParent(s)
@@ -178,9 +213,9 @@ func TestIndex_DeleteParent(t *testing.T) {
 
 // TestEquals compares indices with different and equal attributes
 func TestIndex_Equals(t *testing.T) {
-	s1 := &Summary{ID: "f1.0", Path: "/f1", Blocks: []uint64{1}}
-	s2 := &Summary{ID: "f2.0", Path: "/f2", Blocks: []uint64{2}}
-	s3 := &Summary{ID: "f3.0", Path: "/f3", Blocks: []uint64{3}}
+	s1 := &Summary{ID: "f1.0", Path: "/f1", Blocks: []string{"1"}}
+	s2 := &Summary{ID: "f2.0", Path: "/f2", Blocks: []string{"2"}}
+	s3 := &Summary{ID: "f3.0", Path: "/f3", Blocks: []string{"3"}}
 
 	i1, _ := MakeIndex(s1)
 	i1.AddParent(s2)
@@ -226,20 +261,32 @@ func TestIndex_Equals(t *testing.T) {
 
 }
 
+// TestIndex_References counts the blocks referenced by files and parents
+func TestIndex_References(t *testing.T) {
+	i, _ := MakeIndex(&Summary{ID: "f1.1", Path: "/f1", Hash: HashSHA256, Blocks: []string{"1", "2"}},
+		&Summary{ID: "f2.0", Path: "/f2", Hash: HashSHA256, Blocks: []string{"2", ""}})
+	i.AddParent(&Summary{ID: "f1.0", Path: "/f1", Hash: HashBLAKE2b, Blocks: []string{"1"}})
+	refs := i.References()
+	if len(refs) != 3 || refs[blockKey(HashSHA256, "1")] != 1 ||
+		refs[blockKey(HashSHA256, "2")] != 2 || refs[blockKey(HashBLAKE2b, "1")] != 1 {
+		t.FailNow()
+	}
+}
+
 // TestIndex_Update creates and updates an Index,
 // checking the operations: change, move, delete, keep, create
 func TestIndex_Update(t *testing.T) {
 	i1, _ := MakeIndex()
-	i1.Add(&Summary{ID: "f1.0", Path: "/f1", Blocks: []uint64{1}},
-		&Summary{ID: "f2.0", Path: "/f2", Blocks: []uint64{2}},
-		&Summary{ID: "f3.0", Path: "/f3", Blocks: []uint64{3}},
-		&Summary{ID: "f4.0", Path: "/f4", Blocks: []uint64{4}})
+	i1.Add(&Summary{ID: "f1.0", Path: "/f1", Blocks: []string{"1"}},
+		&Summary{ID: "f2.0", Path: "/f2", Blocks: []string{"2"}},
+		&Summary{ID: "f3.0", Path: "/f3", Blocks: []string{"3"}},
+		&Summary{ID: "f4.0", Path: "/f4", Blocks: []string{"4"}})
 	i2, _ := MakeIndex()
 	i2.Files = make(map[string]*Summary)
-	i2.Add(&Summary{ID: "f1.1", Path: "/f1", Blocks: []uint64{11}}, // change
-		&Summary{ID: "f2.2", Path: "/n2", Blocks: []uint64{2}}, // move
-		&Summary{ID: "f4.0", Path: "/f4", Blocks: []uint64{4}}, // keep
-		&Summary{ID: "f5.0", Path: "/f5", Blocks: []uint64{4}}) // create
+	i2.Add(&Summary{ID: "f1.1", Path: "/f1", Blocks: []string{"11"}}, // change
+		&Summary{ID: "f2.2", Path: "/n2", Blocks: []string{"2"}}, // move
+		&Summary{ID: "f4.0", Path: "/f4", Blocks: []string{"4"}}, // keep
+		&Summary{ID: "f5.0", Path: "/f5", Blocks: []string{"4"}}) // create
 
 	i3 := Update(i1, i2)
 
@@ -267,6 +314,147 @@ func TestIndex_Update(t *testing.T) {
 	if _, found := i3.Files["/f5"]; !found {
 		t.FailNow()
 	}
+
+	// every change is recorded in the version of the summary
+	device := i3.Config.Device
+	if device == "" || i3.Files["/f1"].Version[device] != 1 || i3.Files["/n2"].Version[device] != 1 ||
+		i3.Deletions["f3.0"].Version[device] != 1 || i3.Files["/f4"].Version != nil ||
+		i3.Files["/f5"].Version[device] != 1 {
+		t.FailNow()
+	}
+	i4 := Update(i3, i2)
+	if i4.Config.Device != device || i4.Files["/f1"].Version[device] != 1 {
+		t.FailNow()
+	}
+}
+
+// TestIndex_Update_History keeps the parents and deletions of the old
+// Index, so deleted files are not brought back by Merge after a rescan
+func TestIndex_Update_History(t *testing.T) {
+	f := &Summary{ID: "f.0", Path: "f", Blocks: []string{"0"}, Version: Version{"a": 1}}
+	g0 := &Summary{ID: "g.0", Path: "g", Blocks: []string{"1"}, Version: Version{"a": 1}}
+	g1 := &Summary{ID: "g.1", Path: "g", Blocks: []string{"2"}}
+	i1, _ := MakeIndex(f, g0)
+	i1.Config.Device = "a"
+	i2, _ := MakeIndex(g1)
+	deleted := Update(i1, i2)
+	// a rescan without changes
+	rescanned := Update(deleted, i2)
+	if len(rescanned.Deletions) != 1 || rescanned.Deletions[f.ID] == nil ||
+		len(rescanned.Parents) != 1 || rescanned.Parents[g0.ID] == nil {
+		t.FailNow()
+	}
+	// a peer that still has the file
+	remote, _ := MakeIndex(f)
+	if m, err := Merge(rescanned, remote); err != nil || m.Files["f"] != nil {
+		t.FailNow()
+	}
+}
+
+// TestIndex_Dirs compares, updates and merges indices with directories
+func TestIndex_Dirs(t *testing.T) {
+	d1 := &Summary{ID: "d1", Path: "d", Blocks: []string{}, Perm: os.ModeDir | 0755}
+	f1 := &Summary{ID: "f1", Path: "d/f", Blocks: []string{"1"}, Perm: 0644}
+	e1 := &Summary{ID: "e1", Path: "e", Blocks: []string{}, Perm: os.ModeDir | 0755}
+	local, _ := MakeIndex(d1, f1)
+
+	// directories are created and their content deleted before them
+	remote, _ := MakeIndex(e1)
+	remote.AddDeletion(d1, f1)
+	c := local.Compare(remote)
+	if len(c.Additions) != 1 || c.Additions["e"] != e1 ||
+		!reflect.DeepEqual(c.Deletions, []string{"d/f", "d"}) {
+		t.FailNow()
+	}
+
+	// changes of mode
+	d2 := *d1
+	d2.ID = "d2"
+	d2.Parent = d1.ID
+	d2.Perm = os.ModeDir | 0700
+	remote, _ = MakeIndex(&d2, f1)
+	if c = local.Compare(remote); len(c.Additions) != 1 || c.Additions["d"].Perm != d2.Perm {
+		t.FailNow()
+	}
+
+	// directories are not moved
+	updated, _ := MakeIndex(f1, e1)
+	u := Update(local, updated)
+	if _, found := u.Deletions[d1.ID]; !found || u.Files["e"].Parent != "" {
+		t.FailNow()
+	}
+
+	// directories created by both peers are merged
+	d3 := *d1
+	d3.ID = "d3"
+	i1, _ := MakeIndex(d1)
+	i2, _ := MakeIndex(&d3)
+	m1, _ := Merge(i1, i2)
+	m2, _ := Merge(i2, i1)
+	if len(m1.Files) != 1 || m1.Files["d"].ID != d1.ID || m2.Files["d"].ID != d1.ID {
+		t.FailNow()
+	}
+}
+
+// TestMerge_Versions merges files changed by two peers comparing their
+// versions, the result must not depend on the order of the indices
+func TestMerge_Versions(t *testing.T) {
+	s0 := &Summary{ID: "f.0", Path: "f", Blocks: []string{"0"}, Version: Version{"a": 1}}
+	s1a := &Summary{ID: "f.1a", Parent: s0.ID, Path: "f", Blocks: []string{"1"},
+		Version: Version{"a": 2}}
+	s2a := &Summary{ID: "f.2a", Parent: s1a.ID, Path: "f", Blocks: []string{"2"},
+		Version: Version{"a": 2, "b": 1}}
+	s1b := &Summary{ID: "f.1b", Parent: s0.ID, Path: "f", Blocks: []string{"3"},
+		Version: Version{"a": 1, "b": 1}}
+	s1c := &Summary{ID: "f.1c", Parent: s0.ID, Path: "f", Blocks: []string{"1"},
+		Version: Version{"a": 1, "c": 1}}
+
+	merge := func(s1 *Summary, s2 *Summary) *Index {
+		// the history of the file is not needed
+		i1, _ := MakeIndex(s1)
+		i2, _ := MakeIndex(s2)
+		m1, _ := Merge(i1, i2)
+		m2, _ := Merge(i2, i1)
+		if !reflect.DeepEqual(m1.Files, m2.Files) {
+			t.Fatal(m1.Files, m2.Files)
+		}
+		return m1
+	}
+
+	// newer versions are kept
+	if m := merge(s1a, s2a); len(m.Files) != 1 || m.Files["f"] != s2a {
+		t.FailNow()
+	}
+	// concurrent changes are conflicts, the oldest change is renamed
+	m := merge(s1a, s1b)
+	if len(m.Files) != 2 || m.Files["f"].ID != s1a.ID ||
+		m.Files["f.sync-conflict-b"].ID != s1b.ID {
+		t.Fatal(m.Files)
+	}
+	// unless both peers made the same change
+	m = merge(s1a, s1c)
+	if len(m.Files) != 1 || m.Files["f"].ID != s1a.ID ||
+		m.Files["f"].Version.Compare(Version{"a": 2, "c": 1}) != VersionEqual {
+		t.FailNow()
+	}
+	// conflict copies don't replace files with their name
+	g := &Summary{ID: "g.0", Path: "f.sync-conflict-b", Blocks: []string{"4"}}
+	i1, _ := MakeIndex(s1a, g)
+	i2, _ := MakeIndex(s1b)
+	for _, m := range []func() (*Index, error){
+		func() (*Index, error) { return Merge(i1, i2) },
+		func() (*Index, error) { return Merge(i2, i1) },
+	} {
+		if m, err := m(); err != nil || len(m.Files) != 3 || m.Files[g.Path] != g ||
+			m.Files["f.sync-conflict-b-f.1b"].ID != s1b.ID {
+			t.Fatal(err, m.Files)
+		}
+	}
+	// and the same copy kept by both indices is kept once
+	m, _ = Merge(i1, i2)
+	if m, err := Merge(m, i2); err != nil || len(m.Files) != 3 {
+		t.Fatal(err, m.Files)
+	}
 }
 
 // TestMerge checks that the following merge operations are successfully carried
@@ -289,7 +477,7 @@ func TestMerge(t *testing.T) {
 
 // testMerge1 merges the same file
 func testMerge1(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 
 	i1, _ := MakeIndex(s)
 	i2, _ := MakeIndex(s)
@@ -310,10 +498,10 @@ func testMerge1(t *testing.T) {
 
 // testMerge2 merges different branches of a same file
 func testMerge2(t *testing.T) {
-	s1_0ab := &Summary{ID: "id1", Path: "/path_1", Blocks: []uint64{0}}
-	s1_1a := &Summary{ID: "id2", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []uint64{1}}
-	s1_2a := &Summary{ID: "id3", Parent: s1_1a.ID, Path: "/path_1", Blocks: []uint64{2}}
-	s1_1b := &Summary{ID: "id4", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []uint64{3}}
+	s1_0ab := &Summary{ID: "id1", Path: "/path_1", Blocks: []string{"0"}}
+	s1_1a := &Summary{ID: "id2", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []string{"1"}}
+	s1_2a := &Summary{ID: "id3", Parent: s1_1a.ID, Path: "/path_1", Blocks: []string{"2"}}
+	s1_1b := &Summary{ID: "id4", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []string{"3"}}
 
 	i1, _ := MakeIndex(s1_2a)
 	i2, _ := MakeIndex(s1_1b)
@@ -331,10 +519,10 @@ func testMerge2(t *testing.T) {
 
 // testMerge3 merges an edited and a moved branch of a file
 func testMerge3(t *testing.T) {
-	s1_0ab := &Summary{ID: "id1", Path: "/path_1", Blocks: []uint64{0}}
-	s1_1a := &Summary{ID: "id2", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []uint64{1}}
-	s1_2a := &Summary{ID: "id3", Parent: s1_1a.ID, Path: "/path_2", Blocks: []uint64{1}}
-	s1_1b := &Summary{ID: "id4", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []uint64{2}}
+	s1_0ab := &Summary{ID: "id1", Path: "/path_1", Blocks: []string{"0"}}
+	s1_1a := &Summary{ID: "id2", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []string{"1"}}
+	s1_2a := &Summary{ID: "id3", Parent: s1_1a.ID, Path: "/path_2", Blocks: []string{"1"}}
+	s1_1b := &Summary{ID: "id4", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []string{"2"}}
 
 	i1, _ := MakeIndex(s1_2a)
 	i2, _ := MakeIndex(s1_1b)
@@ -355,7 +543,7 @@ func testMerge3(t *testing.T) {
 
 // testMerge4 creates a file in both branches and deletes it in one of them
 func testMerge4(t *testing.T) {
-	s := &Summary{ID: "id", Path: "/path", Blocks: []uint64{0}}
+	s := &Summary{ID: "id", Path: "/path", Blocks: []string{"0"}}
 
 	i1, _ := MakeIndex(s)
 	i2, _ := MakeIndex()
@@ -372,9 +560,9 @@ func testMerge4(t *testing.T) {
 
 // testMerge5 deletes a file in one branch, edits it in another
 func testMerge5(t *testing.T) {
-	s1_0 := &Summary{ID: "id1", Path: "/path_1", Blocks: []uint64{0}}
-	s1_1 := &Summary{ID: "id2", Parent: s1_0.ID, Path: "/path_1", Blocks: []uint64{1}}
-	s1_2 := &Summary{ID: "id3", Parent: s1_1.ID, Path: "/path_1", Blocks: []uint64{2}}
+	s1_0 := &Summary{ID: "id1", Path: "/path_1", Blocks: []string{"0"}}
+	s1_1 := &Summary{ID: "id2", Parent: s1_0.ID, Path: "/path_1", Blocks: []string{"1"}}
+	s1_2 := &Summary{ID: "id3", Parent: s1_1.ID, Path: "/path_1", Blocks: []string{"2"}}
 
 	i1, _ := MakeIndex(s1_2)
 	i2, _ := MakeIndex()
@@ -393,9 +581,9 @@ func testMerge5(t *testing.T) {
 
 // testMerge6 deletes a file in one branch, moves it in another
 func testMerge6(t *testing.T) {
-	s1_0 := &Summary{ID: "id1", Path: "/path_1", Blocks: []uint64{0}}
-	s1_1 := &Summary{ID: "id2", Parent: s1_0.ID, Path: "/path_2", Blocks: []uint64{0}}
-	s1_2 := &Summary{ID: "id3", Parent: s1_1.ID, Path: "/path_3", Blocks: []uint64{0}}
+	s1_0 := &Summary{ID: "id1", Path: "/path_1", Blocks: []string{"0"}}
+	s1_1 := &Summary{ID: "id2", Parent: s1_0.ID, Path: "/path_2", Blocks: []string{"0"}}
+	s1_2 := &Summary{ID: "id3", Parent: s1_1.ID, Path: "/path_3", Blocks: []string{"0"}}
 
 	i1, _ := MakeIndex(s1_2)
 	i2, _ := MakeIndex()
@@ -414,9 +602,9 @@ func testMerge6(t *testing.T) {
 
 // testMerge7 merges two indices and compares two merges
 func testMerge7(t *testing.T) {
-	s1_0ab := &Summary{ID: "id1", Path: "/path_1", Blocks: []uint64{0}}
-	s1_1a := &Summary{ID: "id2", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []uint64{1}}
-	s1_2a := &Summary{ID: "id3", Parent: s1_1a.ID, Path: "/path_1", Blocks: []uint64{2}}
+	s1_0ab := &Summary{ID: "id1", Path: "/path_1", Blocks: []string{"0"}}
+	s1_1a := &Summary{ID: "id2", Parent: s1_0ab.ID, Path: "/path_1", Blocks: []string{"1"}}
+	s1_2a := &Summary{ID: "id3", Parent: s1_1a.ID, Path: "/path_1", Blocks: []string{"2"}}
 
 	i1, _ := MakeIndex(s1_2a)
 	i1.AddParent(s1_0ab, s1_1a)
@@ -0,0 +1,407 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultMergers are the Mergers used by StoreMerger for each extension if
+// it has none
+var DefaultMergers = map[string]Merger{
+	".cfg":  TextMerger{},
+	".conf": TextMerger{},
+	".csv":  TextMerger{},
+	".ini":  TextMerger{},
+	".json": JSONMerger{},
+	".md":   TextMerger{},
+	".toml": TextMerger{},
+	".txt":  TextMerger{},
+	".yaml": TextMerger{},
+	".yml":  TextMerger{},
+}
+
+// namedMergers are the Mergers that can be chosen in Config.Mergers by name
+var namedMergers = map[string]Merger{
+	MergerJSON: JSONMerger{},
+	MergerText: TextMerger{},
+}
+
+// ErrConflict is returned by a Merger if both changes modify the same part
+// of the content
+var ErrConflict = errors.New("Changes can't be merged")
+
+// BaseResolver is a Resolver that can use the common ancestor of the
+// summaries in conflict, base, which Merge passes if it is in its parents
+type BaseResolver interface {
+	Resolver
+	ResolveBase(base *Summary, local *Summary, remote *Summary) []*Summary
+}
+
+// Merger merges the content of two concurrent changes of a file, base is
+// the content of the common ancestor of both changes
+type Merger interface {
+	Merge(base []byte, local []byte, remote []byte) ([]byte, error)
+}
+
+// JSONMerger merges JSON documents structurally: objects are merged key
+// by key and any other value, arrays included, is replaced as a whole
+type JSONMerger struct{}
+
+// Merge merges the JSON documents, the result is indented with tabs and
+// ends with a newline so every device merging them writes the same content
+func (JSONMerger) Merge(base []byte, local []byte, remote []byte) ([]byte, error) {
+	var values [3]interface{}
+	for n, content := range [][]byte{base, local, remote} {
+		d := json.NewDecoder(bytes.NewReader(content))
+		d.UseNumber()
+		if err := d.Decode(&values[n]); err != nil {
+			return nil, err
+		}
+	}
+	merged, err := mergeJSON(values[0], values[1], values[2])
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "\t")
+	if err = e.Encode(merged); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// StoreMerger merges the content of files changed concurrently, reading
+// both changes and their common ancestor from Store, and stores the merged
+// content in Store. Conflicts it can't merge are resolved by Resolver
+//	Config:		chunker and hash of the merged file, and device its change
+//			is recorded as made by
+//	Mergers:	Merger of each extension, DefaultMergers if nil
+//	Resolver:	resolves unmerged conflicts, KeepBoth if nil
+//	Store:		contains the blocks of the files
+type StoreMerger struct {
+	Config   Config
+	Mergers  map[string]Merger
+	Resolver Resolver
+	Store    *Store
+}
+
+// Resolve resolves a conflict without a common ancestor with Resolver
+func (sm StoreMerger) Resolve(local *Summary, remote *Summary) []*Summary {
+	if sm.Resolver == nil {
+		return KeepBoth{}.Resolve(local, remote)
+	}
+	return sm.Resolver.Resolve(local, remote)
+}
+
+// ResolveBase merges the content of both summaries, the merged summary is
+// a child of local with the versions of both
+func (sm StoreMerger) ResolveBase(base *Summary, local *Summary, remote *Summary) []*Summary {
+	merged, err := sm.merge(base, local, remote)
+	if err != nil {
+		return sm.Resolve(local, remote)
+	}
+	return []*Summary{merged}
+}
+
+// merge merges the content of the summaries with the Merger of their
+// extension
+func (sm StoreMerger) merge(base *Summary, local *Summary, remote *Summary) (*Summary, error) {
+	mergers := sm.Mergers
+	if mergers == nil {
+		mergers = DefaultMergers
+	}
+	merger, found := mergers[strings.ToLower(path.Ext(local.Path))]
+	if !found {
+		return nil, fmt.Errorf("No merger for '%s'", local.Path)
+	}
+	var contents [3][]byte
+	for n, s := range []*Summary{base, local, remote} {
+		if s.special() || s.Size > maxMergeSize {
+			return nil, fmt.Errorf("Can't merge '%s'", s.Path)
+		}
+		content, err := sm.read(s)
+		if err != nil {
+			return nil, err
+		}
+		contents[n] = content
+	}
+	content, err := merger.Merge(contents[0], contents[1], contents[2])
+	if err != nil {
+		return nil, err
+	}
+	merged, err := sm.write(content)
+	if err != nil {
+		return nil, err
+	}
+	merged.Parent = local.ID
+	merged.Path = local.Path
+	merged.Perm = local.Perm
+	merged.ModTime = local.ModTime
+	if remote.ModTime > merged.ModTime {
+		merged.ModTime = remote.ModTime
+	}
+	merged.Version = local.Version.Merge(remote.Version)
+	if sm.Config.Device != "" {
+		merged.Version = merged.Version.Increment(sm.Config.Device)
+	}
+	return merged, nil
+}
+
+// read reads the content of the file described by s from the Store
+func (sm StoreMerger) read(s *Summary) ([]byte, error) {
+	var content bytes.Buffer
+	for _, hash := range s.Blocks {
+		b, err := sm.Store.Get(s.algorithm(), hash)
+		if err != nil {
+			return nil, err
+		}
+		content.Write(b.Content)
+	}
+	return content.Bytes(), nil
+}
+
+// write stores content, cut in blocks as Config says, and returns the
+// Summary of a new file with it
+func (sm StoreMerger) write(content []byte) (*Summary, error) {
+	chunker, err := GetChunker(sm.Config.Chunker, sm.Config.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := newHash(sm.Config.hash())
+	if err != nil {
+		return nil, err
+	}
+	id, _ := uuid.NewV4()
+	s := &Summary{
+		Blocks:    make([]string, 0),
+		BlockSize: sm.Config.blockSize(),
+		Chunker:   sm.Config.Chunker,
+		Hash:      sm.Config.hash(),
+		ID:        id.String(),
+		Sizes:     make([]int64, 0),
+	}
+	err = split(bytes.NewReader(content), chunker, func(data []byte) error {
+		b := &Block{Content: data}
+		hash, err := sm.Store.Put(s.Hash, b)
+		if err != nil {
+			return err
+		}
+		if b.IsZero() {
+			s.Zeros = append(s.Zeros, uint64(len(s.Blocks)))
+		}
+		digest.Write(data)
+		s.Blocks = append(s.Blocks, hash)
+		s.offsets = append(s.offsets, s.Size)
+		s.Size += int64(b.Size())
+		s.Sizes = append(s.Sizes, int64(b.Size()))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Digest = hex.EncodeToString(digest.Sum(nil))
+	return s, nil
+}
+
+// TextMerger merges text line by line: lines changed by only one of the
+// changes are taken from it, lines changed by both are a conflict unless
+// both made the same change
+type TextMerger struct{}
+
+// Merge merges the text, ErrConflict is returned if any line was changed
+// by both changes or the content is not text
+func (TextMerger) Merge(base []byte, local []byte, remote []byte) ([]byte, error) {
+	for _, content := range [][]byte{base, local, remote} {
+		if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+			return nil, ErrConflict
+		}
+	}
+	o, l, r := splitLines(base), splitLines(local), splitLines(remote)
+	ml, err := matchLines(o, l)
+	if err != nil {
+		return nil, err
+	}
+	mr, err := matchLines(o, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged bytes.Buffer
+	// merge a chunk of lines between lines left unchanged by both
+	chunk := func(o []string, l []string, r []string) bool {
+		switch {
+		case equalLines(o, l):
+			l = r
+		case equalLines(o, r), equalLines(l, r):
+		default:
+			return false
+		}
+		for _, line := range l {
+			merged.WriteString(line)
+		}
+		return true
+	}
+	i, a, b := 0, 0, 0
+	for i <= len(o) {
+		// next line of base kept by both
+		next := i
+		for next < len(o) && (ml[next] < 0 || mr[next] < 0) {
+			next++
+		}
+		if next == len(o) {
+			if !chunk(o[i:], l[a:], r[b:]) {
+				return nil, ErrConflict
+			}
+			break
+		}
+		if !chunk(o[i:next], l[a:ml[next]], r[b:mr[next]]) {
+			return nil, ErrConflict
+		}
+		merged.WriteString(o[next])
+		i, a, b = next+1, ml[next]+1, mr[next]+1
+	}
+	return merged.Bytes(), nil
+}
+
+// equalLines checks if both slices have the same lines
+func equalLines(l1 []string, l2 []string) bool {
+	if len(l1) != len(l2) {
+		return false
+	}
+	for n := range l1 {
+		if l1[n] != l2[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLines returns the line of l each line of o is kept as, -1 if it
+// was changed, using their longest common subsequence. Lines common to the
+// start and the end of both are matched first, ErrConflict is returned if
+// what remains is too big to be compared
+func matchLines(o []string, l []string) ([]int, error) {
+	m := make([]int, len(o))
+	for n := range m {
+		m[n] = -1
+	}
+	start := 0
+	for start < len(o) && start < len(l) && o[start] == l[start] {
+		m[start] = start
+		start++
+	}
+	end := 0
+	for end < len(o)-start && end < len(l)-start && o[len(o)-1-end] == l[len(l)-1-end] {
+		m[len(o)-1-end] = len(l) - 1 - end
+		end++
+	}
+	o, l = o[start:len(o)-end], l[start:len(l)-end]
+	if len(o)*len(l) > maxMergeLines {
+		return nil, ErrConflict
+	}
+	// length of the longest common subsequence of o[i:] and l[j:]
+	lcs := make([][]int32, len(o)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(l)+1)
+	}
+	for i := len(o) - 1; i >= 0; i-- {
+		for j := len(l) - 1; j >= 0; j-- {
+			switch {
+			case o[i] == l[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(o) && j < len(l); {
+		switch {
+		case o[i] == l[j]:
+			m[start+i] = start + j
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return m, nil
+}
+
+// mergeJSON merges two decoded JSON values, objects are merged key by key
+func mergeJSON(base interface{}, local interface{}, remote interface{}) (interface{}, error) {
+	switch {
+	case reflect.DeepEqual(local, remote), reflect.DeepEqual(base, remote):
+		return local, nil
+	case reflect.DeepEqual(base, local):
+		return remote, nil
+	}
+	o, isObject := base.(map[string]interface{})
+	l, lIsObject := local.(map[string]interface{})
+	r, rIsObject := remote.(map[string]interface{})
+	if !lIsObject || !rIsObject {
+		return nil, ErrConflict
+	}
+	// objects added by both are merged as if they were empty before
+	if !isObject {
+		o = make(map[string]interface{})
+	}
+	merged := make(map[string]interface{})
+	for key := range l {
+		merged[key] = nil
+	}
+	for key := range r {
+		merged[key] = nil
+	}
+	for key := range merged {
+		ov, inBase := o[key]
+		lv, inLocal := l[key]
+		rv, inRemote := r[key]
+		switch {
+		case inLocal && inRemote:
+			if !inBase {
+				ov = nil
+			}
+			v, err := mergeJSON(ov, lv, rv)
+			if err != nil {
+				return nil, err
+			}
+			merged[key] = v
+		// removed by one and left unchanged by the other
+		case inBase && inLocal && reflect.DeepEqual(ov, lv),
+			inBase && inRemote && reflect.DeepEqual(ov, rv):
+			delete(merged, key)
+		// added by one
+		case !inBase && inLocal:
+			merged[key] = lv
+		case !inBase && inRemote:
+			merged[key] = rv
+		default:
+			return nil, ErrConflict
+		}
+	}
+	return merged, nil
+}
+
+// splitLines splits text in lines, keeping the line breaks
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
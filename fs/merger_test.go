@@ -0,0 +1,156 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestJSONMerger merges objects key by key
+func TestJSONMerger(t *testing.T) {
+	base := []byte("{\n\t\"a\": 1,\n\t\"b\": {\"c\": 2, \"d\": 3},\n\t\"e\": [1]\n}\n")
+	local := []byte("{\n\t\"a\": 1,\n\t\"b\": {\"c\": 4, \"d\": 3},\n\t\"e\": [1],\n\t\"f\": \"<f>\"\n}\n")
+	remote := []byte(`{"a": 5, "b": {"c": 2}, "e": [1]}`)
+	merged, err := JSONMerger{}.Merge(base, local, remote)
+	expected := "{\n\t\"a\": 5,\n\t\"b\": {\n\t\t\"c\": 4\n\t},\n\t\"e\": [\n\t\t1\n\t],\n\t\"f\": \"<f>\"\n}\n"
+	if err != nil || string(merged) != expected {
+		t.Fatal(err, string(merged))
+	}
+
+	// the result doesn't depend on the formatting of local
+	swapped, err := JSONMerger{}.Merge(base, remote, local)
+	if err != nil || string(swapped) != expected {
+		t.Fatal(err, string(swapped))
+	}
+
+	// changed by both
+	if _, err = (JSONMerger{}).Merge(base, []byte(`{"e": [2]}`), []byte(`{"e": [3]}`)); err != ErrConflict {
+		t.FailNow()
+	}
+	// removed by one, changed by the other
+	if _, err = (JSONMerger{}).Merge(base, []byte(`{"a": 2}`), []byte(`{}`)); err != ErrConflict {
+		t.FailNow()
+	}
+	// not JSON
+	if _, err = (JSONMerger{}).Merge(base, local, []byte("{")); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestTextMerger merges the lines changed by each change
+func TestTextMerger(t *testing.T) {
+	base := "1\n2\n3\n4\n5\n"
+	results := []struct {
+		local    string
+		remote   string
+		expected string
+	}{
+		{"0\n1\n2\n3\n4\n5\n", "1\n2\n3\n4\n", "0\n1\n2\n3\n4\n"},
+		{"1\n2\n3\n4\n5\n", "1\n3\n4\n5\n6", "1\n3\n4\n5\n6"},
+		{"1\nb\n3\n4\n5\n", "1\n2\n3\nd\n5\n", "1\nb\n3\nd\n5\n"},
+		{"1\nb\n3\n4\n5\n", "1\nb\n3\n4\n", "1\nb\n3\n4\n"}, // same change
+		{"", "", ""},
+	}
+	for _, r := range results {
+		merged, err := TextMerger{}.Merge([]byte(base), []byte(r.local), []byte(r.remote))
+		if err != nil || string(merged) != r.expected {
+			t.Fatal(err, r.local, r.remote, string(merged))
+		}
+	}
+
+	// the same lines changed by both
+	conflicts := [][2]string{
+		{"1\nb\n3\n4\n5\n", "1\nB\n3\n4\n5\n"},
+		{"1\n2\nc\n4\n5\n", "1\n2\n4\n5\n"},
+		{"1\n2\n3\n4\n5\n\x00", "1\n2\n3\n4\n"},
+	}
+	for _, c := range conflicts {
+		if _, err := (TextMerger{}).Merge([]byte(base), []byte(c[0]), []byte(c[1])); err != ErrConflict {
+			t.Fatal(c)
+		}
+	}
+}
+
+// TestStoreMerger merges conflicts with the content of the Store
+func TestStoreMerger(t *testing.T) {
+	st, err := OpenStore(filepath.Join(testDir, "StoreMerger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := StoreMerger{Config: MakeConfig(), Store: st}
+	sm.Config.Device = "c"
+	stored := func(content string, id string, parent string, version Version) *Summary {
+		s, err := sm.write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ID, s.Parent, s.Path, s.Version = id, parent, "notes.txt", version
+		return s
+	}
+	base := stored("1\n2\n3\n", "f.0", "", Version{"a": 1})
+	local := stored("0\n1\n2\n3\n", "f.a", base.ID, Version{"a": 2})
+	remote := stored("1\n2\n3\n4\n", "f.b", base.ID, Version{"a": 1, "b": 1})
+	i1, _ := MakeIndex(local)
+	i1.AddParent(base)
+	i2, _ := MakeIndex(remote)
+	i2.AddParent(base)
+
+	m, err := MergeWith(i1, i2, sm)
+	if err != nil || len(m.Files) != 1 {
+		t.Fatal(err, m.Files)
+	}
+	merged := m.Files["notes.txt"]
+	if content, err := sm.read(merged); err != nil || string(content) != "0\n1\n2\n3\n4\n" {
+		t.Fatal(err, string(content))
+	}
+	if merged.Parent != local.ID || merged.Version.Compare(Version{"a": 2, "b": 1, "c": 1}) != VersionEqual {
+		t.FailNow()
+	}
+
+	// Merge uses the mergers of the Config if the index has a store
+	i1.Config.Mergers = map[string]string{".txt": MergerText}
+	i1.Config.Store = true
+	if m, err = Merge(i1, i2); err != nil || len(m.Files) != 2 {
+		t.Fatal(err, m.Files)
+	}
+	i1.Store = st
+	if m, err = Merge(i1, i2); err != nil || len(m.Files) != 1 || m.Files["notes.txt"].Parent != local.ID {
+		t.Fatal(err, m.Files)
+	}
+	// and so does MergeFile
+	summaries, err := MergeFile(i1, i2, "notes.txt")
+	if err != nil || len(summaries) != 1 {
+		t.Fatal(err, summaries)
+	}
+	if content, err := sm.read(summaries[0]); err != nil || string(content) != "0\n1\n2\n3\n4\n" {
+		t.Fatal(err, string(content))
+	}
+	if _, err = MergeFile(i1, i2, "missing.txt"); err == nil {
+		t.FailNow()
+	}
+
+	// summaries without versions are merged too
+	legacyLocal, legacyRemote := *local, *remote
+	legacyLocal.Version, legacyRemote.Version = nil, nil
+	i1.Add(&legacyLocal)
+	i2.Add(&legacyRemote)
+	if m, err = MergeWith(i1, i2, sm); err != nil || len(m.Files) != 1 ||
+		m.Files["notes.txt"].Parent != local.ID {
+		t.Fatal(err, m.Files)
+	}
+	i1.Add(local)
+	i2.Add(remote)
+
+	// changes that can't be merged are kept as conflict copies
+	conflict := stored("1\n2\n3\n5\n", "f.c", base.ID, Version{"a": 1, "c": 1})
+	i3, _ := MakeIndex(conflict)
+	i3.AddParent(base)
+	if m, err = MergeWith(i2, i3, sm); err != nil || len(m.Files) != 2 {
+		t.Fatal(err, m.Files)
+	}
+	// and so are those without a common ancestor
+	i1.Parents = make(map[string]*Summary)
+	i2.Parents = make(map[string]*Summary)
+	if m, err = MergeWith(i1, i2, sm); err != nil || len(m.Files) != 2 {
+		t.Fatal(err, m.Files)
+	}
+}
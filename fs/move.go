@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"sort"
+	"strings"
+)
+
+// move is a file of an older Index found, maybe changed, in another path
+type move struct {
+	from       *Summary
+	to         *Summary
+	similarity float64 // fraction of blocks shared by both
+}
+
+// closer checks if m keeps more of the path of the moved file than m2,
+// moves in the same directory or of a renamed directory do
+func (m move) closer(m2 move) bool {
+	c, c2 := commonSuffix(m.from.Path, m.to.Path), commonSuffix(m2.from.Path, m2.to.Path)
+	if c != c2 {
+		return c > c2
+	}
+	if m.from.Path != m2.from.Path {
+		return m.from.Path < m2.from.Path
+	}
+	return m.to.Path < m2.to.Path
+}
+
+// findMoves matches the files of oldIndex missing in newIndex with the
+// files created in newIndex and returns the new path of each moved file.
+// Files are moved if their content is equal or shares at least
+// moveSimilarity of its blocks, each created file is matched at most once.
+// Directories are moved where most of their content was moved, links are
+// never moved
+func findMoves(oldIndex *Index, newIndex *Index) map[string]string {
+	vanished := make([]*Summary, 0)
+	for path, s := range oldIndex.Files {
+		if _, found := newIndex.Files[path]; !found {
+			vanished = append(vanished, s)
+		}
+	}
+	sort.Slice(vanished, func(i, j int) bool { return vanished[i].Path < vanished[j].Path })
+	created := make(map[string]*Summary)
+	for path, ns := range newIndex.Files {
+		if _, found := oldIndex.Files[path]; !found {
+			created[path] = ns
+		}
+	}
+	moves := make(map[string]string)
+	claim := func(m move) {
+		moves[m.from.Path] = m.to.Path
+		delete(created, m.to.Path)
+	}
+
+	// equal content, looked up by the hashes of the blocks
+	byContent := make(map[string][]*Summary)
+	for _, ns := range created {
+		if !ns.special() {
+			byContent[contentKey(ns)] = append(byContent[contentKey(ns)], ns)
+		}
+	}
+	for _, s := range vanished {
+		if s.special() {
+			continue
+		}
+		var best *move
+		for _, ns := range byContent[contentKey(s)] {
+			m := move{from: s, to: ns, similarity: 1}
+			if _, free := created[ns.Path]; free && s.Equals(ns) && (best == nil || m.closer(*best)) {
+				best = &m
+			}
+		}
+		if best != nil {
+			claim(*best)
+		}
+	}
+
+	// similar content, the most similar files are matched first
+	similar := findSimilar(vanished, created, moves)
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].similarity != similar[j].similarity {
+			return similar[i].similarity > similar[j].similarity
+		}
+		return similar[i].closer(similar[j])
+	})
+	for _, m := range similar {
+		_, moved := moves[m.from.Path]
+		if _, free := created[m.to.Path]; free && !moved {
+			claim(m)
+		}
+	}
+
+	// directories, each moved file votes for the directories that contain
+	// it, in both paths, to be the same
+	votes := make(map[string]map[string]int)
+	vote := func(dir string, to string) {
+		if votes[dir] == nil {
+			votes[dir] = make(map[string]int)
+		}
+		votes[dir][to]++
+	}
+	for from, to := range moves {
+		for n := strings.LastIndex(from, "/"); n > 0; n = strings.LastIndex(from[:n], "/") {
+			rel := from[n:]
+			if !strings.HasSuffix(to, rel) || len(to) == len(rel) {
+				break
+			}
+			vote(from[:n], to[:len(to)-len(rel)])
+		}
+	}
+	// parents are sorted before their content
+	for _, s := range vanished {
+		if !s.IsDir() {
+			continue
+		}
+		// empty directories follow the directory they are in
+		if n := strings.LastIndex(s.Path, "/"); n > 0 {
+			if to, moved := moves[s.Path[:n]]; moved {
+				vote(s.Path, to+s.Path[n:])
+			}
+		}
+		best := ""
+		for to, n := range votes[s.Path] {
+			ns, free := created[to]
+			if !free || !ns.IsDir() {
+				continue
+			}
+			if best == "" || n > votes[s.Path][best] || (n == votes[s.Path][best] && to < best) {
+				best = to
+			}
+		}
+		if best != "" {
+			claim(move{from: s, to: created[best]})
+		}
+	}
+	return moves
+}
+
+// findSimilar returns the possible moves of the vanished files that weren't
+// moved to the created files they share at least moveSimilarity of their
+// blocks with. Blocks are looked up by their hashes, all-zero blocks are
+// not compared
+func findSimilar(vanished []*Summary, created map[string]*Summary, moves map[string]string) []move {
+	holders := make(map[string][]*Summary)
+	sizes := make(map[string]int)
+	for _, ns := range created {
+		if ns.special() {
+			continue
+		}
+		blocks := distinctBlocks(ns)
+		for block := range blocks {
+			holders[block] = append(holders[block], ns)
+		}
+		sizes[ns.Path] = len(blocks)
+	}
+	similar := make([]move, 0)
+	for _, s := range vanished {
+		if _, moved := moves[s.Path]; moved || s.special() {
+			continue
+		}
+		blocks := distinctBlocks(s)
+		shared := make(map[*Summary]int)
+		for block := range blocks {
+			for _, ns := range holders[block] {
+				shared[ns]++
+			}
+		}
+		for ns, n := range shared {
+			total := len(blocks)
+			if sizes[ns.Path] > total {
+				total = sizes[ns.Path]
+			}
+			if similarity := float64(n) / float64(total); similarity >= moveSimilarity {
+				similar = append(similar, move{from: s, to: ns, similarity: similarity})
+			}
+		}
+	}
+	return similar
+}
+
+// commonSuffix returns the number of trailing path elements two slash
+// separated paths share
+func commonSuffix(p1 string, p2 string) int {
+	e1, e2 := strings.Split(p1, "/"), strings.Split(p2, "/")
+	n := 0
+	for n < len(e1) && n < len(e2) && e1[len(e1)-1-n] == e2[len(e2)-1-n] {
+		n++
+	}
+	return n
+}
+
+// contentKey identifies the content of a summary by the hashes of its
+// blocks, summaries with the same key are equal if their digests are too
+func contentKey(s *Summary) string {
+	return s.algorithm() + "\x00" + strings.Join(s.Blocks, "\x00")
+}
+
+// distinctBlocks returns the set of hashes of the blocks of s that are not
+// all zeros, prefixed by their algorithm
+func distinctBlocks(s *Summary) map[string]bool {
+	blocks := make(map[string]bool)
+	for n, block := range s.Blocks {
+		if block != "" && !s.IsZero(n) {
+			blocks[s.algorithm()+"\x00"+block] = true
+		}
+	}
+	return blocks
+}
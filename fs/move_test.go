@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestFindMoves matches moved files, changed or not, and directories
+func TestFindMoves(t *testing.T) {
+	dir := &Summary{ID: "d.0", Path: "d", Perm: os.ModeDir | 0755}
+	oldIndex, _ := MakeIndex(
+		&Summary{ID: "a.0", Path: "a", Blocks: []string{"1", "2"}},
+		&Summary{ID: "b.0", Path: "b", Blocks: []string{"3", "4", "5", "6"}},
+		&Summary{ID: "c.0", Path: "c", Blocks: []string{"7", "8"}},
+		dir,
+		&Summary{ID: "d/x.0", Path: "d/x", Blocks: []string{"9"}},
+		&Summary{ID: "d/e/x.0", Path: "d/e/x", Blocks: []string{"9"}},
+		&Summary{ID: "d/e/f.0", Path: "d/e/f", Perm: dir.Perm},
+		&Summary{ID: "d/e.0", Path: "d/e", Perm: dir.Perm})
+	newIndex, _ := MakeIndex(
+		&Summary{ID: "a.1", Path: "n/a", Blocks: []string{"1", "2"}},      // moved
+		&Summary{ID: "b.1", Path: "n/b", Blocks: []string{"3", "4", "5"}}, // moved and changed
+		&Summary{ID: "c.1", Path: "n/c", Blocks: []string{"7", "0", "1"}}, // too different
+		&Summary{ID: "r.0", Path: "r", Perm: dir.Perm},
+		&Summary{ID: "r/x.0", Path: "r/x", Blocks: []string{"9"}},
+		&Summary{ID: "r/e.0", Path: "r/e", Perm: dir.Perm},
+		&Summary{ID: "r/e/x.0", Path: "r/e/x", Blocks: []string{"9"}},
+		&Summary{ID: "r/e/f.0", Path: "r/e/f", Perm: dir.Perm})
+
+	expected := map[string]string{
+		"a":     "n/a",
+		"b":     "n/b",
+		"d":     "r",
+		"d/x":   "r/x",
+		"d/e":   "r/e",
+		"d/e/x": "r/e/x",
+		"d/e/f": "r/e/f",
+	}
+	if moves := findMoves(oldIndex, newIndex); !reflect.DeepEqual(moves, expected) {
+		t.Fatal(moves)
+	}
+}
+
+// TestIndex_Update_Moves records a renamed directory as moves
+func TestIndex_Update_Moves(t *testing.T) {
+	perm := os.ModeDir | 0755
+	oldIndex, _ := MakeIndex(
+		&Summary{ID: "d.0", Path: "d", Perm: perm},
+		&Summary{ID: "d/x.0", Path: "d/x", Blocks: []string{"1", "2"}})
+	newIndex, _ := MakeIndex(
+		&Summary{ID: "r.0", Path: "r", Perm: perm},
+		&Summary{ID: "r/x.0", Path: "r/x", Blocks: []string{"1", "3"}})
+
+	u := Update(oldIndex, newIndex)
+	if len(u.Deletions) != 0 || len(u.Parents) != 2 ||
+		u.Files["r"].Parent != "d.0" || u.Files["r/x"].Parent != "d/x.0" {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// notifyMask are the inotify events that change the content of a directory
+const notifyMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// notifier reports the changes made to the watched directories using inotify
+type notifier struct {
+	events chan notifyEvent
+	fd     int      // only used to add watches, Fd would make file blocking
+	file   *os.File // reads are interrupted when file is closed
+	mutex  sync.Mutex
+	dirs   map[int32]string // watched directories by watch descriptor
+}
+
+// newNotifier starts reading the events of a new inotify instance, the file
+// descriptor is non-blocking so closing it stops the reader
+func newNotifier() (*notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	n := &notifier{
+		events: make(chan notifyEvent),
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+	}
+	go n.read()
+	return n, nil
+}
+
+// add watches the content of dir, but not of its subdirectories
+func (n *notifier) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, notifyMask)
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	n.dirs[int32(wd)] = dir
+	n.mutex.Unlock()
+	return nil
+}
+
+// close stops watching every directory, events is closed afterwards
+func (n *notifier) close() error {
+	return n.file.Close()
+}
+
+// read sends the events read from inotify until it is closed
+func (n *notifier) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		read, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= read; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				n.events <- notifyEvent{overflow: true}
+				continue
+			}
+			n.mutex.Lock()
+			dir, found := n.dirs[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.dirs, raw.Wd)
+			}
+			n.mutex.Unlock()
+			if !found || raw.Len == 0 {
+				continue
+			}
+			name := string(bytes.TrimRight(buf[start:offset], "\x00"))
+			n.events <- notifyEvent{
+				created: raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+				dir:     raw.Mask&syscall.IN_ISDIR != 0,
+				path:    filepath.Join(dir, name),
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import "errors"
+
+// notifier can't watch directories in this platform
+type notifier struct {
+	events chan notifyEvent
+}
+
+// newNotifier returns an error, directories have to be scanned
+func newNotifier() (*notifier, error) {
+	return nil, errors.New("Watching directories is not supported in this platform")
+}
+
+// add does nothing
+func (n *notifier) add(dir string) error {
+	return nil
+}
+
+// close does nothing
+func (n *notifier) close() error {
+	return nil
+}
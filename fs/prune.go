@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retention decides which parents and deletions Index.Prune removes
+//	Confirmed:	only remove what no contact is still using, if neither
+//			MaxAge nor MaxParents is set everything no contact is
+//			using is removed
+//	MaxAge:		remove parents and deletions retired longer ago
+//	MaxParents:	remove the oldest parents of each file beyond this number
+// Zero values keep everything. Deletions are only removed once every
+// contact confirms them, even without Confirmed, so contacts that don't
+// synchronize in MaxAge can't bring deleted files back
+type Retention struct {
+	Confirmed  bool          `json:"confirmed,omitempty"`
+	MaxAge     time.Duration `json:"max_age,omitempty"`
+	MaxParents int           `json:"max_parents,omitempty"`
+}
+
+// Validate checks that the limits of the Retention are not negative
+func (r Retention) Validate() error {
+	if r.MaxAge < 0 || r.MaxParents < 0 {
+		return fmt.Errorf("Invalid retention: max age %s, max parents %d", r.MaxAge, r.MaxParents)
+	}
+	return nil
+}
+
+// Prune removes the parents and deletions of the Index that r doesn't
+// keep and returns how many were removed. contacts are the last indices
+// received from every known contact, nil if one hasn't been received: an
+// entry is confirmed if no contact has a file with its ID. Deletions are
+// always confirmed first. Entries retired before their retirement was
+// recorded are considered retired now
+func (i *Index) Prune(r Retention, now time.Time, contacts ...*Index) int {
+	stampRetired(i.Parents, now)
+	stampRetired(i.Deletions, now)
+
+	used := make(map[string]bool)
+	unknown := false
+	for _, c := range contacts {
+		if c == nil {
+			unknown = true
+			continue
+		}
+		for _, s := range c.Files {
+			used[s.ID] = true
+		}
+	}
+	confirmed := func(id string) bool {
+		return !unknown && !used[id]
+	}
+	expired := func(s *Summary) bool {
+		return r.MaxAge > 0 && now.Sub(time.Unix(0, s.Retired)) > r.MaxAge
+	}
+	all := r.Confirmed && r.MaxAge == 0 && r.MaxParents == 0
+	excess := i.excessParents(r.MaxParents)
+
+	removed := 0
+	for id, s := range i.Parents {
+		if (all || expired(s) || excess[id]) && (!r.Confirmed || confirmed(id)) {
+			i.DeleteParent(s)
+			removed++
+		}
+	}
+	for id, s := range i.Deletions {
+		if (all || expired(s)) && confirmed(id) {
+			i.DeleteDeletion(s)
+			removed++
+		}
+	}
+	return removed
+}
+
+// excessParents returns the IDs of the parents beyond the newest max of
+// each file or deletion, parents shared by several lines are kept if any
+// of them keeps them
+func (i *Index) excessParents(max int) map[string]bool {
+	excess := make(map[string]bool)
+	if max <= 0 {
+		return excess
+	}
+	kept := make(map[string]bool)
+	walk := func(s *Summary) {
+		visited := make(map[string]bool)
+		n := 0
+		for p, found := i.Parents[s.Parent]; found && !visited[p.ID]; p, found = i.Parents[p.Parent] {
+			visited[p.ID] = true
+			if n++; n > max {
+				excess[p.ID] = true
+			} else {
+				kept[p.ID] = true
+			}
+		}
+	}
+	for _, s := range i.Files {
+		walk(s)
+	}
+	for _, s := range i.Deletions {
+		walk(s)
+	}
+	for id := range kept {
+		delete(excess, id)
+	}
+	return excess
+}
+
+// stampRetired sets the retirement time of the summaries that don't have
+// one, summaries are copied before they are modified
+func stampRetired(summaries map[string]*Summary, now time.Time) {
+	for id, s := range summaries {
+		if s.Retired == 0 {
+			stamped := *s
+			stamped.Retired = now.UnixNano()
+			summaries[id] = &stamped
+		}
+	}
+}
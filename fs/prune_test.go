@@ -0,0 +1,133 @@
+package fs
+
+import (
+	"testing"
+	"time"
+)
+
+// TestIndex_Prune removes old parents and deletions
+func TestIndex_Prune(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour).UnixNano()
+	p0 := &Summary{ID: "f.0", Path: "f", Retired: old}
+	p1 := &Summary{ID: "f.1", Parent: p0.ID, Path: "f", Retired: old}
+	p2 := &Summary{ID: "f.2", Parent: p1.ID, Path: "f"}
+	f := &Summary{ID: "f.3", Parent: p2.ID, Path: "f"}
+	d := &Summary{ID: "d.0", Path: "d", Retired: old}
+	makeIndex := func() *Index {
+		i, _ := MakeIndex(f)
+		i.AddParent(p0, p1, p2)
+		i.AddDeletion(d)
+		return i
+	}
+
+	// nothing is removed by default
+	i := makeIndex()
+	if i.Prune(Retention{}, now) != 0 || len(i.Parents) != 3 || len(i.Deletions) != 1 {
+		t.FailNow()
+	}
+	// entries without a retirement time are retired now
+	if i.Parents[p2.ID].Retired != now.UnixNano() || p2.Retired != 0 {
+		t.FailNow()
+	}
+	// by age
+	i = makeIndex()
+	if i.Prune(Retention{MaxAge: 24 * time.Hour}, now) != 3 ||
+		len(i.Parents) != 1 || i.Parents[p2.ID] == nil || len(i.Deletions) != 0 {
+		t.FailNow()
+	}
+	// deletions a contact may still have are kept, unknown or behind
+	behind, _ := MakeIndex(d)
+	for _, contact := range []*Index{nil, behind} {
+		i = makeIndex()
+		if i.Prune(Retention{MaxAge: 24 * time.Hour}, now, contact) != 2 || len(i.Deletions) != 1 {
+			t.Fatal(i.Deletions)
+		}
+	}
+	// by number of parents
+	i = makeIndex()
+	if i.Prune(Retention{MaxParents: 2}, now) != 1 ||
+		len(i.Parents) != 2 || i.Parents[p0.ID] != nil || len(i.Deletions) != 1 {
+		t.FailNow()
+	}
+}
+
+// TestIndex_Prune_Confirmed only removes what no contact is using
+func TestIndex_Prune_Confirmed(t *testing.T) {
+	now := time.Now()
+	p0 := &Summary{ID: "f.0", Path: "f"}
+	f := &Summary{ID: "f.1", Parent: p0.ID, Path: "f"}
+	d := &Summary{ID: "d.0", Path: "d"}
+	makeIndex := func() *Index {
+		i, _ := MakeIndex(f)
+		i.AddParent(p0)
+		i.AddDeletion(d)
+		return i
+	}
+	r := Retention{Confirmed: true}
+	updated, _ := MakeIndex(f)
+	behind, _ := MakeIndex(p0, d)
+
+	// the index of a contact is unknown
+	i := makeIndex()
+	if i.Prune(r, now, updated, nil) != 0 {
+		t.FailNow()
+	}
+	// a contact still has the old files
+	if i.Prune(r, now, updated, behind) != 0 {
+		t.FailNow()
+	}
+	// every contact has synchronized
+	if i.Prune(r, now, updated) != 2 || len(i.Parents) != 0 || len(i.Deletions) != 0 {
+		t.FailNow()
+	}
+	// limits are still applied
+	i = makeIndex()
+	r.MaxAge = time.Hour
+	if i.Prune(r, now, updated) != 0 {
+		t.FailNow()
+	}
+}
+
+// TestRetention_Validate rejects negative limits
+func TestRetention_Validate(t *testing.T) {
+	if (Retention{Confirmed: true, MaxAge: time.Hour, MaxParents: 1}).Validate() != nil {
+		t.FailNow()
+	}
+	if (Retention{MaxAge: -time.Hour}).Validate() == nil {
+		t.FailNow()
+	}
+}
+
+// TestMerge_Tombstones doesn't bring back files deleted after their parents
+// were pruned, but keeps files created again in their path
+func TestMerge_Tombstones(t *testing.T) {
+	s0 := &Summary{ID: "f.0", Path: "f", Blocks: []string{"0"}, Version: Version{"a": 1}}
+	s1 := &Summary{ID: "f.1", Parent: s0.ID, Path: "f", Blocks: []string{"1"},
+		Version: Version{"a": 2}}
+	old, _ := MakeIndex(s1)
+
+	// s1 is deleted after its parent s0 was pruned
+	i1 := Update(old, &Index{Config: old.Config, Files: map[string]*Summary{}})
+	if len(i1.Parents) != 0 || len(i1.Deletions) != 1 {
+		t.FailNow()
+	}
+	// a contact still has s0, which isn't the deleted file nor its parent
+	i2, _ := MakeIndex(s0)
+	for _, m := range []func() (*Index, error){
+		func() (*Index, error) { return Merge(i1, i2) },
+		func() (*Index, error) { return Merge(i2, i1) },
+	} {
+		if m, err := m(); err != nil || len(m.Files) != 0 {
+			t.Fatal(err, m.Files)
+		}
+	}
+
+	// files created again are newer than the deletion
+	created := &Summary{ID: "f.2", Path: "f", Blocks: []string{"2"}}
+	i3 := Update(i1, &Index{Config: i1.Config, Files: map[string]*Summary{"f": created}})
+	m, err := Merge(i3, i2)
+	if err != nil || len(m.Files) != 1 || m.Files["f"].ID != created.ID {
+		t.Fatal(err, m.Files)
+	}
+}
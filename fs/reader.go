@@ -0,0 +1,171 @@
+package fs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// BlockReader reads the blocks of a file one at a time, so a file can be
+// hashed or served without keeping all of its content in memory
+type BlockReader struct {
+	file *os.File
+	cr   *chunkReader
+}
+
+// OpenBlockReader opens the file in path to be divided by c
+func OpenBlockReader(path string, c Chunker) (*BlockReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockReader{file: file, cr: newChunkReader(file, c)}, nil
+}
+
+// Close closes the underlying file
+func (r *BlockReader) Close() error {
+	return r.file.Close()
+}
+
+// Next returns the next block of the file or io.EOF
+func (r *BlockReader) Next() (*Block, error) {
+	content, err := r.cr.next()
+	if err != nil {
+		return nil, err
+	}
+	return &Block{Content: content}, nil
+}
+
+// MakeSummaryFromPath creates the Summary of a file reading one block at a
+// time, c decides the chunker and the hash algorithm to use
+func MakeSummaryFromPath(path string, c Config) (*Summary, error) {
+	if !IsFile(path) {
+		return nil, fmt.Errorf("Not a valid path to a file: '%s'", path)
+	}
+	if err := ValidHash(c.hash()); err != nil {
+		return nil, err
+	}
+	chunker, err := GetChunker(c.Chunker, c.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := uuid.NewV4()
+	s := Summary{
+		Blocks:    make([]string, 0),
+		BlockSize: c.blockSize(),
+		Chunker:   c.Chunker,
+		Hash:      c.hash(),
+		ID:        id.String(),
+		Inode:     inode(info),
+		ModTime:   info.ModTime().UnixNano(),
+		Path:      path,
+		Perm:      info.Mode(),
+		Sizes:     make([]int64, 0),
+	}
+	digest, _ := newHash(s.Hash)
+	add := func(b *Block, hash string) {
+		if b.IsZero() {
+			s.Zeros = append(s.Zeros, uint64(len(s.Blocks)))
+		}
+		digest.Write(b.Content)
+		s.Blocks = append(s.Blocks, hash)
+		s.offsets = append(s.offsets, s.Size)
+		s.Size += int64(b.Size())
+		s.Sizes = append(s.Sizes, int64(b.Size()))
+	}
+
+	// blocks of fixed size inside holes are not read
+	if chunker.Name() == ChunkerFixed {
+		err = readFixed(path, info.Size(), chunker.MaxSize(), s.Hash, add)
+		if err != nil {
+			return nil, err
+		}
+		s.Digest = hex.EncodeToString(digest.Sum(nil))
+		return &s, nil
+	}
+
+	r, err := OpenBlockReader(path, chunker)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		add(b, b.HashWith(s.Hash))
+	}
+	s.Digest = hex.EncodeToString(digest.Sum(nil))
+	return &s, nil
+}
+
+// ReadBlock reads block n of the file in path, described by s, seeking
+// straight to its offset. An error is returned if the content of the
+// block has changed since the summary was created
+func ReadBlock(path string, s *Summary, n int) (*Block, error) {
+	offset, size, err := s.Offset(n)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content := make([]byte, size)
+	read, err := file.ReadAt(content, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b := &Block{Content: content[:read]}
+	if b.HashWith(s.Hash) != s.Blocks[n] {
+		return nil, fmt.Errorf("Block %d of '%s' has changed", n, path)
+	}
+	return b, nil
+}
+
+// readFixed reads a file of the given size in blocks of blockSize and calls
+// fn with each block and its hash. Blocks inside holes of sparse files are
+// neither read nor hashed
+func readFixed(path string, size int64, blockSize int64, algorithm string, fn func(*Block, string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	holes, err := findHoles(file, size)
+	if err != nil {
+		// holes are an optimization, read every block
+		holes = nil
+	}
+	buf := make([]byte, blockSize)
+	for offset := int64(0); offset < size; offset += blockSize {
+		n := blockSize
+		if size-offset < n {
+			n = size - offset
+		}
+		if covered(holes, offset, n) {
+			fn(ZeroBlock(n), hashZeros(algorithm, n))
+			continue
+		}
+		read, err := file.ReadAt(buf[:n], offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		b := &Block{Content: buf[:read]}
+		fn(b, b.HashWith(algorithm))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestBlockReader reads a file block by block and compares the blocks
+// with the ones created by File.Slice
+func TestBlockReader(t *testing.T) {
+	c := Config{Chunker: ChunkerCDC, BlockSize: 64 * 1024}
+	f, _ := MakeFileWithConfig(muffinPath, c)
+	chunker, _ := GetChunker(c.Chunker, c.BlockSize)
+	r, err := OpenBlockReader(muffinPath, chunker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; ; i++ {
+		b, err := r.Next()
+		if err == io.EOF {
+			if i != len(f.Blocks) {
+				t.FailNow()
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.DeepEquals(f.Blocks[i]) {
+			t.FailNow()
+		}
+	}
+
+	// non-existing file
+	if _, err = OpenBlockReader("", chunker); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestMakeSummaryFromPath compares a streamed summary with the summary of
+// a File
+func TestMakeSummaryFromPath(t *testing.T) {
+	f, _ := MakeFile(muffinPath)
+	s, err := MakeSummaryFromPath(muffinPath, MakeConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Equals(MakeSummary(f)) {
+		t.FailNow()
+	}
+
+	// invalid path and hash
+	if _, err = MakeSummaryFromPath("", MakeConfig()); err == nil {
+		t.FailNow()
+	}
+	if _, err = MakeSummaryFromPath(muffinPath, Config{Hash: "md4"}); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestReadBlock reads each block of a file by its offset, then modifies
+// the file and checks that the change is detected
+func TestReadBlock(t *testing.T) {
+	content := make([]byte, 2*BlockSize+42)
+	content[BlockSize] = 1
+	filename := filepath.Join(testDir, "ReadBlock")
+	ioutil.WriteFile(filename, content, 0644)
+
+	s, _ := MakeSummaryFromPath(filename, MakeConfig())
+	for i := range s.Blocks {
+		offset, size, _ := s.Offset(i)
+		b, err := ReadBlock(filename, s, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Content, content[offset:offset+size]) {
+			t.FailNow()
+		}
+	}
+
+	// out of range
+	if _, err := ReadBlock(filename, s, len(s.Blocks)); err == nil {
+		t.FailNow()
+	}
+
+	// modified file
+	content[0] = 1
+	ioutil.WriteFile(filename, content, 0644)
+	if _, err := ReadBlock(filename, s, 0); err == nil {
+		t.FailNow()
+	}
+}
@@ -3,11 +3,21 @@ package fs
 import (
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
+// racyWindow is how long after a scan starts a modified file could be
+// modified again without its modification time changing
+const racyWindow = 2 * time.Second
+
 // Scanner will be used to scan a directory and generate File structs
 type Scanner struct {
 	Root string
+	// Config stores the settings used to scan Root
+	Config Config
 	// Summaries lightens memory usage by avoiding storing
 	// files
 	Summaries []*Summary
@@ -15,22 +25,89 @@ type Scanner struct {
 	NewIndex *Index
 	// NewIndex will store the read summaries
 	OldIndex *Index
+	// Workers is the number of files hashed at the same time by Scan,
+	// runtime.NumCPU() if it is not set
+	Workers int
+	// following has the real paths of the directories follow is walking
+	following map[string]bool
+	// ignore decides which paths of Root are not scanned
+	ignore *Ignore
+	// started is when the scan started, to detect racy modification times
+	started time.Time
+	// jobs receives the files to hash while Scan is running
+	jobs chan scanJob
+	// rehashed has the summaries of OldIndex rehashed by the workers,
+	// indexed by path, until they replace them, see rehash
+	rehashed map[string]*Summary
+	mutex    sync.Mutex // guards rehashed
+	// store keeps the blocks of scanned files if Config.Store is set
+	store *Store
+}
+
+// scanJob is a file to be hashed by the workers of Scan, slot is the
+// position of its Summary in Scanner.Summaries
+type scanJob struct {
+	info os.FileInfo
+	path string
+	rel  string
+	slot int
+}
+
+// scanResult is the Summary of a scanJob or the error hashing it
+type scanResult struct {
+	err     error
+	slot    int
+	summary *Summary
 }
 
 // MakeScanner creates a new scanner, tries to read
 // OldIndex and create NewIndex
 func MakeScanner(root string) (*Scanner, error) {
-	s := new(Scanner)
-	s.Root = root
+	return MakeScannerWithConfig(root, nil)
+}
+
+// MakeScannerWithConfig creates a new scanner that uses c to scan root,
+// if c is nil the Config stored in OldIndex is used
+func MakeScannerWithConfig(root string, c *Config) (*Scanner, error) {
 	// Old Index
 	if SummaryExists(root) {
-		oldIndex, err := ReadIndex(filepath.Join(root, SummaryDir, SummaryFile))
+		oldIndex, err := ReadRootIndex(root)
 		if err != nil {
 			return nil, err
 		}
-		s.OldIndex = oldIndex
+		return MakeScannerWithIndex(root, oldIndex, c)
+	}
+	oldIndex, _ := MakeIndex()
+	return MakeScannerWithIndex(root, oldIndex, c)
+}
+
+// MakeScannerWithIndex creates a new scanner that uses c to scan root
+// starting from the summaries of oldIndex instead of the Index stored in
+// root. If c is nil the Config of oldIndex is used. Rehashed summaries
+// replace those of oldIndex, so NewIndex can be compared with it
+func MakeScannerWithIndex(root string, oldIndex *Index, c *Config) (*Scanner, error) {
+	s := new(Scanner)
+	s.Root = root
+	s.started = time.Now()
+	s.OldIndex = oldIndex
+	if c != nil {
+		s.Config = *c
+		// the device keeps its ID when the settings change
+		if s.Config.Device == "" {
+			s.Config.Device = s.OldIndex.Config.Device
+		}
 	} else {
-		s.OldIndex, _ = MakeIndex()
+		s.Config = s.OldIndex.Config
+	}
+	if err := s.Config.Validate(); err != nil {
+		return nil, err
+	}
+	if s.Config.Store {
+		store, err := OpenStore(root)
+		if err != nil {
+			return nil, err
+		}
+		s.store = store
 	}
 
 	// New Index
@@ -39,28 +116,323 @@ func MakeScanner(root string) (*Scanner, error) {
 		return nil, err
 	}
 	s.NewIndex, _ = MakeIndex(s.Summaries...)
+	s.NewIndex.Config = s.Config
+	s.NewIndex.Ignore = s.ignore
+	s.NewIndex.Store = s.store
 	return s, nil
 }
 
-// Scan runs Scanner.VisitDir in path (root folder) and each subdirectory
+// Scan runs Scanner.VisitDir in path (root folder) and each subdirectory,
+// path is used as Root if none is set. Files are hashed by a pool of
+// Workers, their summaries are kept in the order they are visited so the
+// result is the same as hashing them one at a time
 func (s *Scanner) Scan(path string) error {
-	if err := filepath.Walk(path, s.Visit); err != nil {
+	if s.Root == "" {
+		s.Root = path
+	}
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	s.jobs = make(chan scanJob)
+	results := make(chan scanResult)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range s.jobs {
+				summary, err := s.hashFile(j.path, j.rel, j.info)
+				results <- scanResult{err: err, slot: j.slot, summary: summary}
+			}
+		}()
+	}
+	collected := make(chan []scanResult)
+	go func() {
+		var rs []scanResult
+		for r := range results {
+			rs = append(rs, r)
+		}
+		collected <- rs
+	}()
+
+	walkErr := filepath.Walk(path, s.Visit)
+	close(s.jobs)
+	wg.Wait()
+	close(results)
+	rs := <-collected
+	s.jobs = nil
+	s.applyRehashed()
+
+	// the first error in walk order is returned, as in a sequential scan
+	errSlot := -1
+	var err error
+	for _, r := range rs {
+		if r.err != nil {
+			if errSlot < 0 || r.slot < errSlot {
+				errSlot, err = r.slot, r.err
+			}
+			continue
+		}
+		s.Summaries[r.slot] = r.summary
+	}
+	summaries := s.Summaries[:0]
+	for _, summary := range s.Summaries {
+		if summary != nil {
+			summaries = append(summaries, summary)
+		}
+	}
+	s.Summaries = summaries
+	if err != nil {
 		return err
 	}
-	return nil
+	return walkErr
 }
 
-// Visit creates a File when visiting a file and appends it to Summary.Files
+// Visit creates a Summary when visiting a file and appends it to
+// Scanner.Summaries, the file is read one block at a time
 func (s *Scanner) Visit(path string, f os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
+	if s.ignore == nil {
+		s.ignore = MakeIgnore()
+	}
+	if f.IsDir() && filepath.Clean(path) == filepath.Clean(s.Root) {
+		return s.ignore.AddFile(path, "")
+	}
+	// summaries are indexed by their path relative to the root
+	rel, err := RelPath(s.Root, path)
+	if err != nil {
+		return err
+	}
+	if s.ignore.Match(rel, f.IsDir()) {
+		if f.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if f.Mode()&os.ModeSymlink != 0 {
+		return s.visitLink(path, rel)
+	}
+	// rules of a directory apply to its content, which is visited next
+	if f.IsDir() {
+		summary, err := s.summarizeDir(path, rel, f)
+		if err != nil {
+			return err
+		}
+		s.Summaries = append(s.Summaries, summary)
+		return s.ignore.AddFile(path, rel)
+	}
 	if f.Mode().IsRegular() {
-		file, err := MakeFile(path)
+		// while Scan is running files are hashed by its workers, the slot
+		// of the Summary is reserved to keep the order of the walk
+		if s.jobs != nil {
+			s.jobs <- scanJob{info: f, path: path, rel: rel, slot: len(s.Summaries)}
+			s.Summaries = append(s.Summaries, nil)
+			return nil
+		}
+		summary, err := s.hashFile(path, rel, f)
+		if err != nil {
+			return err
+		}
+		s.applyRehashed()
+		s.Summaries = append(s.Summaries, summary)
+	}
+	return nil
+}
+
+// applyRehashed replaces the summaries of OldIndex rehashed by the workers
+// with their rehashed copies, once no worker is reading OldIndex
+func (s *Scanner) applyRehashed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for rel, summary := range s.rehashed {
+		s.OldIndex.Files[rel] = summary
+	}
+	s.rehashed = nil
+}
+
+// follow indexes the target of the link in path as if it was in path, links
+// pointing outside of Root and links to directories containing them or
+// already being followed, which would be followed forever, are skipped
+func (s *Scanner) follow(path string) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// broken links have nothing to index
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return err
+	}
+	if _, err = RelPath(root, target); err != nil {
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.Visit(path, info, nil)
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if parent == target || strings.HasPrefix(parent, target+string(filepath.Separator)) {
+		return nil
+	}
+	// directories linking to each other would be followed forever too
+	if s.following[target] {
+		return nil
+	}
+	if s.following == nil {
+		s.following = make(map[string]bool)
+	}
+	s.following[target] = true
+	defer delete(s.following, target)
+	return filepath.Walk(target, func(p string, f os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(target, p)
+		if relErr != nil {
+			return relErr
+		}
+		return s.Visit(filepath.Join(path, rel), f, err)
+	})
+}
+
+// hashFile creates the Summary of the regular file in path, indexed as rel,
+// and stores its blocks if the Store is enabled. It is safe to call from
+// several goroutines with different files
+func (s *Scanner) hashFile(path string, rel string, f os.FileInfo) (*Summary, error) {
+	summary, err := s.summarize(path, rel, f)
+	if err != nil {
+		return nil, err
+	}
+	if s.store != nil && !s.store.HasFile(summary) {
+		if err = s.store.AddFile(path, summary); err != nil {
+			return nil, err
+		}
+	}
+	return summary, nil
+}
+
+// rehash records a copy of the summary stored in OldIndex with the hashes
+// of summary when it was hashed with a different algorithm and the content
+// of the file hasn't changed, so Update doesn't see the file as modified.
+// The copy replaces it in OldIndex once the workers finish, see
+// applyRehashed
+func (s *Scanner) rehash(path string, summary *Summary) error {
+	if s.OldIndex == nil {
+		return nil
+	}
+	old, found := s.OldIndex.Files[summary.Path]
+	if !found || old.algorithm() == summary.Hash {
+		return nil
+	}
+	c := s.Config
+	c.Hash = old.algorithm()
+	previous, err := MakeSummaryFromPath(path, c)
+	if err != nil {
+		return err
+	}
+	if !previous.Equals(old) {
+		return nil
+	}
+	rehashed := *old
+	rehashed.Blocks = summary.Blocks
+	rehashed.Digest = summary.Digest
+	rehashed.Hash = summary.Hash
+	rehashed.Size = summary.Size
+	rehashed.Sizes = summary.Sizes
+	rehashed.offsets = summary.offsets
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rehashed == nil {
+		s.rehashed = make(map[string]*Summary)
+	}
+	s.rehashed[summary.Path] = &rehashed
+	return nil
+}
+
+// reuse returns a copy of the summary of rel stored in OldIndex if the
+// size, modification time and inode of the file haven't changed since it
+// was created and it was created using the same Config, nil otherwise
+func (s *Scanner) reuse(rel string, f os.FileInfo) *Summary {
+	if s.Config.Paranoid || s.OldIndex == nil {
+		return nil
+	}
+	old, found := s.OldIndex.Files[rel]
+	if !found || old.ModTime == 0 || old.Digest == "" {
+		return nil
+	}
+	if old.Size != f.Size() || old.ModTime != f.ModTime().UnixNano() || old.Inode != inode(f) {
+		return nil
+	}
+	if old.algorithm() != s.Config.hash() || old.Chunker != s.Config.Chunker ||
+		old.BlockSize != s.Config.blockSize() {
+		return nil
+	}
+	summary := *old
+	summary.Perm = f.Mode()
+	return &summary
+}
+
+// summarize creates the Summary of the file in path, indexed as rel,
+// reusing the one in OldIndex if the file hasn't changed. Files modified right before the scan
+// started are summarized without their modification time, as they could be
+// modified again without it changing, so they are read in the next scan too
+func (s *Scanner) summarize(path string, rel string, f os.FileInfo) (*Summary, error) {
+	if summary := s.reuse(rel, f); summary != nil {
+		return summary, nil
+	}
+	summary, err := MakeSummaryFromPath(path, s.Config)
+	if err != nil {
+		return nil, err
+	}
+	summary.Path = rel
+	if time.Unix(0, summary.ModTime).After(s.started.Add(-racyWindow)) {
+		summary.ModTime = 0
+	}
+	if err = s.rehash(path, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// summarizeDir creates the Summary of the directory in path, indexed as
+// rel, the one in OldIndex is kept if the mode of the directory hasn't changed
+func (s *Scanner) summarizeDir(path string, rel string, f os.FileInfo) (*Summary, error) {
+	if s.OldIndex != nil {
+		old, found := s.OldIndex.Files[rel]
+		if found && old.IsDir() && old.Perm == f.Mode() {
+			summary := *old
+			return &summary, nil
+		}
+	}
+	summary, err := MakeDirSummary(path, s.Config)
+	if err != nil {
+		return nil, err
+	}
+	summary.Path = rel
+	return summary, nil
+}
+
+// visitLink indexes the symbolic link in path, indexed as rel, according to
+// Config.Symlinks. Preserved links pointing outside of Root are skipped
+func (s *Scanner) visitLink(path string, rel string) error {
+	switch s.Config.Symlinks {
+	case SymlinksFollow:
+		return s.follow(path)
+	case SymlinksPreserve:
+		summary, err := MakeLinkSummary(path, s.Config)
 		if err != nil {
 			return err
 		}
-		summary := MakeSummary(file)
+		if !SafeLink(rel, summary.Target) {
+			return nil
+		}
+		summary.Path = rel
 		s.Summaries = append(s.Summaries, summary)
 	}
 	return nil
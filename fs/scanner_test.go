@@ -90,3 +90,296 @@ func TestSummaryExists(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// TestMakeScannerWithIndex scans a directory starting from an Index that
+// isn't the one stored in it, its Config is used and its summaries rehashed
+func TestMakeScannerWithIndex(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "MakeScannerWithIndex")
+	os.MkdirAll(unitTestDir, 0755)
+	filename := filepath.Join(unitTestDir, "file")
+	ioutil.WriteFile(filename, []byte{1, 2, 3}, 0644)
+
+	f, _ := MakeFile(filename)
+	f.Hash = HashFNV64a
+	sum := MakeSummary(f)
+	sum.Path = "file"
+	oldIndex, _ := MakeIndex(sum)
+	oldIndex.Config = MakeConfig()
+	oldIndex.Config.BlockSize = 2 * BlockSize
+
+	s, err := MakeScannerWithIndex(unitTestDir, oldIndex, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config.BlockSize != 2*BlockSize || s.NewIndex.Files["file"].BlockSize != 2*BlockSize {
+		t.FailNow()
+	}
+	u := Update(s.OldIndex, s.NewIndex)
+	if len(u.Parents) != 0 || u.Files["file"].Hash != DefaultHash {
+		t.FailNow()
+	}
+}
+
+// TestScanner_Rehash scans a directory whose index was hashed with FNV-1a
+// and checks that unchanged files are rehashed instead of modified
+func TestScanner_Rehash(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Rehash")
+	os.MkdirAll(filepath.Join(unitTestDir, SummaryDir), 0755)
+	filename := filepath.Join(unitTestDir, "file")
+	ioutil.WriteFile(filename, []byte{1, 2, 3}, 0644)
+
+	f, _ := MakeFile(filename)
+	f.Hash = HashFNV64a
+	oldIndex, _ := MakeIndex(MakeSummary(f))
+	oldIndex.Config = Config{}
+	WriteIndex(*oldIndex, filepath.Join(unitTestDir, SummaryDir, SummaryFile))
+
+	s, err := MakeScanner(unitTestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := Update(s.OldIndex, s.NewIndex)
+	if len(u.Parents) != 0 || u.Files["file"].Hash != DefaultHash {
+		t.FailNow()
+	}
+}
+
+// TestScanner_Store scans a directory with the store enabled, stored
+// blocks must not be indexed
+func TestScanner_Store(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "ScannerStore")
+	os.MkdirAll(unitTestDir, 0755)
+	filename := filepath.Join(unitTestDir, "file")
+	ioutil.WriteFile(filename, []byte{1, 2, 3}, 0644)
+
+	c := MakeConfig()
+	c.Store = true
+	s, err := MakeScannerWithConfig(unitTestDir, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.NewIndex.Files) != 1 {
+		t.FailNow()
+	}
+	st, _ := OpenStore(unitTestDir)
+	if !st.Has(c.Hash, s.NewIndex.Files["file"].Blocks[0]) {
+		t.FailNow()
+	}
+}
+
+// TestScanner_Reuse scans a directory twice, summaries of unchanged files
+// are taken from the old index unless the scanner is paranoid
+func TestScanner_Reuse(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Reuse")
+	os.MkdirAll(filepath.Join(unitTestDir, SummaryDir), 0755)
+	filename := filepath.Join(unitTestDir, "file")
+	ioutil.WriteFile(filename, []byte{1, 2, 3}, 0644)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filename, past, past)
+
+	s, err := MakeScanner(unitTestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := s.NewIndex.Files["file"]
+	if old.ModTime != past.UnixNano() {
+		t.FailNow()
+	}
+	WriteIndex(*s.NewIndex, filepath.Join(unitTestDir, SummaryDir, SummaryFile))
+
+	// unchanged file
+	s, _ = MakeScanner(unitTestDir)
+	if s.NewIndex.Files["file"].ID != old.ID {
+		t.FailNow()
+	}
+
+	// paranoid scanners read every file
+	c := s.Config
+	c.Paranoid = true
+	s, _ = MakeScannerWithConfig(unitTestDir, &c)
+	if s.NewIndex.Files["file"].ID == old.ID {
+		t.FailNow()
+	}
+
+	// same size, different modification time
+	ioutil.WriteFile(filename, []byte{3, 2, 1}, 0644)
+	os.Chtimes(filename, past, past.Add(time.Second))
+	s, _ = MakeScanner(unitTestDir)
+	if s.NewIndex.Files["file"].Digest == old.Digest {
+		t.FailNow()
+	}
+
+	// files modified during the scan are read in the next one
+	ioutil.WriteFile(filename, []byte{1, 2, 3}, 0644)
+	s, _ = MakeScanner(unitTestDir)
+	if s.NewIndex.Files["file"].ModTime != 0 {
+		t.FailNow()
+	}
+}
+
+// TestScanner_Ignore scans a directory with ignore files in the root and
+// in a subdirectory
+func TestScanner_Ignore(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Ignore")
+	for _, dir := range []string{SummaryDir, "build", "sub"} {
+		os.MkdirAll(filepath.Join(unitTestDir, dir), 0755)
+	}
+	files := map[string]string{
+		IgnoreFile:                     "build/\n*.tmp\n",
+		"a.tmp":                        "",
+		"b":                            "",
+		"build/c":                      "",
+		"sub/" + IgnoreFile:            "!keep.tmp\nd\n",
+		"sub/d":                        "",
+		"sub/keep.tmp":                 "",
+		SummaryDir + "/" + SummaryFile: "{}",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(unitTestDir, name), []byte(content), 0644)
+	}
+
+	s, err := MakeScanner(unitTestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{IgnoreFile, "b", "sub", "sub/" + IgnoreFile, "sub/keep.tmp"}
+	if len(s.NewIndex.Files) != len(expected) {
+		t.Fatal(s.NewIndex.Files)
+	}
+	for _, path := range expected {
+		if _, found := s.NewIndex.Files[path]; !found {
+			t.Fatal(path)
+		}
+	}
+}
+
+// TestScanner_Dirs scans a directory with an empty subdirectory, which is
+// indexed with its mode and keeps its ID while it doesn't change
+func TestScanner_Dirs(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Dirs")
+	empty := filepath.Join(unitTestDir, "empty")
+	os.MkdirAll(empty, 0755)
+	os.Chmod(empty, 0700)
+
+	s, err := MakeScanner(unitTestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, found := s.NewIndex.Files["empty"]
+	if !found || !d.IsDir() || d.Perm.Perm() != 0700 || len(s.NewIndex.Files) != 1 {
+		t.FailNow()
+	}
+	os.MkdirAll(filepath.Join(unitTestDir, SummaryDir), 0755)
+	WriteIndex(*s.NewIndex, filepath.Join(unitTestDir, SummaryDir, SummaryFile))
+
+	s, _ = MakeScanner(unitTestDir)
+	if s.NewIndex.Files["empty"].ID != d.ID {
+		t.FailNow()
+	}
+	os.Chmod(empty, 0755)
+	s, _ = MakeScanner(unitTestDir)
+	if s.NewIndex.Files["empty"].ID == d.ID {
+		t.FailNow()
+	}
+}
+
+// TestScanner_Symlinks scans a directory with links to a file, to a
+// directory, to their parent and outside of the directory with each policy
+func TestScanner_Symlinks(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Symlinks")
+	os.MkdirAll(filepath.Join(unitTestDir, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(unitTestDir, "dir", "file"), []byte{1}, 0644)
+	links := map[string]string{
+		"file":     "dir/file",
+		"linkdir":  "dir",
+		"dir/loop": "..",
+		"outside":  "/tmp",
+		"broken":   "missing",
+	}
+	for link, target := range links {
+		os.Symlink(target, filepath.Join(unitTestDir, link))
+	}
+	scan := func(policy string) *Index {
+		s, err := MakeScannerWithConfig(unitTestDir, &Config{Symlinks: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.NewIndex
+	}
+
+	if i := scan(SymlinksIgnore); len(i.Files) != 2 {
+		t.Fatal(i.Files)
+	}
+
+	i := scan(SymlinksFollow)
+	expected := []string{"dir", "dir/file", "file", "linkdir", "linkdir/file"}
+	if len(i.Files) != len(expected) {
+		t.Fatal(i.Files)
+	}
+	for _, path := range expected {
+		if _, found := i.Files[path]; !found {
+			t.Fatal(path)
+		}
+	}
+	if !i.Files["file"].Equals(i.Files["dir/file"]) || !i.Files["linkdir"].IsDir() {
+		t.FailNow()
+	}
+
+	i = scan(SymlinksPreserve)
+	if len(i.Files) != 6 || !i.Files["dir/loop"].IsSymlink() ||
+		i.Files["linkdir"].Target != "dir" || i.Files["outside"] != nil {
+		t.Fatal(i.Files)
+	}
+}
+
+// TestScanner_SymlinkLoop follows two directories that link to each other
+func TestScanner_SymlinkLoop(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "SymlinkLoop")
+	os.MkdirAll(filepath.Join(unitTestDir, "A"), 0755)
+	os.MkdirAll(filepath.Join(unitTestDir, "B"), 0755)
+	os.Symlink("../B", filepath.Join(unitTestDir, "A", "L1"))
+	os.Symlink("../A", filepath.Join(unitTestDir, "B", "L2"))
+	s, err := MakeScannerWithConfig(unitTestDir, &Config{Symlinks: SymlinksFollow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"A/L1", "A/L1/L2", "B/L2", "B/L2/L1"} {
+		if s.NewIndex.Files[path] == nil {
+			t.Fatal(path, s.NewIndex.Files)
+		}
+	}
+	if s.NewIndex.Files["A/L1/L2/L1"] != nil {
+		t.FailNow()
+	}
+}
+
+// TestScanner_Workers scans the same directory with one and several workers,
+// the summaries must be the same and in the same order
+func TestScanner_Workers(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Workers")
+	for i := 0; i < 64; i++ {
+		dir := filepath.Join(unitTestDir, fmt.Sprintf("d%d", i%4))
+		os.MkdirAll(dir, 0755)
+		content := make([]byte, rand.Intn(int(2*MinBlockSize)))
+		rand.Read(content)
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), content, 0644)
+	}
+	scan := func(workers int) []*Summary {
+		s := &Scanner{Config: Config{BlockSize: MinBlockSize}, Workers: workers}
+		if err := s.Scan(unitTestDir); err != nil {
+			t.Fatal(err)
+		}
+		return s.Summaries
+	}
+	sequential := scan(1)
+	parallel := scan(8)
+	if len(sequential) != 68 || len(parallel) != len(sequential) {
+		t.FailNow()
+	}
+	for i, s := range sequential {
+		p := parallel[i]
+		if s.Path != p.Path || s.Digest != p.Digest || !s.Equals(p) {
+			t.Fatal(s.Path, p.Path)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package fs
+
+import "fmt"
+
+// migrations upgrade indices written in older formats, migrations[n]
+// upgrades an Index from schema n to schema n+1
+var migrations = []func(*Index) error{
+	migrateUnversioned,
+}
+
+// migrate upgrades the Index, as it was read, to IndexSchema. Indices
+// written by newer versions can't be read
+func (i *Index) migrate() error {
+	if i.Schema < 0 || i.Schema > IndexSchema {
+		return fmt.Errorf("Unsupported index schema: %d, expected up to %d",
+			i.Schema, IndexSchema)
+	}
+	for ; i.Schema < IndexSchema; i.Schema++ {
+		if err := migrations[i.Schema](i); err != nil {
+			return fmt.Errorf("Migrating index from schema %d: %s", i.Schema, err)
+		}
+	}
+	return nil
+}
+
+// migrateUnversioned upgrades indices written before the schema was
+// recorded, which may lack any of the maps of summaries or store them
+// without their path or ID. Hashes stored as numbers are converted by
+// Summary.UnmarshalJSON and absolute paths by ReadRootIndex
+func migrateUnversioned(i *Index) error {
+	if i.Files == nil {
+		i.Files = make(map[string]*Summary)
+	}
+	if i.Parents == nil {
+		i.Parents = make(map[string]*Summary)
+	}
+	if i.Deletions == nil {
+		i.Deletions = make(map[string]*Summary)
+	}
+	for path, s := range i.Files {
+		if s == nil {
+			delete(i.Files, path)
+		} else if s.Path == "" {
+			s.Path = path
+		}
+	}
+	for _, summaries := range []map[string]*Summary{i.Parents, i.Deletions} {
+		for id, s := range summaries {
+			if s == nil {
+				delete(summaries, id)
+			} else if s.ID == "" {
+				s.ID = id
+			}
+		}
+	}
+	return nil
+}
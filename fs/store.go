@@ -0,0 +1,198 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// storeTmpPrefix starts the names of the temporary files blocks are written
+// to by Store.Put
+const storeTmpPrefix = ".block"
+
+// storeLocks keeps GC from removing blocks that are about to be indexed,
+// see Store.Hold. Stores of the same directory share their lock
+var (
+	storeLocks      = make(map[string]*sync.RWMutex)
+	storeLocksMutex sync.Mutex
+)
+
+// Store keeps the content of blocks in a directory, each block is saved
+// once, in a file named after its hash, no matter how many files contain it.
+// Blocks stay available after the files they were read from change, so
+// any version recorded in an Index can be served
+type Store struct {
+	Dir string
+}
+
+// OpenStore opens (creating it if needed) the Store of the directory root
+func OpenStore(root string) (*Store, error) {
+	dir := filepath.Join(root, SummaryDir, StoreDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// AddFile stores the blocks of the file in path, described by s, an error
+// is returned if the content of the file doesn't match the summary
+func (st *Store) AddFile(path string, s *Summary) error {
+	chunker, err := GetChunker(s.Chunker, s.BlockSize)
+	if err != nil {
+		return err
+	}
+	r, err := OpenBlockReader(path, chunker)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for i := 0; ; i++ {
+		b, err := r.Next()
+		if err == io.EOF {
+			if i != len(s.Blocks) {
+				return fmt.Errorf("'%s' has changed", path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if i >= len(s.Blocks) || b.HashWith(s.algorithm()) != s.Blocks[i] {
+			return fmt.Errorf("'%s' has changed", path)
+		}
+		if st.Has(s.algorithm(), s.Blocks[i]) {
+			continue
+		}
+		if _, err = st.Put(s.algorithm(), b); err != nil {
+			return err
+		}
+	}
+}
+
+// GC removes the blocks not referenced by any summary of the Index returned
+// by index, returns the number of removed blocks. GC waits until no Hold is
+// held and index is called after, so it sees the summaries of the blocks
+// stored while it was held. Blocks being written by Put are kept
+func (st *Store) GC(index func() *Index) (int, error) {
+	l := st.lock()
+	l.Lock()
+	defer l.Unlock()
+	refs := index().References()
+	removed := 0
+	err := filepath.Walk(st.Dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), storeTmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(st.Dir, path)
+		if err != nil {
+			return err
+		}
+		algorithm := filepath.Dir(filepath.Dir(rel))
+		if refs[blockKey(algorithm, f.Name())] > 0 {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// Get reads the block with the given hash, an error is returned if the
+// block is not stored or its content doesn't match the hash
+func (st *Store) Get(algorithm string, hash string) (*Block, error) {
+	content, err := ioutil.ReadFile(st.path(algorithm, hash))
+	if err != nil {
+		return nil, err
+	}
+	b := &Block{Content: content}
+	if b.HashWith(algorithm) != hash {
+		return nil, fmt.Errorf("Stored block %s is corrupted", hash)
+	}
+	return b, nil
+}
+
+// Has checks if the block with the given hash is stored
+func (st *Store) Has(algorithm string, hash string) bool {
+	_, err := os.Stat(st.path(algorithm, hash))
+	return err == nil
+}
+
+// Hold keeps GC from running until release is called. It must be held from
+// the time blocks are stored until the summaries that use them are in the
+// Index given to GC, and must not be held by the caller of GC
+func (st *Store) Hold() (release func()) {
+	l := st.lock()
+	l.RLock()
+	return l.RUnlock
+}
+
+// HasFile checks if every block of the file described by s is stored
+func (st *Store) HasFile(s *Summary) bool {
+	for _, h := range s.Blocks {
+		if !st.Has(s.algorithm(), h) {
+			return false
+		}
+	}
+	return true
+}
+
+// Put stores a block and returns its hash, the block is written to a
+// temporary file first so a partially written block is never found
+func (st *Store) Put(algorithm string, b *Block) (string, error) {
+	if err := ValidHash(algorithm); err != nil {
+		return "", err
+	}
+	hash := b.HashWith(algorithm)
+	path := st.path(algorithm, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), storeTmpPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b.Content); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
+
+// lock returns the lock shared by the Stores of st.Dir
+func (st *Store) lock() *sync.RWMutex {
+	dir, err := filepath.Abs(st.Dir)
+	if err != nil {
+		dir = st.Dir
+	}
+	storeLocksMutex.Lock()
+	defer storeLocksMutex.Unlock()
+	l, found := storeLocks[dir]
+	if !found {
+		l = new(sync.RWMutex)
+		storeLocks[dir] = l
+	}
+	return l
+}
+
+// path returns the path of a block, blocks are grouped in directories by
+// the first two characters of their hash
+func (st *Store) path(algorithm string, hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(st.Dir, algorithm, hash)
+	}
+	return filepath.Join(st.Dir, algorithm, hash[:2], hash)
+}
@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStore puts and gets blocks from a Store
+func TestStore(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Store")
+	st, err := OpenStore(unitTestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Block{Content: []byte("stored block")}
+	hash, err := st.Put(HashSHA256, b)
+	if err != nil || hash != b.HashWith(HashSHA256) {
+		t.FailNow()
+	}
+	if !st.Has(HashSHA256, hash) || st.Has(HashBLAKE2b, hash) {
+		t.FailNow()
+	}
+	stored, err := st.Get(HashSHA256, hash)
+	if err != nil || !stored.DeepEquals(b) {
+		t.FailNow()
+	}
+
+	// missing and corrupted blocks
+	if _, err = st.Get(HashBLAKE2b, hash); err == nil {
+		t.FailNow()
+	}
+	ioutil.WriteFile(st.path(HashSHA256, hash), []byte("corrupted"), 0644)
+	if _, err = st.Get(HashSHA256, hash); err == nil {
+		t.FailNow()
+	}
+
+	// unknown algorithm
+	if _, err = st.Put("md4", b); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestStore_AddFile stores the blocks of a file and an identical copy once
+func TestStore_AddFile(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "StoreAddFile")
+	st, _ := OpenStore(unitTestDir)
+	c := Config{BlockSize: 64 * 1024, Hash: HashSHA256}
+	s, _ := MakeSummaryFromPath(muffinPath, c)
+	if err := st.AddFile(muffinPath, s); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(muffinPath)
+	for i, hash := range s.Blocks {
+		b, err := st.Get(s.Hash, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, size, _ := s.Offset(i)
+		if !bytes.Equal(b.Content, content[offset:offset+size]) {
+			t.FailNow()
+		}
+	}
+
+	// file changed since it was summarized
+	changed := *s
+	changed.Blocks = append([]string{"0"}, s.Blocks[1:]...)
+	if err := st.AddFile(muffinPath, &changed); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestStore_GC removes the blocks no longer referenced by an index
+func TestStore_GC(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "StoreGC")
+	st, _ := OpenStore(unitTestDir)
+	kept := &Block{Content: []byte("kept")}
+	parent := &Block{Content: []byte("parent")}
+	removed := &Block{Content: []byte("removed")}
+	for _, b := range []*Block{kept, parent, removed} {
+		st.Put(HashSHA256, b)
+	}
+	i, _ := MakeIndex(&Summary{ID: "f1.1", Path: "/f1", Hash: HashSHA256,
+		Blocks: []string{kept.HashWith(HashSHA256)}})
+	i.AddParent(&Summary{ID: "f1.0", Path: "/f1", Hash: HashSHA256,
+		Blocks: []string{parent.HashWith(HashSHA256)}})
+
+	// blocks being written are kept
+	tmp, _ := ioutil.TempFile(filepath.Dir(st.path(HashSHA256, kept.HashWith(HashSHA256))), storeTmpPrefix)
+	tmp.Close()
+	index := func() *Index { return i }
+	n, err := st.GC(index)
+	if err != nil || n != 1 {
+		t.FailNow()
+	}
+	if !st.Has(HashSHA256, kept.HashWith(HashSHA256)) ||
+		!st.Has(HashSHA256, parent.HashWith(HashSHA256)) ||
+		st.Has(HashSHA256, removed.HashWith(HashSHA256)) {
+		t.FailNow()
+	}
+	if _, err = os.Stat(tmp.Name()); err != nil {
+		t.FailNow()
+	}
+
+	// blocks stored while the store is held are kept if they are indexed
+	// once it is released
+	release := st.Hold()
+	done := make(chan bool)
+	go func() {
+		st.GC(index)
+		close(done)
+	}()
+	st.Put(HashSHA256, removed)
+	select {
+	case <-done:
+		t.Fatal("GC ran while the store was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	i.Files["/f2"] = &Summary{ID: "f2.0", Path: "/f2", Hash: HashSHA256,
+		Blocks: []string{removed.HashWith(HashSHA256)}}
+	release()
+	<-done
+	if !st.Has(HashSHA256, removed.HashWith(HashSHA256)) {
+		t.FailNow()
+	}
+}
@@ -1,18 +1,83 @@
 package fs
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 
 	"github.com/satori/go.uuid"
 )
 
 // Summary is used to marshal/unmarshal Files to/from JSON files
 type Summary struct {
-	Blocks []uint64    `json:"blocks"`
-	ID     string      `json:"id"`
-	Parent string      `json:"parent"`
-	Path   string      `json:"path"`
-	Perm   os.FileMode `json:"permission"`
+	Blocks    []string    `json:"blocks"`               // hex encoded hashes
+	BlockSize int64       `json:"block_size,omitempty"` // given to the chunker
+	Chunker   string      `json:"chunker,omitempty"`
+	Digest    string      `json:"digest,omitempty"` // hash of the whole file
+	Hash      string      `json:"hash"`             // algorithm used to hash the blocks
+	ID        string      `json:"id"`
+	Inode     uint64      `json:"inode,omitempty"` // inode of the scanned file
+	ModTime   int64       `json:"mtime,omitempty"` // modification time in Unix nanoseconds
+	Parent    string      `json:"parent"`
+	Path      string      `json:"path"`
+	Perm      os.FileMode `json:"permission"`
+	Retired   int64       `json:"retired,omitempty"` // when it was replaced or deleted, in Unix nanoseconds
+	Size      int64       `json:"size,omitempty"`    // size of the file in Bytes
+	Sizes     []int64     `json:"sizes,omitempty"`   // length of each block
+	Target    string      `json:"target,omitempty"`  // slash separated target of a symbolic link
+	Version   Version     `json:"version,omitempty"` // changes made to the file by each device
+	Zeros     []uint64    `json:"zeros,omitempty"`   // sorted numbers of all-zero blocks
+
+	offsets []int64 // offset of each block, computed from Sizes, see Offset
+}
+
+// MakeDirSummary creates the Summary of the directory in path, directories
+// have no blocks and their mode has os.ModeDir set
+func MakeDirSummary(path string, c Config) (*Summary, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Not a valid path to a directory: '%s'", path)
+	}
+	id, _ := uuid.NewV4()
+	return &Summary{
+		Blocks: make([]string, 0),
+		Hash:   c.hash(),
+		ID:     id.String(),
+		Path:   path,
+		Perm:   info.Mode(),
+	}, nil
+}
+
+// MakeLinkSummary creates the Summary of the symbolic link in path, links
+// have no blocks and their target is stored as it is
+func MakeLinkSummary(path string, c Config) (*Summary, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil, fmt.Errorf("Not a valid path to a symbolic link: '%s'", path)
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := uuid.NewV4()
+	return &Summary{
+		Blocks: make([]string, 0),
+		Hash:   c.hash(),
+		ID:     id.String(),
+		Path:   path,
+		Perm:   info.Mode(),
+		Target: filepath.ToSlash(target),
+	}, nil
 }
 
 // MakeSummary creates a marshable Summary from a File
@@ -23,21 +88,44 @@ func MakeSummary(f *File) *Summary {
 	} else {
 		parent = f.Parent.String()
 	}
-	s := Summary{ID: f.ID.String(), Parent: parent, Path: f.Path}
-	s.Blocks = make([]uint64, len(f.Blocks))
+	s := Summary{ID: f.ID.String(), Parent: parent, Path: f.Path, Chunker: f.Chunker}
+	s.BlockSize = f.BlockSize
+	s.Hash = f.Hash
+	if s.Hash == "" {
+		s.Hash = HashFNV64a
+	}
+	s.Blocks = make([]string, len(f.Blocks))
+	s.Sizes = make([]int64, len(f.Blocks))
 	for i, b := range f.Blocks {
-		s.Blocks[i] = b.Hash()
+		s.Blocks[i] = b.HashWith(s.Hash)
+		s.Sizes[i] = int64(b.Size())
+		s.offsets = append(s.offsets, s.Size)
+		s.Size += s.Sizes[i]
+		if b.IsZero() {
+			s.Zeros = append(s.Zeros, uint64(i))
+		}
 	}
+	s.Digest, s.Size = digestBlocks(s.Hash, f.Blocks)
 	s.Perm = f.Perm
 	return &s
 }
 
 // Diff compares the blocks of two summaries
-// if the block is up to date, the value is 0
+// if the block is up to date, the value is an empty string
 // otherwise it's the value of the block in s2
-func (s *Summary) Diff(s2 *Summary) ([]uint64, bool) {
-	change := false
-	blocks := make([]uint64, len(s2.Blocks))
+// Blocks of fixed size are compared by position, if any of the summaries
+// was chunked by content a block is up to date if s contains it anywhere.
+// Directories and links only change if their mode or target do
+func (s *Summary) Diff(s2 *Summary) ([]string, bool) {
+	if s.special() || s2.special() {
+		return append(make([]string, 0), s2.Blocks...), !s.Equals(s2)
+	}
+	if !s.FixedSize() || !s2.FixedSize() {
+		return s.diffContent(s2)
+	}
+	// blocks removed from the end are changes too
+	change := len(s.Blocks) != len(s2.Blocks) || s.digestDiffers(s2)
+	blocks := make([]string, len(s2.Blocks))
 	for i, block := range s2.Blocks {
 		if i >= len(s.Blocks) {
 			change = true
@@ -52,11 +140,44 @@ func (s *Summary) Diff(s2 *Summary) ([]uint64, bool) {
 	return blocks, change
 }
 
-// Equals is used to compare both the CONTENT of a Summary
+// diffContent compares the blocks of two summaries regardless of their position
+func (s *Summary) diffContent(s2 *Summary) ([]string, bool) {
+	found := make(map[string]bool)
+	for _, block := range s.Blocks {
+		found[block] = true
+	}
+	change := len(s.Blocks) != len(s2.Blocks) || s.digestDiffers(s2)
+	blocks := make([]string, len(s2.Blocks))
+	for i, block := range s2.Blocks {
+		if !found[block] {
+			change = true
+			blocks[i] = block
+		}
+	}
+	return blocks, change
+}
+
+// digestDiffers checks if both summaries have a digest and they differ
+func (s *Summary) digestDiffers(s2 *Summary) bool {
+	if s.Digest == "" || s2.Digest == "" || s.algorithm() != s2.algorithm() {
+		return false
+	}
+	return s.Digest != s2.Digest || s.Size != s2.Size
+}
+
+// Equals is used to compare both the CONTENT of a Summary, using the
+// digest of the whole file if both summaries have one. Directories and
+// links are equal if their modes and targets are
 func (s *Summary) Equals(s2 *Summary) bool {
-	if len(s.Blocks) != len(s2.Blocks) {
+	if s.special() || s2.special() {
+		return s.Perm == s2.Perm && s.Target == s2.Target
+	}
+	if s.algorithm() != s2.algorithm() || len(s.Blocks) != len(s2.Blocks) {
 		return false
 	}
+	if s.Digest != "" && s2.Digest != "" {
+		return s.Digest == s2.Digest && s.Size == s2.Size
+	}
 	for i, b := range s.Blocks {
 		if b != s2.Blocks[i] {
 			return false
@@ -64,3 +185,134 @@ func (s *Summary) Equals(s2 *Summary) bool {
 	}
 	return true
 }
+
+// IsDir checks if the summary describes a directory
+func (s *Summary) IsDir() bool {
+	return s.Perm.IsDir()
+}
+
+// IsSymlink checks if the summary describes a symbolic link
+func (s *Summary) IsSymlink() bool {
+	return s.Perm&os.ModeSymlink != 0
+}
+
+// IsZero checks if block n of the file only has zeros
+func (s *Summary) IsZero(n int) bool {
+	i := sort.Search(len(s.Zeros), func(i int) bool { return s.Zeros[i] >= uint64(n) })
+	return i < len(s.Zeros) && s.Zeros[i] == uint64(n)
+}
+
+// Offset returns the offset and the size of block n in the file, summaries
+// without sizes were cut in blocks of the same size. The offsets of the
+// summaries made or read by this package are computed once, so reading
+// every block of a file doesn't add up its sizes each time
+func (s *Summary) Offset(n int) (int64, int64, error) {
+	if n < 0 || n >= len(s.Blocks) {
+		return 0, 0, fmt.Errorf("Block index out of range: max is %d got %d",
+			len(s.Blocks)-1, n)
+	}
+	if len(s.Sizes) != len(s.Blocks) {
+		if !s.FixedSize() {
+			return 0, 0, errors.New("Missing block sizes")
+		}
+		blockSize := s.config().blockSize()
+		return int64(n) * blockSize, blockSize, nil
+	}
+	if len(s.offsets) == len(s.Sizes) {
+		return s.offsets[n], s.Sizes[n], nil
+	}
+	var offset int64
+	for _, size := range s.Sizes[:n] {
+		offset += size
+	}
+	return offset, s.Sizes[n], nil
+}
+
+// FixedSize checks if the blocks of the summary were cut at fixed
+// offsets, summaries without a chunker precede content-defined chunking
+func (s *Summary) FixedSize() bool {
+	return s.Chunker == "" || s.Chunker == ChunkerFixed
+}
+
+// UnmarshalJSON reads a Summary, hashes stored as numbers by older indices
+// are converted to hex encoded FNV-1a hashes
+func (s *Summary) UnmarshalJSON(b []byte) error {
+	type summary Summary
+	aux := struct {
+		Blocks []json.RawMessage `json:"blocks"`
+		*summary
+	}{summary: (*summary)(s)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	s.cacheOffsets()
+	if aux.Blocks == nil {
+		s.Blocks = nil
+		return nil
+	}
+	s.Blocks = make([]string, len(aux.Blocks))
+	for i, raw := range aux.Blocks {
+		if err := json.Unmarshal(raw, &s.Blocks[i]); err == nil {
+			continue
+		}
+		n, err := strconv.ParseUint(string(raw), 10, 64)
+		if err != nil {
+			return err
+		}
+		s.Blocks[i] = legacyHash(n)
+		s.Hash = HashFNV64a
+	}
+	return nil
+}
+
+// Verify checks that the file in path has the content described by the
+// summary, empty hashes are blocks left unchanged by Diff and not checked
+func (s *Summary) Verify(path string) error {
+	s2, err := MakeSummaryFromPath(path, s.config())
+	if err != nil {
+		return err
+	}
+	if s.digestDiffers(s2) {
+		return fmt.Errorf("Digest of '%s' doesn't match", path)
+	}
+	if len(s2.Blocks) != len(s.Blocks) {
+		return fmt.Errorf("Expected %d blocks in '%s', found %d",
+			len(s.Blocks), path, len(s2.Blocks))
+	}
+	for i, b := range s.Blocks {
+		if b != "" && b != s2.Blocks[i] {
+			return fmt.Errorf("Block %d of '%s' doesn't match its hash", i, path)
+		}
+	}
+	return nil
+}
+
+// cacheOffsets computes the offset of each block from Sizes
+func (s *Summary) cacheOffsets() {
+	s.offsets = make([]int64, len(s.Sizes))
+	var offset int64
+	for i, size := range s.Sizes {
+		s.offsets[i] = offset
+		offset += size
+	}
+}
+
+// config returns the settings used to create the summary
+func (s *Summary) config() Config {
+	return Config{BlockSize: s.BlockSize, Chunker: s.Chunker, Hash: s.algorithm()}
+}
+
+// algorithm returns the algorithm used to hash the blocks, summaries
+// without one were hashed with FNV-1a
+func (s *Summary) algorithm() string {
+	if s.Hash == "" {
+		return HashFNV64a
+	}
+	return s.Hash
+}
+
+// special checks if the summary describes a directory or a link, which
+// have no content
+func (s *Summary) special() bool {
+	return s.IsDir() || s.IsSymlink()
+}
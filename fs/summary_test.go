@@ -1,11 +1,55 @@
 package fs
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/satori/go.uuid"
 )
 
+// TestMakeDirSummary summarizes a directory and compares it with other
+// directories and files
+func TestMakeDirSummary(t *testing.T) {
+	dir := filepath.Join(testDir, "MakeDirSummary")
+	os.MkdirAll(dir, 0750)
+	os.Chmod(dir, 0750)
+	s, err := MakeDirSummary(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsDir() || s.Perm.Perm() != 0750 || len(s.Blocks) != 0 {
+		t.FailNow()
+	}
+	if _, err = MakeDirSummary(muffinPath, Config{}); err == nil {
+		t.FailNow()
+	}
+
+	same := *s
+	if !s.Equals(&same) {
+		t.FailNow()
+	}
+	if _, change := s.Diff(&same); change {
+		t.FailNow()
+	}
+	chmod := *s
+	chmod.Perm = os.ModeDir | 0755
+	if s.Equals(&chmod) {
+		t.FailNow()
+	}
+	if _, change := s.Diff(&chmod); !change {
+		t.FailNow()
+	}
+	file := &Summary{Hash: s.Hash, Blocks: []string{}, Perm: 0750}
+	if s.Equals(file) || file.Equals(s) {
+		t.FailNow()
+	}
+	if _, change := file.Diff(s); !change {
+		t.FailNow()
+	}
+}
+
 // TestMakeSummary checks that a Summary is built properly from a File
 func TestMakeSummary(t *testing.T) {
 	f, _ := MakeFile(muffinPath)
@@ -23,9 +67,9 @@ func TestMakeSummary(t *testing.T) {
 }
 
 func TestSummary_Diff(t *testing.T) {
-	s1 := Summary{Blocks: []uint64{1, 3, 2}}
-	s2 := Summary{Blocks: []uint64{1, 2, 3, 4}}
-	expectedDiff := []uint64{0, 2, 3, 4}
+	s1 := Summary{Blocks: []string{"1", "3", "2"}}
+	s2 := Summary{Blocks: []string{"1", "2", "3", "4"}}
+	expectedDiff := []string{"", "2", "3", "4"}
 	diff, change := s1.Diff(&s2)
 	if !change {
 		t.FailNow()
@@ -56,4 +100,126 @@ func TestSummary_Equals(t *testing.T) {
 	if !s1.Equals(s2) || s1.Equals(s3) {
 		t.FailNow()
 	}
+
+	// same blocks, different digest or size
+	s2.Digest = s3.Digest
+	if s1.Equals(s2) {
+		t.FailNow()
+	}
+	s2.Digest = s1.Digest
+	s2.Size++
+	if s1.Equals(s2) {
+		t.FailNow()
+	}
+
+	// summaries without digest are compared block by block
+	s2.Digest = ""
+	if !s1.Equals(s2) {
+		t.FailNow()
+	}
+}
+
+// TestSummary_DiffTail compares a file with a copy that lost its tail
+func TestSummary_DiffTail(t *testing.T) {
+	b := &Block{Content: []byte{1, 2, 3}}
+	short := &Block{Content: []byte{1, 2}}
+	s1 := MakeSummary(&File{Blocks: []*Block{b, b}})
+	s2 := MakeSummary(&File{Blocks: []*Block{b}})
+	if _, change := s1.Diff(s2); !change {
+		t.FailNow()
+	}
+	// empty file
+	s2 = MakeSummary(&File{})
+	if _, change := s1.Diff(s2); !change || s1.Equals(s2) {
+		t.FailNow()
+	}
+	// same blocks, different digest
+	s2 = MakeSummary(&File{Blocks: []*Block{b, short}})
+	s2.Blocks = s1.Blocks
+	if _, change := s1.Diff(s2); !change {
+		t.FailNow()
+	}
+}
+
+// TestSummary_DiffContent compares summaries chunked by content, where
+// blocks are matched regardless of their position
+func TestSummary_DiffContent(t *testing.T) {
+	s1 := Summary{Chunker: ChunkerCDC, Blocks: []string{"1", "3", "2"}}
+	s2 := Summary{Chunker: ChunkerCDC, Blocks: []string{"1", "2", "3", "4"}}
+	expectedDiff := []string{"", "", "", "4"}
+	diff, change := s1.Diff(&s2)
+	if !change {
+		t.FailNow()
+	}
+	for i, block := range diff {
+		if block != expectedDiff[i] {
+			t.FailNow()
+		}
+	}
+
+	// same blocks, one of them removed
+	s2.Blocks = []string{"3", "1"}
+	if _, change = s1.Diff(&s2); !change {
+		t.FailNow()
+	}
+}
+
+// TestSummary_UnmarshalJSON reads a summary written before hashes were
+// configurable and one with hex encoded hashes
+func TestSummary_UnmarshalJSON(t *testing.T) {
+	var s Summary
+	legacy := []byte(`{"blocks":[15655658624539369542],"id":"id","path":"/1"}`)
+	if err := json.Unmarshal(legacy, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.algorithm() != HashFNV64a || s.Blocks[0] != legacyHash(15655658624539369542) {
+		t.FailNow()
+	}
+
+	b := Block{Content: []byte{1}}
+	s2 := Summary{Blocks: []string{b.Hash()}, Hash: DefaultHash, ID: "id"}
+	marshalled, _ := json.Marshal(s2)
+	var s3 Summary
+	if err := json.Unmarshal(marshalled, &s3); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.Equals(&s3) || s.Equals(&s3) {
+		t.FailNow()
+	}
+
+	if err := json.Unmarshal([]byte(`{"blocks":[-1]}`), &s3); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestSummary_Offset checks that the offsets computed when a Summary is made
+// or read match those added up from its sizes
+func TestSummary_Offset(t *testing.T) {
+	s, err := MakeSummaryFromPath(muffinPath, Config{Chunker: ChunkerCDC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a summary without computed offsets adds up its sizes
+	literal := Summary{Blocks: s.Blocks, Chunker: s.Chunker, Sizes: s.Sizes}
+	marshalled, _ := json.Marshal(s)
+	var unmarshalled Summary
+	if err = json.Unmarshal(marshalled, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	var expected int64
+	for i, size := range s.Sizes {
+		for _, summary := range []*Summary{s, &literal, &unmarshalled} {
+			offset, n, err := summary.Offset(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != expected || n != size {
+				t.FailNow()
+			}
+		}
+		expected += size
+	}
+	if expected != s.Size || len(s.offsets) != len(s.Sizes) || len(unmarshalled.offsets) != len(s.Sizes) {
+		t.FailNow()
+	}
 }
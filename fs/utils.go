@@ -1,23 +1,102 @@
 package fs
 
 import (
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-// CalcBlockN calculates the number of blocks to
-// be extracted from a file
-func CalcBlockN(f os.FileInfo) int {
-	n := f.Size() / BlockSize
-	if f.Size()-BlockSize*n == 0 {
+// AbsPath returns the local path of a path of an Index, which is relative
+// to root and separated by slashes. Paths sent by other peers can't be
+// trusted, so absolute paths and paths outside of root are rejected
+func AbsPath(root string, path string) (string, error) {
+	local := filepath.FromSlash(path)
+	if path == "" || strings.HasPrefix(path, "/") || filepath.IsAbs(local) {
+		return "", fmt.Errorf("Not a relative path: '%s'", path)
+	}
+	local = filepath.Clean(local)
+	if local == ".." || strings.HasPrefix(local, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path is outside of the directory: '%s'", path)
+	}
+	return filepath.Join(root, local), nil
+}
+
+// blockKey identifies a block in Index.References
+func blockKey(algorithm string, hash string) string {
+	return algorithm + "/" + hash
+}
+
+// CalcBlockN calculates the number of blocks of
+// blockSize to be extracted from a file
+func CalcBlockN(f os.FileInfo, blockSize int64) int {
+	n := f.Size() / blockSize
+	if f.Size()-blockSize*n == 0 {
 		return int(n)
 	}
 	return int(n + 1)
 }
 
+// CheckLink checks that a symbolic link of an Index, in path relative to
+// root and separated by slashes, to target can be created: it must be a
+// SafeLink, it can't be in a linked directory and its target can't go
+// through other links, checked against the files in root
+func CheckLink(root string, path string, target string) error {
+	if !SafeLink(path, target) {
+		return fmt.Errorf("Link points outside of the directory: '%s'", path)
+	}
+	if _, err := SafePath(root, path); err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	// the directory of the link has no links, so it is its real path
+	dir := filepath.Join(realRoot, filepath.Dir(filepath.FromSlash(path)))
+	for _, name := range strings.Split(target, "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			dir = filepath.Dir(dir)
+			continue
+		}
+		dir = filepath.Join(dir, name)
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Link points through another link: '%s'", path)
+		}
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	if _, err := RelPath(realRoot, dir); err != nil && dir != realRoot {
+		return fmt.Errorf("Link points outside of the directory: '%s'", path)
+	}
+	return nil
+}
+
+// commonAncestor returns the closest ancestor of s2 that is an ancestor
+// of s1 too, nil if there is none in parents
+func commonAncestor(s1 *Summary, s2 *Summary, parents map[string]*Summary) *Summary {
+	line := make(map[string]bool)
+	for p, found := parents[s1.Parent]; found && !line[p.ID]; p, found = parents[p.Parent] {
+		line[p.ID] = true
+	}
+	visited := make(map[string]bool)
+	for p, found := parents[s2.Parent]; found && !visited[p.ID]; p, found = parents[p.Parent] {
+		if line[p.ID] {
+			return p
+		}
+		visited[p.ID] = true
+	}
+	return nil
+}
+
 // commonRoot iteratively checks if the files have a common ancestor
 // Time complexity (quick case aside): best -> O(n), worst -> O(n+m)
 // Space complexity: best == worst -> O(n)
@@ -91,6 +170,33 @@ func isDescendant(descendant *Summary, ancestor *Summary, line map[string]*Summa
 	return false
 }
 
+// MakeDir creates the directory in path, and any missing parent, and sets
+// its permissions to perm
+func MakeDir(path string, perm os.FileMode) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm.Perm())
+}
+
+// MakeLink creates a symbolic link to target in path, replacing any file
+// or link already in path
+func MakeLink(path string, target string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".link")
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.FromSlash(target), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 // mergeSummaryMap creates a map with keys/values from all the maps
 // if ignoreCollisions is set to false, an error will be returned when an
 // existing key is added to the map
@@ -106,7 +212,12 @@ func mergeSummaryMap(ignoreCollisions bool, maps ...map[string]*Summary) (map[st
 	}
 	for i := 1; i < len(maps); i++ {
 		for k, v := range maps[i] {
-			if s, conflict := m[k]; !ignoreCollisions && conflict && !v.Equals(s) {
+			if s, conflict := m[k]; conflict && v.algorithm() != s.algorithm() {
+				// one of the peers has rehashed the summary, keep it
+				if StrongHash(s.algorithm()) {
+					continue
+				}
+			} else if !ignoreCollisions && conflict && !v.Equals(s) {
 				return nil, fmt.Errorf("Error merging key: %s", k)
 			}
 			m[k] = v
@@ -122,18 +233,132 @@ func ProjectPath() string {
 }
 
 // ReadIndex creates an Index given a path
-// to a file containing a valid json
+// to a file containing a valid index in any encoding. Indices written in older formats are
+// migrated. If the file can't be read the previous generation, kept by
+// WriteIndex, is read instead
 func ReadIndex(filename string) (*Index, error) {
-	file, err := ioutil.ReadFile(filename)
+	i, err := readIndexFile(filename)
+	if err == nil {
+		return i, nil
+	}
+	if backup, backupErr := readIndexFile(filename + SummaryBackupExt); backupErr == nil {
+		return backup, nil
+	}
+	return nil, err
+}
+
+// readIndexFile reads the Index in filename, in any encoding, and migrates
+// it to IndexSchema
+func readIndexFile(filename string) (*Index, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	i, _, err := DecodeIndex(file)
 	if err != nil {
 		return nil, err
 	}
-	var is Index
-	err = json.Unmarshal(file, &is)
+	if err = i.migrate(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// ReadRootIndex reads the Index of the directory root, absolute paths
+// written by older versions are made relative to root
+func ReadRootIndex(root string) (*Index, error) {
+	i, err := ReadIndex(filepath.Join(root, SummaryDir, SummaryFile))
 	if err != nil {
 		return nil, err
 	}
-	return &is, nil
+	i.relativize(root)
+	return i, nil
+}
+
+// relativizeMap returns a copy of summaries whose absolute paths are
+// relative to root, or empty if they are outside of it
+func relativizeMap(root string, summaries map[string]*Summary) map[string]*Summary {
+	m := make(map[string]*Summary, len(summaries))
+	for k, s := range summaries {
+		if filepath.IsAbs(s.Path) {
+			moved := *s
+			moved.Path, _ = RelPath(root, s.Path)
+			s = &moved
+		}
+		m[k] = s
+	}
+	return m
+}
+
+// RelPath returns the path of a file of the directory root as stored in an
+// Index: relative to root and separated by slashes
+func RelPath(root string, path string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is not inside '%s'", path, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// SafeLink checks if a symbolic link in path, relative to the root of a
+// directory and separated by slashes, points inside of the directory.
+// Absolute targets are never safe, as they differ between peers, and
+// neither are targets with '..' after a name, as 'a/..' leaves the
+// directory if 'a' is, or later becomes, a link
+func SafeLink(path string, target string) bool {
+	if target == "" || strings.HasPrefix(target, "/") || filepath.IsAbs(filepath.FromSlash(target)) {
+		return false
+	}
+	named := false
+	for _, name := range strings.Split(target, "/") {
+		if name == ".." && named {
+			return false
+		}
+		named = named || (name != "" && name != "." && name != "..")
+	}
+	resolved := filepath.ToSlash(filepath.Clean(filepath.Join(filepath.Dir(filepath.FromSlash(path)),
+		filepath.FromSlash(target))))
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// SafePath returns the local path of a path of an Index, as AbsPath does,
+// checking that none of the directories it is in, inside root, is a
+// symbolic link, so files written to it can't end up outside of root
+func SafePath(root string, path string) (string, error) {
+	absPath, err := AbsPath(root, path)
+	if err != nil {
+		return "", err
+	}
+	dir := root
+	for _, name := range strings.Split(filepath.Dir(filepath.Clean(filepath.FromSlash(path))), string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Path goes through a link: '%s'", path)
+		}
+	}
+	return absPath, nil
 }
 
 // SummaryExists checks wheter the summary file exists
@@ -145,13 +370,105 @@ func SummaryExists(root string) bool {
 	return !f.Mode().IsDir()
 }
 
-// WriteIndex writes an Index as a JSON in
-// the file specified by the path
-func WriteIndex(index Index, filename string) error {
-	content, _ := json.Marshal(index)
-	err := ioutil.WriteFile(filename, content, 0755)
+// syncDir flushes the entries of a directory to disk, so renamed files
+// are not lost in a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// tmpDir returns the directory where files are written before replacing
+// the file in path: TmpDir in the SummaryDir of the synchronized directory
+// containing path, or the directory of path if it isn't synchronized
+func tmpDir(path string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if info, err := os.Stat(filepath.Join(d, SummaryDir)); err == nil && info.IsDir() {
+			tmp := filepath.Join(d, SummaryDir, TmpDir)
+			return tmp, os.MkdirAll(tmp, 0755)
+		}
+		if filepath.Dir(d) == d {
+			return dir, nil
+		}
+	}
+}
+
+// verifyDigest checks that the content of the file in path has the given
+// hex encoded digest
+func verifyDigest(path string, algorithm string, digest string) error {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+	if _, err = io.Copy(h, file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != digest {
+		return fmt.Errorf("Digest of '%s' doesn't match", path)
+	}
 	return nil
 }
+
+// WriteIndex writes an Index in the file specified by the path, encoded
+// as set in its Config. The Index is written to a temporary file
+// that replaces the file once it is synced, so a crash never leaves a
+// partially written Index. The replaced generation is kept as a backup
+func WriteIndex(index Index, filename string) error {
+	index.Schema = IndexSchema
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	// does nothing once the file is renamed
+	defer os.Remove(tmp.Name())
+	if err = EncodeIndex(tmp, &index, index.Config.Encoding); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	// the current generation is linked, not moved, so there is always an
+	// Index in filename
+	if _, err = os.Lstat(filename); err == nil {
+		backup := filename + SummaryBackupExt
+		os.Remove(backup)
+		if err = os.Link(filename, backup); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// WriteRootIndex writes the Index of the directory root, absolute paths
+// inside root are made relative to it. SummaryDir is created if needed
+func WriteRootIndex(index Index, root string) error {
+	index.relativize(root)
+	if err := os.MkdirAll(filepath.Join(root, SummaryDir), 0755); err != nil {
+		return err
+	}
+	return WriteIndex(index, filepath.Join(root, SummaryDir, SummaryFile))
+}
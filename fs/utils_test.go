@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -9,6 +10,27 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+// TestAbsPath resolves paths of an Index, paths outside of the root
+// must be rejected
+func TestAbsPath(t *testing.T) {
+	valid := map[string]string{
+		"a":         "/root/a",
+		"a/b/c":     "/root/a/b/c",
+		"a/../b":    "/root/b",
+		"./a//b/./": "/root/a/b",
+	}
+	for rel, abs := range valid {
+		if path, err := AbsPath("/root", rel); err != nil || path != abs {
+			t.Fatal(rel, path, err)
+		}
+	}
+	for _, rel := range []string{"", "/a", "..", "../a", "a/../../b"} {
+		if _, err := AbsPath("/root", rel); err == nil {
+			t.Fatal(rel)
+		}
+	}
+}
+
 // TestCommonRoot creates a tree of file changes and verifies that the common
 // ancestor is correctly identified
 func TestCommonRoot(t *testing.T) {
@@ -167,6 +189,177 @@ func TestReadIndex(t *testing.T) {
 	}
 }
 
+// TestReadIndex_Backup reads the previous generation of an Index when the
+// current one is corrupted
+func TestReadIndex_Backup(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "ReadIndexBackup")
+	os.MkdirAll(unitTestDir, 0755)
+	filename := filepath.Join(unitTestDir, SummaryFile)
+	i1, _ := MakeIndex(&Summary{ID: "1", Path: "a"})
+	i2, _ := MakeIndex(&Summary{ID: "2", Path: "b"})
+	if err := WriteIndex(*i1, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(*i2, filename); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0644 {
+		t.FailNow()
+	}
+	// only the index and its backup are left
+	if entries, _ := ioutil.ReadDir(unitTestDir); len(entries) != 2 {
+		t.Fatal(entries)
+	}
+	if i, err := ReadIndex(filename); err != nil || i.Files["b"] == nil {
+		t.FailNow()
+	}
+
+	ioutil.WriteFile(filename, []byte("{"), 0644)
+	i, err := ReadIndex(filename)
+	if err != nil || i.Files["a"] == nil || i.Schema != IndexSchema {
+		t.FailNow()
+	}
+	os.Remove(filename + SummaryBackupExt)
+	if _, err = ReadIndex(filename); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestReadIndex_Migrate reads indices written before the schema was
+// recorded and by newer versions
+func TestReadIndex_Migrate(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "ReadIndexMigrate")
+	os.MkdirAll(unitTestDir, 0755)
+	filename := filepath.Join(unitTestDir, SummaryFile)
+	ioutil.WriteFile(filename, []byte(`{"files":{"a":{"id":"1","blocks":[1]}},"parents":null}`), 0644)
+	i, err := ReadIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Schema != IndexSchema || i.Parents == nil || i.Deletions == nil ||
+		i.Files["a"].Path != "a" || i.Files["a"].Blocks[0] != legacyHash(1) {
+		t.FailNow()
+	}
+
+	ioutil.WriteFile(filename, []byte(fmt.Sprintf(`{"schema":%d}`, IndexSchema+1)), 0644)
+	if _, err = ReadIndex(filename); err == nil {
+		t.FailNow()
+	}
+}
+
+// TestReadRootIndex writes an Index with absolute paths, as older versions
+// did, and reads it with paths relative to the root
+func TestReadRootIndex(t *testing.T) {
+	root := filepath.Join(testDir, "ReadRootIndex")
+	os.MkdirAll(filepath.Join(root, SummaryDir), 0755)
+	i, _ := MakeIndex(
+		&Summary{ID: "1", Path: filepath.Join(root, "a", "b")},
+		&Summary{ID: "2", Path: "/elsewhere/c"},
+		&Summary{ID: "3", Path: "d"},
+	)
+	i.AddParent(&Summary{ID: "0", Path: filepath.Join(root, "a", "b")})
+	WriteIndex(*i, filepath.Join(root, SummaryDir, SummaryFile))
+
+	ri, err := ReadRootIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ri.Files) != 2 || ri.Files["a/b"].ID != "1" || ri.Files["d"].ID != "3" ||
+		ri.Parents["0"].Path != "a/b" {
+		t.FailNow()
+	}
+
+	// the written Index is not modified
+	if err = WriteRootIndex(*i, root); err != nil {
+		t.Fatal(err)
+	}
+	if i.Files[filepath.Join(root, "a", "b")].Path != filepath.Join(root, "a", "b") {
+		t.FailNow()
+	}
+	written, _ := ReadIndex(filepath.Join(root, SummaryDir, SummaryFile))
+	if _, found := written.Files["a/b"]; !found || len(written.Files) != 2 {
+		t.FailNow()
+	}
+}
+
+// TestRelPath converts local paths to paths of an Index
+func TestRelPath(t *testing.T) {
+	if rel, err := RelPath("/root", "/root/a/b"); err != nil || rel != "a/b" {
+		t.FailNow()
+	}
+	for _, path := range []string{"/root", "/", "/rootless/a"} {
+		if _, err := RelPath("/root", path); err == nil {
+			t.Fatal(path)
+		}
+	}
+}
+
+// TestMakeLink creates a link and replaces it with another
+func TestMakeLink(t *testing.T) {
+	path := filepath.Join(testDir, "MakeLink", "a", "link")
+	for _, target := range []string{"b", "../c"} {
+		if err := MakeLink(path, target); err != nil {
+			t.Fatal(err)
+		}
+		if link, _ := os.Readlink(path); link != target {
+			t.FailNow()
+		}
+	}
+}
+
+// TestCheckLink rejects links that leave the directory through other links
+func TestCheckLink(t *testing.T) {
+	root := filepath.Join(testDir, "CheckLink")
+	os.MkdirAll(filepath.Join(root, "s"), 0755)
+	os.MkdirAll(filepath.Join(root, "d"), 0755)
+	if err := CheckLink(root, "e", "."); err != nil {
+		t.Fatal(err)
+	}
+	MakeLink(filepath.Join(root, "e"), ".")
+	for path, target := range map[string]string{"s/d": "../e/..", "s/f": "../e/d", "e/f": "d"} {
+		if err := CheckLink(root, path, target); err == nil {
+			t.Fatal(path, target)
+		}
+	}
+	if err := CheckLink(root, "s/f", "../d"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSafeLink checks links pointing inside and outside of a directory
+func TestSafeLink(t *testing.T) {
+	safe := map[string]string{"a": "b", "a/b": "../c", "a/b/c": "../../d", "l": "./a/b"}
+	for path, target := range safe {
+		if !SafeLink(path, target) {
+			t.Fatal(path, target)
+		}
+	}
+	unsafe := map[string]string{"a": "../b", "a/b": "../../c", "l": "/etc", "e": "",
+		"s/d": "../e/.."}
+	for path, target := range unsafe {
+		if SafeLink(path, target) {
+			t.Fatal(path, target)
+		}
+	}
+}
+
+// TestSafePath rejects paths in linked directories
+func TestSafePath(t *testing.T) {
+	root := filepath.Join(testDir, "SafePath")
+	os.MkdirAll(filepath.Join(root, "d"), 0755)
+	MakeLink(filepath.Join(root, "l"), "..")
+	if path, err := SafePath(root, "d/new/f"); err != nil || path != filepath.Join(root, "d", "new", "f") {
+		t.Fatal(err)
+	}
+	// the link itself can be replaced
+	if _, err := SafePath(root, "l"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SafePath(root, "l/f"); err == nil {
+		t.FailNow()
+	}
+}
+
 // TestWriteIndex writes an Index to a valid
 // and an invalid diretory
 func TestWriteIndex(t *testing.T) {
@@ -0,0 +1,64 @@
+package fs
+
+import uuid "github.com/satori/go.uuid"
+
+// Version is a version vector: the number of changes made to a file by
+// each device, indexed by the ID of the device. Unlike the Parent of a
+// Summary it doesn't need the history of the file to be compared
+type Version map[string]uint64
+
+// Compare decides if v is equal to, older than, newer than or concurrent
+// with v2. Devices missing from a Version haven't changed the file
+func (v Version) Compare(v2 Version) int {
+	older, newer := false, false
+	for device, n := range v {
+		if n > v2[device] {
+			newer = true
+		}
+	}
+	for device, n := range v2 {
+		if n > v[device] {
+			older = true
+		}
+	}
+	switch {
+	case older && newer:
+		return VersionConcurrent
+	case older:
+		return VersionOlder
+	case newer:
+		return VersionNewer
+	}
+	return VersionEqual
+}
+
+// Increment returns a copy of v with a new change made by device
+func (v Version) Increment(device string) Version {
+	nv := make(Version, len(v)+1)
+	for d, n := range v {
+		nv[d] = n
+	}
+	nv[device]++
+	return nv
+}
+
+// Merge returns a Version that is newer than or equal to both v and v2,
+// with the highest count of each device
+func (v Version) Merge(v2 Version) Version {
+	nv := make(Version, len(v))
+	for d, n := range v {
+		nv[d] = n
+	}
+	for d, n := range v2 {
+		if n > nv[d] {
+			nv[d] = n
+		}
+	}
+	return nv
+}
+
+// newDevice creates the ID a device uses to record its changes
+func newDevice() string {
+	id, _ := uuid.NewV4()
+	return id.String()
+}
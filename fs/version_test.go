@@ -0,0 +1,49 @@
+package fs
+
+import "testing"
+
+// TestVersion_Compare compares equal, older, newer and concurrent versions
+func TestVersion_Compare(t *testing.T) {
+	v := Version{"a": 1, "b": 2}
+	if v.Compare(Version{"b": 2, "a": 1}) != VersionEqual ||
+		Version(nil).Compare(Version{}) != VersionEqual {
+		t.FailNow()
+	}
+	if v.Compare(Version{"a": 1, "b": 3}) != VersionOlder ||
+		v.Compare(Version{"a": 1, "b": 2, "c": 1}) != VersionOlder {
+		t.FailNow()
+	}
+	if v.Compare(Version{"a": 1}) != VersionNewer || v.Compare(nil) != VersionNewer {
+		t.FailNow()
+	}
+	if v.Compare(Version{"a": 2, "b": 1}) != VersionConcurrent ||
+		v.Compare(Version{"c": 1}) != VersionConcurrent {
+		t.FailNow()
+	}
+}
+
+// TestVersion_Increment checks that incrementing a version copies it
+func TestVersion_Increment(t *testing.T) {
+	v := Version{"a": 1}
+	nv := v.Increment("a").Increment("b")
+	if v["a"] != 1 || nv["a"] != 2 || nv["b"] != 1 || v.Compare(nv) != VersionOlder {
+		t.FailNow()
+	}
+	if nv = Version(nil).Increment("a"); nv["a"] != 1 {
+		t.FailNow()
+	}
+}
+
+// TestVersion_Merge merges two concurrent versions
+func TestVersion_Merge(t *testing.T) {
+	v1 := Version{"a": 2, "b": 1}
+	v2 := Version{"a": 1, "c": 3}
+	m := v1.Merge(v2)
+	if m.Compare(Version{"a": 2, "b": 1, "c": 3}) != VersionEqual ||
+		m.Compare(v1) != VersionNewer || m.Compare(v2) != VersionNewer {
+		t.FailNow()
+	}
+	if len(v1) != 2 || len(v2) != 2 {
+		t.FailNow()
+	}
+}
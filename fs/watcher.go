@@ -0,0 +1,454 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchDelay is how long new Watchers wait for more changes before updating
+// the Index, so a burst of writes produces a single update
+var WatchDelay = 500 * time.Millisecond
+
+// writes records the files written by File.Write, indexed by path, so the
+// events they cause are not seen as local changes
+var (
+	writes      = make(map[string]written)
+	writesMutex sync.Mutex
+)
+
+// notifyEvent is a change in a watched directory
+//
+//	created:	path was created or moved into the directory
+//	dir:		path is a directory
+//	overflow:	events were lost, path is empty
+//	path:		path of the changed file
+type notifyEvent struct {
+	created  bool
+	dir      bool
+	overflow bool
+	path     string
+}
+
+// written is the state of a file right after File.Write replaced it
+//
+//	summary:	what was written, with the inode and modification time of
+//			the file, nil if File.Write wasn't given a Summary
+type written struct {
+	inode   uint64
+	modTime time.Time
+	size    int64
+	summary *Summary
+}
+
+// Watcher keeps the Index of a directory up to date with the changes made to
+// it. Only the changed paths are scanned, a full scan is made if the system
+// loses track of the changes
+type Watcher struct {
+	Root string
+
+	config   Config
+	delay    time.Duration
+	done     chan struct{} // closed once run returns
+	ignore   *Ignore
+	index    *Index
+	mutex    sync.Mutex // guards index, held while it is updated
+	notifier *notifier
+	started  bool // set by Start
+	store    *Store
+	updated  func(*Index, error)
+	writes   map[string]*Summary // summaries of own writes, applied by flush
+}
+
+// Watch scans root, starting from the summaries in index, or the default
+// Config if it is nil, and keeps watching it. updated is called with a copy
+// of the Index after each update, or with the error that prevented it. It
+// is called in the order the updates are made and can't call the methods
+// of the Watcher
+func Watch(root string, index *Index, updated func(*Index, error)) (*Watcher, error) {
+	w, err := NewWatcher(root, index, updated)
+	if err != nil {
+		return nil, err
+	}
+	w.Start()
+	return w, nil
+}
+
+// NewWatcher scans root as Watch does but doesn't update the Index until
+// Start is called, so the Index of the first scan can be read before
+// updated is called. Changes made in between are picked up by the first
+// update
+func NewWatcher(root string, index *Index, updated func(*Index, error)) (*Watcher, error) {
+	if index == nil {
+		index, _ = MakeIndex()
+	}
+	n, err := newNotifier()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Root:     root,
+		config:   index.Config,
+		delay:    WatchDelay,
+		done:     make(chan struct{}),
+		index:    index.Copy(),
+		notifier: n,
+		updated:  updated,
+	}
+	if err = w.config.Validate(); err != nil {
+		n.close()
+		return nil, err
+	}
+	// changes are recorded as made by this device
+	if w.config.Device == "" {
+		w.config.Device = newDevice()
+		w.index.Config = w.config
+	}
+	if w.config.Store {
+		if w.store, err = OpenStore(root); err != nil {
+			n.close()
+			return nil, err
+		}
+	}
+	// changes made while scanning are picked up by the first update
+	if err = w.watchTree(root); err != nil {
+		n.close()
+		return nil, err
+	}
+	if _, err = w.rescan(); err != nil {
+		n.close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close stops watching the directory, once it returns the Index is no
+// longer updated
+func (w *Watcher) Close() error {
+	err := w.notifier.close()
+	if w.started {
+		<-w.done
+	}
+	return err
+}
+
+// Index returns a copy of the current Index of the directory
+func (w *Watcher) Index() *Index {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.index.Copy()
+}
+
+// Modify applies f to a copy of the Index, which replaces it, and calls
+// updated with it. Later updates keep the changes made by f, such as the
+// parents it prunes or its Config
+func (w *Watcher) Modify(f func(*Index)) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	i := w.index.Copy()
+	f(i)
+	w.index = i
+	w.config = i.Config
+	if w.updated != nil {
+		w.updated(i.Copy(), nil)
+	}
+}
+
+// Start updates the Index with the changes made since the Watcher was
+// created until it is closed, it must be called once
+func (w *Watcher) Start() {
+	w.started = true
+	go w.run()
+}
+
+// applyWrites replaces the summaries of the files written by File.Write
+// with the summaries they were written with, replaced summaries become
+// parents. Returns whether any file changed, the mutex must be held
+func (w *Watcher) applyWrites() bool {
+	changed := false
+	for rel, s := range w.writes {
+		written := *s
+		written.Path = rel
+		if prev, found := w.index.Files[rel]; !found {
+			changed = true
+		} else if prev.ID != written.ID {
+			w.index.AddParent(prev)
+			changed = true
+		}
+		w.index.Files[rel] = &written
+	}
+	w.writes = nil
+	return changed
+}
+
+// flush updates the Index with the changes made to paths, or scans the
+// whole directory if changes were lost. updated is only called if the
+// Index changed
+func (w *Watcher) flush(paths map[string]bool, overflow bool) {
+	// blocks stored while scanning are kept until updated is called, the
+	// Store is always held before the mutex is locked
+	if w.store != nil {
+		defer w.store.Hold()()
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	// later changes to the written files are changes to what was written
+	applied := w.applyWrites()
+	var changed bool
+	var err error
+	if overflow {
+		changed, err = w.rescan()
+	} else {
+		changed, err = w.rescanPaths(paths)
+	}
+	if w.updated == nil {
+		return
+	}
+	if err != nil {
+		w.updated(nil, err)
+	} else if changed || applied {
+		w.updated(w.index.Copy(), nil)
+	}
+}
+
+// rescan scans the whole directory, unchanged files are not read
+func (w *Watcher) rescan() (bool, error) {
+	s := w.scanner()
+	if err := s.Scan(w.Root); err != nil {
+		return false, err
+	}
+	ni, err := MakeIndex(s.Summaries...)
+	if err != nil {
+		return false, err
+	}
+	ni.Config = w.config
+	w.ignore = s.ignore
+	return w.update(w.index, ni), nil
+}
+
+// rescanPaths scans the changed paths and the content of changed directories,
+// paths inside other changed directories are scanned with them
+func (w *Watcher) rescanPaths(paths map[string]bool) (bool, error) {
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	changed := sorted[:0]
+	for _, path := range sorted {
+		if n := len(changed); n > 0 && strings.HasPrefix(path, changed[n-1]+"/") {
+			continue
+		}
+		changed = append(changed, path)
+	}
+
+	s := w.scanner()
+	old, _ := MakeIndex()
+	// files created where others were deleted must be newer than them
+	old.Deletions = w.index.Deletions
+	for _, rel := range changed {
+		for path, summary := range w.index.Files {
+			if path == rel || strings.HasPrefix(path, rel+"/") {
+				old.Add(summary)
+			}
+		}
+		path := filepath.Join(w.Root, filepath.FromSlash(rel))
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if info.IsDir() {
+			err = s.Scan(path)
+		} else {
+			err = s.Visit(path, info, nil)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	// summaries rehashed by the scanner replace those of w.index
+	for path := range old.Files {
+		old.Files[path] = w.index.Files[path]
+	}
+	ni, err := MakeIndex(s.Summaries...)
+	if err != nil {
+		return false, err
+	}
+	ni.Config = w.config
+	return w.update(old, ni), nil
+}
+
+// run collects the changed paths and updates the Index once no change has
+// been made for WatchDelay, or after 10 times that if changes don't stop
+func (w *Watcher) run() {
+	defer close(w.done)
+	paths := make(map[string]bool)
+	overflow := false
+	var first time.Time
+	var timer <-chan time.Time
+	for {
+		select {
+		case e, ok := <-w.notifier.events:
+			if !ok {
+				return
+			}
+			if !w.record(e, paths) {
+				overflow = true
+			}
+			if first.IsZero() {
+				first = time.Now()
+			}
+			if time.Since(first) < 10*w.delay {
+				timer = time.After(w.delay)
+			}
+		case <-timer:
+			if len(paths) > 0 || len(w.writes) > 0 || overflow {
+				w.flush(paths, overflow)
+			}
+			paths = make(map[string]bool)
+			overflow = false
+			first = time.Time{}
+			timer = nil
+		}
+	}
+}
+
+// record adds the path of an event to paths unless it is ignored or was
+// caused by File.Write, whose Summary is kept for flush instead. New
+// directories are watched. false is returned if the directory has to be
+// scanned again
+func (w *Watcher) record(e notifyEvent, paths map[string]bool) bool {
+	if e.overflow {
+		return false
+	}
+	rel, err := RelPath(w.Root, e.path)
+	if err != nil || w.ignore.Match(rel, e.dir) {
+		return true
+	}
+	if e.dir && e.created {
+		if err = w.watchTree(e.path); err != nil {
+			return false
+		}
+	}
+	if s, own := ownWrite(e.path); own {
+		if s != nil {
+			if w.writes == nil {
+				w.writes = make(map[string]*Summary)
+			}
+			w.writes[rel] = s
+		}
+		return true
+	}
+	paths[rel] = true
+	return true
+}
+
+// scanner creates a Scanner that reuses the summaries of the current Index
+func (w *Watcher) scanner() *Scanner {
+	return &Scanner{
+		Config:   w.config,
+		OldIndex: w.index,
+		Root:     w.Root,
+		ignore:   w.ignore,
+		started:  time.Now(),
+		store:    w.store,
+	}
+}
+
+// update applies the changes from old, the summaries of the changed paths
+// before they changed, to ni, their summaries now, using Update. Returns
+// whether any summary changed, the mutex must be held unless run hasn't
+// started
+func (w *Watcher) update(old *Index, ni *Index) bool {
+	u := Update(old, ni)
+	changed := len(u.Parents) > len(old.Parents) || len(u.Deletions) > len(old.Deletions) ||
+		len(u.Files) != len(old.Files)
+	for path, s := range u.Files {
+		if prev, found := old.Files[path]; !found || prev.ID != s.ID {
+			changed = true
+		}
+	}
+	for path := range old.Files {
+		delete(w.index.Files, path)
+	}
+	for path, s := range u.Files {
+		w.index.Files[path] = s
+	}
+	for id, s := range u.Parents {
+		w.index.Parents[id] = s
+	}
+	for id, s := range u.Deletions {
+		w.index.Deletions[id] = s
+	}
+	w.index.Ignore = w.ignore
+	w.index.Store = w.store
+	return changed
+}
+
+// watchTree watches dir and every directory inside it that isn't ignored
+func (w *Watcher) watchTree(dir string) error {
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			// the directory may be gone already
+			return nil
+		}
+		if !f.IsDir() {
+			return nil
+		}
+		if rel, err := RelPath(w.Root, path); err == nil && w.ignore.Match(rel, true) {
+			return filepath.SkipDir
+		}
+		return w.notifier.add(path)
+	})
+}
+
+// ownWrite checks if the file in path is still as File.Write left it and
+// returns the Summary it was written with
+func ownWrite(path string) (*Summary, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, false
+	}
+	writesMutex.Lock()
+	defer writesMutex.Unlock()
+	wr, found := writes[abs]
+	if !found {
+		return nil, false
+	}
+	info, err := os.Lstat(abs)
+	if err != nil || info.Size() != wr.size || !info.ModTime().Equal(wr.modTime) || inode(info) != wr.inode {
+		delete(writes, abs)
+		return nil, false
+	}
+	return wr.summary, true
+}
+
+// recordWrite records the state of the temporary file tmp, which is about to
+// replace the file in path with the content described by s, which can be nil
+func recordWrite(path string, tmp string, s *Summary) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	info, err := os.Lstat(tmp)
+	if err != nil {
+		return
+	}
+	wr := written{inode: inode(info), modTime: info.ModTime(), size: info.Size()}
+	if s != nil {
+		// the scanner reuses summaries whose file wasn't touched since
+		stamped := *s
+		stamped.Inode = wr.inode
+		stamped.ModTime = wr.modTime.UnixNano()
+		wr.summary = &stamped
+	}
+	writesMutex.Lock()
+	writes[abs] = wr
+	writesMutex.Unlock()
+}
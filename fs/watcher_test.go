@@ -0,0 +1,217 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatch watches a directory while files are created, written in bursts,
+// moved and deleted, and while sakaban writes to it
+func TestWatch(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "Watch")
+	os.MkdirAll(unitTestDir, 0755)
+	ioutil.WriteFile(filepath.Join(unitTestDir, "a"), []byte{1}, 0644)
+
+	delay := WatchDelay
+	WatchDelay = 50 * time.Millisecond
+	defer func() { WatchDelay = delay }()
+	updates := make(chan *Index, 16)
+	w, err := Watch(unitTestDir, nil, func(i *Index, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		updates <- i
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer w.Close()
+	if _, found := w.Index().Files["a"]; !found {
+		t.FailNow()
+	}
+	wait := func() *Index {
+		select {
+		case i := <-updates:
+			return i
+		case <-time.After(5 * time.Second):
+			t.Fatal("Index was not updated")
+		}
+		return nil
+	}
+
+	// a burst of writes in a new directory is a single update
+	os.Mkdir(filepath.Join(unitTestDir, "dir"), 0755)
+	for n := 0; n < 10; n++ {
+		ioutil.WriteFile(filepath.Join(unitTestDir, "dir", "b"), []byte{byte(n)}, 0644)
+	}
+	i := wait()
+	if b, found := i.Files["dir/b"]; !found || len(i.Files) != 3 || b.Size != 1 {
+		t.Fatal(i.Files)
+	}
+	select {
+	case <-updates:
+		t.Fatal("Burst of writes caused several updates")
+	case <-time.After(10 * WatchDelay):
+	}
+
+	// moves keep the history of the file
+	old := i.Files["a"]
+	os.Rename(filepath.Join(unitTestDir, "a"), filepath.Join(unitTestDir, "dir", "c"))
+	i = wait()
+	if _, found := i.Files["a"]; found || i.Files["dir/c"].Parent != old.ID {
+		t.Fatal(i.Files)
+	}
+
+	// deleted directories and their content
+	b := i.Files["dir/b"]
+	os.RemoveAll(filepath.Join(unitTestDir, "dir"))
+	i = wait()
+	if _, found := i.Deletions[b.ID]; !found || len(i.Files) != 0 {
+		t.Fatal(i.Files)
+	}
+
+	// files written by sakaban are not local changes
+	f := &File{Path: filepath.Join(unitTestDir, "d"), Perm: 0644,
+		Blocks: []*Block{&Block{Content: []byte{1, 2}}}}
+	if err = f.Write(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case i = <-updates:
+		t.Fatal("File.Write caused an update", i.Files)
+	case <-time.After(10 * WatchDelay):
+	}
+
+	// files written with a summary are indexed with it
+	content := []byte{3, 4}
+	scratch := filepath.Join(testDir, "WatchScratch")
+	ioutil.WriteFile(scratch, content, 0644)
+	s, err := MakeSummaryFromPath(scratch, MakeConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Path = "e"
+	s.Version = Version{"remote": 3}
+	f = &File{Path: filepath.Join(unitTestDir, "e"), Perm: 0644,
+		Blocks: []*Block{&Block{Content: content}}}
+	if err = f.WriteVerified(s); err != nil {
+		t.Fatal(err)
+	}
+	i = wait()
+	if e := i.Files["e"]; e == nil || e.ID != s.ID || e.Version.Compare(s.Version) != VersionEqual {
+		t.Fatal(i.Files)
+	}
+}
+
+// TestNewWatcher checks that a Watcher doesn't update the Index until it is
+// started, that changes made before are picked up and that it can be closed
+// without being started
+func TestNewWatcher(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "NewWatcher")
+	os.MkdirAll(unitTestDir, 0755)
+	delay := WatchDelay
+	WatchDelay = 50 * time.Millisecond
+	defer func() { WatchDelay = delay }()
+	updates := make(chan *Index, 16)
+	updated := func(i *Index, err error) {
+		if err == nil {
+			updates <- i
+		}
+	}
+
+	w, err := NewWatcher(unitTestDir, nil, updated)
+	if err != nil {
+		t.Skip(err)
+	}
+	ioutil.WriteFile(filepath.Join(unitTestDir, "a"), []byte{1}, 0644)
+	select {
+	case <-updates:
+		t.Fatal("Index was updated before the Watcher was started")
+	case <-time.After(10 * WatchDelay):
+	}
+	w.Start()
+	select {
+	case i := <-updates:
+		if _, found := i.Files["a"]; !found {
+			t.Fatal(i.Files)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Index was not updated")
+	}
+	w.Close()
+
+	w, err = NewWatcher(unitTestDir, nil, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+// TestWatcher_Overflow checks that lost events cause a full scan
+func TestWatcher_Overflow(t *testing.T) {
+	w := &Watcher{}
+	if w.record(notifyEvent{overflow: true}, make(map[string]bool)) {
+		t.FailNow()
+	}
+	unitTestDir := filepath.Join(testDir, "WatchOverflow")
+	os.MkdirAll(unitTestDir, 0755)
+	w = &Watcher{Root: unitTestDir, index: new(Index).Copy()}
+	ioutil.WriteFile(filepath.Join(unitTestDir, "a"), []byte{1}, 0644)
+	w.flush(nil, true)
+	if _, found := w.Index().Files["a"]; !found {
+		t.FailNow()
+	}
+}
+
+// TestWatcher_Modify checks that changes made with Modify are kept by later
+// updates and that the Index is not updated once the Watcher is closed
+func TestWatcher_Modify(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "WatchModify")
+	os.MkdirAll(unitTestDir, 0755)
+	ioutil.WriteFile(filepath.Join(unitTestDir, "a"), []byte{1}, 0644)
+
+	delay := WatchDelay
+	WatchDelay = 50 * time.Millisecond
+	defer func() { WatchDelay = delay }()
+	updates := make(chan *Index, 16)
+	w, err := Watch(unitTestDir, nil, func(i *Index, err error) {
+		if err == nil {
+			updates <- i
+		}
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	parent := &Summary{ID: "f.0", Path: "old"}
+	w.Modify(func(i *Index) {
+		i.Config.Paranoid = true
+		i.AddParent(parent)
+	})
+	if i := <-updates; !i.Config.Paranoid || i.Parents[parent.ID] == nil {
+		t.FailNow()
+	}
+
+	ioutil.WriteFile(filepath.Join(unitTestDir, "b"), []byte{2}, 0644)
+	select {
+	case i := <-updates:
+		if _, found := i.Files["b"]; !found || !i.Config.Paranoid || i.Parents[parent.ID] == nil {
+			t.Fatal(i.Files, i.Parents)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Index was not updated")
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(unitTestDir, "c"), []byte{3}, 0644)
+	select {
+	case i := <-updates:
+		t.Fatal("Closed watcher updated the index", i.Files)
+	case <-time.After(10 * WatchDelay):
+	}
+}
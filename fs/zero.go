@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// holeMinSize is the smallest run of zeros written as a hole
+const holeMinSize = 4 * 1024
+
+var (
+	// zeros is shared by every zero block, it must never be written to
+	zeros     []byte
+	zeroHash  = make(map[string]string)
+	zeroMutex sync.Mutex
+)
+
+// extent is a range of a file: [Offset, Offset+Length)
+type extent struct {
+	Offset int64
+	Length int64
+}
+
+// ZeroBlock returns a block of size zeros. Zero blocks share their content,
+// which must not be modified
+func ZeroBlock(size int64) *Block {
+	zeroMutex.Lock()
+	defer zeroMutex.Unlock()
+	if int64(len(zeros)) < size {
+		zeros = make([]byte, size)
+	}
+	return &Block{Content: zeros[:size]}
+}
+
+// covered checks if the range [offset, offset+length) is inside a hole
+func covered(holes []extent, offset int64, length int64) bool {
+	for _, h := range holes {
+		if h.Offset <= offset && offset+length <= h.Offset+h.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// hashZeros returns the hash of size zeros, hashes are cached so blocks in
+// holes don't need to be read nor hashed
+func hashZeros(algorithm string, size int64) string {
+	key := fmt.Sprintf("%s/%d", algorithm, size)
+	zeroMutex.Lock()
+	h, found := zeroHash[key]
+	zeroMutex.Unlock()
+	if found {
+		return h
+	}
+	h = ZeroBlock(size).HashWith(algorithm)
+	zeroMutex.Lock()
+	zeroHash[key] = h
+	zeroMutex.Unlock()
+	return h
+}
+
+// isZero checks if every byte of content is zero
+func isZero(content []byte) bool {
+	for _, c := range content {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseWriter writes to a file leaving holes where runs of zeros are
+// written, a hash of everything written is kept to verify the file
+type sparseWriter struct {
+	file   *os.File
+	hash   hash.Hash
+	offset int64
+}
+
+// Close sets the size of the file, as holes at the end are not written
+func (w *sparseWriter) Close() error {
+	return w.file.Truncate(w.offset)
+}
+
+// Write writes p or, if p only has zeros, seeks past it
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	w.hash.Write(p)
+	if len(p) >= holeMinSize && isZero(p) {
+		if _, err := w.file.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		w.offset += int64(len(p))
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeSparseFile creates a file with data at the beginning and the end
+// and a hole of the given size in between
+func makeSparseFile(path string, data []byte, hole int64) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(data, int64(len(data))+hole); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TestFindHoles finds the hole of a sparse file, the file system may not
+// support holes so only found holes are checked
+func TestFindHoles(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "FindHoles")
+	os.MkdirAll(unitTestDir, 0755)
+	path := filepath.Join(unitTestDir, "sparse")
+	data := bytes.Repeat([]byte{1}, int(MinBlockSize))
+	if err := makeSparseFile(path, data, 16*MinBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := os.Open(path)
+	defer file.Close()
+	info, _ := file.Stat()
+	holes, err := findHoles(file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(path)
+	for _, h := range holes {
+		if !isZero(content[h.Offset : h.Offset+h.Length]) {
+			t.FailNow()
+		}
+	}
+}
+
+// TestFindHoles_End finds the hole at the end of a file extended with
+// Truncate, where no data follows it
+func TestFindHoles_End(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "FindHolesEnd")
+	os.MkdirAll(unitTestDir, 0755)
+	path := filepath.Join(unitTestDir, "sparse")
+	data := bytes.Repeat([]byte{1}, int(MinBlockSize))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size := 16 * MinBlockSize
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := os.Open(path)
+	defer file.Close()
+	holes, err := findHoles(file, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file system may not support holes
+	if len(holes) == 0 {
+		t.Skip("No holes found")
+	}
+	last := holes[len(holes)-1]
+	if last.Offset+last.Length != size || last.Offset < int64(len(data)) {
+		t.Fatal(holes)
+	}
+}
+
+// TestMakeSummaryFromPath_Sparse summarizes a sparse file, blocks in the
+// hole are marked as zero and hashed as if they were read
+func TestMakeSummaryFromPath_Sparse(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "SummarySparse")
+	os.MkdirAll(unitTestDir, 0755)
+	path := filepath.Join(unitTestDir, "sparse")
+	data := bytes.Repeat([]byte{1}, int(MinBlockSize))
+	makeSparseFile(path, data, 4*MinBlockSize)
+
+	c := Config{BlockSize: MinBlockSize}
+	s, err := MakeSummaryFromPath(path, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := MakeFileWithConfig(path, c)
+	if !s.Equals(MakeSummary(f)) || s.Digest != MakeSummary(f).Digest {
+		t.FailNow()
+	}
+	if len(s.Zeros) != 4 || !s.IsZero(1) || !s.IsZero(4) || s.IsZero(0) || s.IsZero(5) {
+		t.FailNow()
+	}
+}
+
+// TestFile_Write_Sparse writes a file with zero blocks, which are left as
+// holes if the file system supports them
+func TestFile_Write_Sparse(t *testing.T) {
+	unitTestDir := filepath.Join(testDir, "WriteSparse")
+	os.MkdirAll(unitTestDir, 0755)
+	data := &Block{Content: bytes.Repeat([]byte{1}, int(MinBlockSize))}
+	f := File{
+		Path:      filepath.Join(unitTestDir, "sparse"),
+		Perm:      0644,
+		BlockSize: MinBlockSize,
+		Blocks:    []*Block{data, ZeroBlock(MinBlockSize), data, ZeroBlock(MinBlockSize)},
+	}
+	if err := f.Write(); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(f.Path)
+	expected := append(append(append([]byte{}, data.Content...), ZeroBlock(MinBlockSize).Content...),
+		data.Content...)
+	expected = append(expected, ZeroBlock(MinBlockSize).Content...)
+	if !bytes.Equal(content, expected) {
+		t.FailNow()
+	}
+}
+
+// TestHashZeros compares the cached hash of zeros with a computed one
+func TestHashZeros(t *testing.T) {
+	for _, size := range []int64{1, 100, MinBlockSize} {
+		b := &Block{Content: make([]byte, size)}
+		if hashZeros(HashSHA256, size) != b.HashWith(HashSHA256) {
+			t.FailNow()
+		}
+	}
+	if !ZeroBlock(10).IsZero() || (&Block{Content: []byte{0, 1}}).IsZero() {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,143 @@
+package comm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies the algorithm used to compress the content of a block
+type Codec byte
+
+// Codecs is a set of Codecs, each Codec is the position of a bit
+type Codecs byte
+
+const (
+	// CodecNone sends the content as it is
+	CodecNone Codec = iota
+	// CodecGzip compresses the content with gzip
+	CodecGzip
+	// CodecSnappy compresses the content with snappy, faster but weaker
+	CodecSnappy
+	// CodecZstd compresses the content with zstd
+	CodecZstd
+	// CodecZero sends only the length of a block whose bytes are all zero
+	CodecZero
+)
+
+// SupportedCodecs are the Codecs this peer can decompress
+const SupportedCodecs = Codecs(1<<CodecGzip | 1<<CodecSnappy | 1<<CodecZstd | 1<<CodecZero)
+
+// codecPreference lists the Codecs in the order they are chosen to send
+// a block, better compression first as links between peers may be slow
+var codecPreference = []Codec{CodecZstd, CodecGzip, CodecSnappy}
+
+// Has checks if c is in the set
+func (cs Codecs) Has(c Codec) bool {
+	return c == CodecNone || cs&(1<<c) != 0
+}
+
+// Preferred returns the Codec used to send blocks to a peer that accepts
+// the Codecs in cs, CodecNone if no other is supported by both peers
+func (cs Codecs) Preferred() Codec {
+	for _, c := range codecPreference {
+		if cs.Has(c) && SupportedCodecs.Has(c) {
+			return c
+		}
+	}
+	return CodecNone
+}
+
+// compress returns the content compressed with c
+func compress(c Codec, content []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return content, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, content), nil
+	case CodecZero:
+		for _, b := range content {
+			if b != 0 {
+				return nil, errors.New("Content is not zero")
+			}
+		}
+		return uint64ToBytes(uint64(len(content))), nil
+	case CodecZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(content, nil), nil
+	}
+	return nil, fmt.Errorf("Unknown codec: %d", c)
+}
+
+// decompress returns the content compressed with c, an error is returned
+// if the decompressed content is longer than max
+func decompress(c Codec, content []byte, max int) ([]byte, error) {
+	var r io.Reader
+	switch c {
+	case CodecNone:
+		return content, nil
+	case CodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case CodecSnappy:
+		n, err := snappy.DecodedLen(content)
+		if err != nil {
+			return nil, err
+		}
+		if n > max {
+			return nil, fmt.Errorf("Decompressed content is too big: %dB", n)
+		}
+		return snappy.Decode(nil, content)
+	case CodecZero:
+		if len(content) != sizeOfZeroBlock {
+			return nil, errors.New("Invalid zero block")
+		}
+		n := uint64FromBytes(content)
+		if n > uint64(max) {
+			return nil, fmt.Errorf("Decompressed content is too big: %dB", n)
+		}
+		return make([]byte, n), nil
+	case CodecZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("Unknown codec: %d", c)
+	}
+	// read one more byte than allowed to detect oversized content
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > max {
+		return nil, fmt.Errorf("Decompressed content is too big: >%dB", max)
+	}
+	return decompressed, nil
+}
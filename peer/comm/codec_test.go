@@ -0,0 +1,75 @@
+package comm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs_Has(t *testing.T) {
+	cs := Codecs(1 << CodecGzip)
+	if !cs.Has(CodecGzip) || !cs.Has(CodecNone) || cs.Has(CodecZstd) {
+		t.FailNow()
+	}
+}
+
+func TestCodecs_Preferred(t *testing.T) {
+	if SupportedCodecs.Preferred() != CodecZstd {
+		t.FailNow()
+	}
+	if Codecs(1<<CodecSnappy).Preferred() != CodecSnappy {
+		t.FailNow()
+	}
+	// peers that accept no codecs
+	if Codecs(0).Preferred() != CodecNone {
+		t.FailNow()
+	}
+}
+
+// TestCompress compresses and decompresses content with every codec
+func TestCompress(t *testing.T) {
+	content := bytes.Repeat([]byte("sakaban "), 1024)
+	for _, c := range []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd} {
+		compressed, err := compress(c, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := decompress(c, compressed, len(content))
+		if err != nil || !bytes.Equal(decompressed, content) {
+			t.Fatalf("Codec %d: %s", c, err)
+		}
+		// content bigger than allowed
+		if c != CodecNone {
+			if _, err = decompress(c, compressed, len(content)-1); err == nil {
+				t.Fatalf("Codec %d: decompressed oversized content", c)
+			}
+		}
+	}
+
+	// zero blocks
+	zeros := make([]byte, 1024)
+	compressed, _ := compress(CodecZero, zeros)
+	if len(compressed) != 8 {
+		t.FailNow()
+	}
+	if decompressed, err := decompress(CodecZero, compressed, 1024); err != nil ||
+		!bytes.Equal(decompressed, zeros) {
+		t.FailNow()
+	}
+	if _, err := decompress(CodecZero, compressed, 1023); err == nil {
+		t.FailNow()
+	}
+	if _, err := compress(CodecZero, content); err == nil {
+		t.FailNow()
+	}
+
+	// unknown codec and corrupted content
+	if _, err := compress(Codec(42), content); err == nil {
+		t.FailNow()
+	}
+	if _, err := decompress(Codec(42), content, len(content)); err == nil {
+		t.FailNow()
+	}
+	if _, err := decompress(CodecGzip, content, len(content)); err == nil {
+		t.FailNow()
+	}
+}
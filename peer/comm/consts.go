@@ -17,19 +17,32 @@ const (
 	MTIndexContent
 	// MTIndexRequest is used to ask for a IndexContent
 	MTIndexRequest
+	// MTDeltaContent lists the operations to rebuild a modified file
+	MTDeltaContent
+	// MTDeltaRequest sends the fs.Signature of a file to get a DeltaContent
+	MTDeltaRequest
 )
 
 const minMessageType MessageType = MTBlockContent
-const maxMessageType MessageType = MTIndexRequest
+const maxMessageType MessageType = MTDeltaRequest
+
+const (
+	/* delta operations */
+	opCopy    byte = iota // copy a block of the old copy
+	opLiteral             // write the content of the operation
+)
 
 const (
 	/* other constats */
 	bufferSize = 1024 * 1024 * 2 // recv buffer size
 	/* sizes of fields */
-	sizeOfBlockN       = int(unsafe.Sizeof(uint8(0)))
+	sizeOfBlockN       = int(unsafe.Sizeof(uint64(0)))
 	sizeOfBlockSize    = int(unsafe.Sizeof(uint16(0)))
+	sizeOfCodec        = int(unsafe.Sizeof(Codec(0)))
 	sizeOfFileID       = uuid.Size
 	sizeOfFilePathSize = int(unsafe.Sizeof(uint16(0)))
 	sizeOfMessage      = int(unsafe.Sizeof(uint64(0)))
 	sizeOfMessageType  = 1
+	sizeOfOperation    = 1 + int(unsafe.Sizeof(uint64(0))) // kind + block number or length
+	sizeOfZeroBlock    = int(unsafe.Sizeof(uint64(0)))     // length of a zero block
 )
@@ -2,9 +2,11 @@ package comm
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 
 	"bitbucket.org/mikelsr/sakaban/fs"
 	"github.com/satori/go.uuid"
@@ -29,19 +31,32 @@ type Message interface {
 // belongs to
 type BlockContent struct {
 	MessageSize uint64    // total size of the message
-	BlockN      uint8     // block number
+	BlockN      uint64    // block number
 	BlockSize   uint16    // block size in kB
-	Content     []byte    // content of the block
+	Codec       Codec     // codec used to compress Content when it is sent
+	Content     []byte    // content of the block, decompressed
 	FileID      uuid.UUID // ID of the file the Block belongs to
 }
 
-// Dump creates a byte array: {MessageType, BlockNumber, BlockSize, FileID,
-// Content} (28B + BlockSize * 1024B)
+// Dump creates a byte array: {MessageType, MessageSize, BlockNumber,
+// BlockSize, Codec, FileID, Content} (36B + BlockSize * 1024B). Content is
+// sent uncompressed if it doesn't shrink
 func (bc BlockContent) Dump() []byte {
+	codec, content := bc.Codec, bc.Content
+	if codec != CodecNone {
+		compressed, err := compress(codec, content)
+		if err == nil && len(compressed) < len(content) {
+			content = compressed
+		} else {
+			codec = CodecNone
+		}
+	}
 	// create base message
-	dump := append([]byte{byte(bc.Type()), byte(bc.BlockN)}, uint16ToBytes(bc.BlockSize)...)
+	dump := append([]byte{byte(bc.Type())}, uint64ToBytes(bc.BlockN)...)
+	dump = append(dump, uint16ToBytes(bc.BlockSize)...)
+	dump = append(dump, byte(codec))
 	dump = append(dump, bc.FileID.Bytes()...)
-	dump = append(dump, bc.Content...)
+	dump = append(dump, content...)
 	// calculate size of message
 	totalLen := uint64(len(dump) + sizeOfMessage)
 	// create new massage merging the base message and its size
@@ -52,10 +67,10 @@ func (bc BlockContent) Dump() []byte {
 }
 
 // Load reads blockN, blockSize, fileID, content from a byte slice created
-// by br.Dump()
+// by br.Dump(), content is decompressed
 func (bc *BlockContent) Load(msg []byte) error {
 	index := 0
-	headerSize := sizeOfMessageType + sizeOfMessage + sizeOfFileID + sizeOfBlockN + sizeOfBlockSize
+	headerSize := sizeOfMessageType + sizeOfMessage + sizeOfFileID + sizeOfBlockN + sizeOfBlockSize + sizeOfCodec
 
 	// parse contents of the message, extract values
 	if len(msg) < headerSize || MessageType(msg[0]) != MTBlockContent {
@@ -70,13 +85,17 @@ func (bc *BlockContent) Load(msg []byte) error {
 	index += sizeOfMessage
 
 	// block number
-	blockN := uint8(msg[index])
+	blockN := uint64FromBytes(msg[index : index+sizeOfBlockN])
 	index += sizeOfBlockN
 
 	// block size
 	blockSize := uint16FromBytes(msg[index : index+sizeOfBlockSize])
 	index += sizeOfBlockSize
 
+	// codec
+	codec := Codec(msg[index])
+	index += sizeOfCodec
+
 	// file id
 	fileID, err := uuid.FromBytes(msg[index : index+sizeOfFileID])
 	if err != nil {
@@ -84,8 +103,11 @@ func (bc *BlockContent) Load(msg []byte) error {
 	}
 	index += sizeOfFileID
 
-	// content
-	content := msg[index:]
+	// content, decompressed before it is validated
+	content, err := decompress(codec, msg[index:], (int(blockSize)+1)*1024-1)
+	if err != nil {
+		return err
+	}
 
 	// validate extracted values
 	if len(content) > int(^uint16(0))*1024 { // bigger than MaxUint8
@@ -100,6 +122,7 @@ func (bc *BlockContent) Load(msg []byte) error {
 	bc.MessageSize = totalSize
 	bc.BlockN = blockN
 	bc.BlockSize = blockSize
+	bc.Codec = codec
 	bc.Content = content
 	bc.FileID = fileID
 
@@ -125,15 +148,19 @@ func (bc BlockContent) Type() MessageType {
 
 // BlockRequest is used to ask for a block
 type BlockRequest struct {
-	BlockN       uint8     // block number
+	BlockN       uint64    // block number
+	Codecs       Codecs    // codecs accepted to compress the block
 	FileID       uuid.UUID // ID of the file the Block belongs to
 	FilePathSize uint16    // size of encoded FilePath
 	FilePath     string    // relative path of the file
 }
 
-// Dump creates a byte array: {MessageType, BlockNumber, FileID} (18B)
+// Dump creates a byte array: {MessageType, BlockNumber, Codecs, FileID,
+// FilePathSize, FilePath} (28B + FilePathSize)
 func (br BlockRequest) Dump() []byte {
-	dump := append([]byte{byte(br.Type()), byte(br.BlockN)}, br.FileID.Bytes()...)
+	dump := append([]byte{byte(br.Type())}, uint64ToBytes(br.BlockN)...)
+	dump = append(dump, byte(br.Codecs))
+	dump = append(dump, br.FileID.Bytes()...)
 	encodedPath := []byte(br.FilePath)
 	// split string size in two bytes
 	pathSize := uint16ToBytes(uint16(len(encodedPath)))
@@ -141,10 +168,10 @@ func (br BlockRequest) Dump() []byte {
 	return append(dump, encodedPath...)
 }
 
-// Load reads blockN and fileID from a byte slice created by br.Dump()
+// Load reads blockN, codecs and fileID from a byte slice created by br.Dump()
 func (br *BlockRequest) Load(msg []byte) error {
 	index := 0
-	headerSize := sizeOfMessageType + sizeOfBlockN + sizeOfFileID + sizeOfFilePathSize
+	headerSize := sizeOfMessageType + sizeOfBlockN + sizeOfCodec + sizeOfFileID + sizeOfFilePathSize
 
 	if len(msg) < headerSize || MessageType(msg[0]) != MTBlockRequest {
 		return errors.New("Invalid message type")
@@ -152,9 +179,13 @@ func (br *BlockRequest) Load(msg []byte) error {
 	index += sizeOfMessageType
 
 	// block number
-	blockN := uint8(msg[index])
+	blockN := uint64FromBytes(msg[index : index+sizeOfBlockN])
 	index += sizeOfBlockN
 
+	// accepted codecs
+	codecs := Codecs(msg[index])
+	index += sizeOfCodec
+
 	// file id
 	fileID, err := uuid.FromBytes(msg[index : index+sizeOfFileID])
 	if err != nil {
@@ -174,6 +205,7 @@ func (br *BlockRequest) Load(msg []byte) error {
 
 	// both values extracted successfully
 	br.BlockN = blockN
+	br.Codecs = codecs
 	br.FileID = fileID
 	br.FilePathSize = uint16(filePathSize)
 	br.FilePath = filePath
@@ -186,10 +218,12 @@ func (br *BlockRequest) Recv(s *bufio.Reader) ([]byte, error) {
 }
 
 // Size returns the total size of the message
-// MessageType + BlockN + UUID + FilePathSize + filePath
+// MessageType + BlockN + Codecs + UUID + FilePathSize + filePath
 func (br BlockRequest) Size(msg []byte) uint64 {
-	// return 1 + 1 + 2 + uint64(uint16FromBytes(msg[18:34]))
-	s := sizeOfMessageType + sizeOfBlockN + sizeOfFileID
+	s := sizeOfMessageType + sizeOfBlockN + sizeOfCodec + sizeOfFileID
+	if len(msg) < s+sizeOfFilePathSize {
+		return uint64(s + sizeOfFilePathSize)
+	}
 	return uint64(s) + uint64(sizeOfFilePathSize) + uint64(uint16FromBytes(msg[s:s+sizeOfFilePathSize]))
 }
 
@@ -198,11 +232,198 @@ func (br BlockRequest) Type() MessageType {
 	return MTBlockRequest
 }
 
+/* Delta content */
+
+// DeltaContent is used to send the operations that rebuild a file from the
+// old copy described by a fs.Signature
+type DeltaContent struct {
+	MessageSize uint64    // total size of the message
+	Delta       fs.Delta  // operations to rebuild the file
+	FileID      uuid.UUID // ID of the file
+}
+
+// Dump creates a byte array: {MessageType, MessageSize, FileID, Operations}
+// (25B + 9B for each operation + length of literals). An operation is a
+// kind, the block number to copy or the length of the literal and the
+// literal itself
+func (dc DeltaContent) Dump() []byte {
+	dump := dc.FileID.Bytes()
+	for _, op := range dc.Delta {
+		if op.Literal == nil {
+			dump = append(dump, opCopy)
+			dump = append(dump, uint64ToBytes(op.BlockN)...)
+			continue
+		}
+		dump = append(dump, opLiteral)
+		dump = append(dump, uint64ToBytes(uint64(len(op.Literal)))...)
+		dump = append(dump, op.Literal...)
+	}
+	totalLen := uint64(len(dump) + sizeOfMessageType + sizeOfMessage)
+	cDump := []byte{byte(dc.Type())}
+	cDump = append(cDump, uint64ToBytes(totalLen)...)
+	return append(cDump, dump...)
+}
+
+// Load reads fileID and the operations from a byte slice created by
+// dc.Dump()
+func (dc *DeltaContent) Load(msg []byte) error {
+	index := 0
+	headerSize := sizeOfMessageType + sizeOfMessage + sizeOfFileID
+
+	if len(msg) < headerSize || MessageType(msg[0]) != MTDeltaContent {
+		return errors.New("Invalid message type")
+	}
+	index += sizeOfMessageType
+
+	totalSize := dc.Size(msg)
+	if uint64(len(msg)) != totalSize {
+		return fmt.Errorf("Invalid DeltaContent dump, expected %dB got %dB", totalSize, len(msg))
+	}
+	index += sizeOfMessage
+
+	// file id
+	fileID, err := uuid.FromBytes(msg[index : index+sizeOfFileID])
+	if err != nil {
+		return err
+	}
+	index += sizeOfFileID
+
+	// operations
+	delta := make(fs.Delta, 0)
+	for index < len(msg) {
+		if len(msg) < index+sizeOfOperation {
+			return errors.New("Incomplete delta operation")
+		}
+		kind := msg[index]
+		n := uint64FromBytes(msg[index+1 : index+sizeOfOperation])
+		index += sizeOfOperation
+		switch kind {
+		case opCopy:
+			delta = append(delta, fs.Operation{BlockN: n})
+		case opLiteral:
+			if uint64(len(msg)-index) < n {
+				return errors.New("Incomplete delta literal")
+			}
+			delta = append(delta, fs.Operation{Literal: msg[index : index+int(n)]})
+			index += int(n)
+		default:
+			return fmt.Errorf("Unknown delta operation: %d", kind)
+		}
+	}
+
+	dc.MessageSize = totalSize
+	dc.Delta = delta
+	dc.FileID = fileID
+	return nil
+}
+
+// Recv calls RecvMessage to receive a complete DeltaContent
+func (dc *DeltaContent) Recv(s *bufio.Reader) ([]byte, error) {
+	return RecvMessage(s, dc)
+}
+
+// Size returns the total size of the message
+func (dc DeltaContent) Size(msg []byte) uint64 {
+	return uint64FromBytes(msg[sizeOfMessageType : sizeOfMessageType+sizeOfMessage])
+}
+
+// Type returns the type of the Message (MTDeltaContent)
+func (dc DeltaContent) Type() MessageType {
+	return MTDeltaContent
+}
+
+/* Delta request */
+
+// DeltaRequest is used to ask for the changes made to a file the receiver
+// has an old copy of
+type DeltaRequest struct {
+	MessageSize uint64       // total size of the message
+	FileID      uuid.UUID    // ID of the file
+	FilePath    string       // relative path of the file
+	Signature   fs.Signature // describes the old copy of the file
+}
+
+// Dump creates a byte array: {MessageType, MessageSize, FileID,
+// FilePathSize, FilePath, Signature}, the signature is marshalled to JSON
+func (dr DeltaRequest) Dump() []byte {
+	signature, _ := json.Marshal(dr.Signature)
+	encodedPath := []byte(dr.FilePath)
+	dump := append(dr.FileID.Bytes(), uint16ToBytes(uint16(len(encodedPath)))...)
+	dump = append(dump, encodedPath...)
+	dump = append(dump, signature...)
+	totalLen := uint64(len(dump) + sizeOfMessageType + sizeOfMessage)
+	cDump := []byte{byte(dr.Type())}
+	cDump = append(cDump, uint64ToBytes(totalLen)...)
+	return append(cDump, dump...)
+}
+
+// Load reads fileID, filePath and the signature from a byte slice created
+// by dr.Dump()
+func (dr *DeltaRequest) Load(msg []byte) error {
+	index := 0
+	headerSize := sizeOfMessageType + sizeOfMessage + sizeOfFileID + sizeOfFilePathSize
+
+	if len(msg) < headerSize || MessageType(msg[0]) != MTDeltaRequest {
+		return errors.New("Invalid message type")
+	}
+	index += sizeOfMessageType
+
+	totalSize := dr.Size(msg)
+	if uint64(len(msg)) != totalSize {
+		return fmt.Errorf("Invalid DeltaRequest dump, expected %dB got %dB", totalSize, len(msg))
+	}
+	index += sizeOfMessage
+
+	// file id
+	fileID, err := uuid.FromBytes(msg[index : index+sizeOfFileID])
+	if err != nil {
+		return err
+	}
+	index += sizeOfFileID
+
+	// filepath
+	filePathSize := int(uint16FromBytes(msg[index : index+sizeOfFilePathSize]))
+	index += sizeOfFilePathSize
+	if len(msg) < index+filePathSize {
+		return errors.New("Incomplete message content")
+	}
+	filePath := string(msg[index : index+filePathSize])
+	index += filePathSize
+
+	// signature
+	var signature fs.Signature
+	if err = json.Unmarshal(msg[index:], &signature); err != nil {
+		return err
+	}
+
+	dr.MessageSize = totalSize
+	dr.FileID = fileID
+	dr.FilePath = filePath
+	dr.Signature = signature
+	return nil
+}
+
+// Recv calls RecvMessage to receive a complete DeltaRequest
+func (dr *DeltaRequest) Recv(s *bufio.Reader) ([]byte, error) {
+	return RecvMessage(s, dr)
+}
+
+// Size returns the total size of the message
+func (dr DeltaRequest) Size(msg []byte) uint64 {
+	return uint64FromBytes(msg[sizeOfMessageType : sizeOfMessageType+sizeOfMessage])
+}
+
+// Type returns the type of the Message (MTDeltaRequest)
+func (dr DeltaRequest) Type() MessageType {
+	return MTDeltaRequest
+}
+
 /* Index content */
 
 // IndexContent is used to send the fs.Index of a directory to a peer
 type IndexContent struct {
 	MessageSize uint64 // total size of the message
+	Encoding    string // fs.IndexEncodingJSON, the default, or fs.IndexEncodingBinary
 	Index       fs.Index
 }
 
@@ -210,12 +431,16 @@ type IndexContent struct {
 // The first byte contains the MessageType, the rest of them contained a
 // marshalled fs.Index
 func (ic IndexContent) Dump() []byte {
-	index, _ := json.Marshal(ic.Index)
-	dump := append([]byte{byte(MTIndexContent)}, uint64ToBytes(uint64(len(index)+sizeOfMessageType+sizeOfMessage))...)
-	return append(dump, index...)
+	var index bytes.Buffer
+	if err := fs.EncodeIndex(&index, &ic.Index, ic.Encoding); err != nil {
+		return nil
+	}
+	dump := append([]byte{byte(MTIndexContent)}, uint64ToBytes(uint64(index.Len()+sizeOfMessageType+sizeOfMessage))...)
+	return append(dump, index.Bytes()...)
 }
 
-// Load creates a fs.Index given a MTIndexContent message
+// Load creates a fs.Index given a MTIndexContent message, the encoding of
+// the Index is detected
 func (ic *IndexContent) Load(msg []byte) error {
 	index := 0
 	headerSize := sizeOfMessageType + sizeOfMessage
@@ -233,10 +458,13 @@ func (ic *IndexContent) Load(msg []byte) error {
 	if uint64(len(msg)) != totalSize {
 		return fmt.Errorf("Invalid BlockContent dump, expected %dB got %dB", totalSize, len(msg))
 	}
-	if err := json.Unmarshal(msg[index:], &ic.Index); err != nil {
+	i, encoding, err := fs.DecodeIndex(bytes.NewReader(msg[index:]))
+	if err != nil {
 		return err
 	}
 
+	ic.Encoding = encoding
+	ic.Index = *i
 	ic.MessageSize = totalSize
 	return nil
 }
@@ -256,6 +484,23 @@ func (ic IndexContent) Type() MessageType {
 	return MTIndexContent
 }
 
+// WriteTo writes the same bytes as Dump to w without keeping the encoded
+// Index in memory. The Index is encoded twice, first to find its size
+func (ic IndexContent) WriteTo(w io.Writer) (int64, error) {
+	size := new(countingWriter)
+	if err := fs.EncodeIndex(size, &ic.Index, ic.Encoding); err != nil {
+		return 0, err
+	}
+	header := append([]byte{byte(MTIndexContent)}, uint64ToBytes(uint64(size.n)+uint64(sizeOfMessageType+sizeOfMessage))...)
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+	counted := &countingWriter{w: w}
+	err = fs.EncodeIndex(counted, &ic.Index, ic.Encoding)
+	return int64(n) + counted.n, err
+}
+
 /* Index request */
 
 // IndexRequest is used to ask a Peer for the index of it's assigned directory
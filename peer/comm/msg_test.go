@@ -1,6 +1,8 @@
 package comm
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -34,6 +36,14 @@ func TestMessageTypeFromBytes(t *testing.T) {
 	if mt, err := MessageTypeFromBytes(ir.Dump()); err != nil || *mt != MTIndexRequest {
 		t.FailNow()
 	}
+	dc := DeltaContent{}
+	dr := DeltaRequest{}
+	if mt, err := MessageTypeFromBytes(dc.Dump()); err != nil || *mt != MTDeltaContent {
+		t.FailNow()
+	}
+	if mt, err := MessageTypeFromBytes(dr.Dump()); err != nil || *mt != MTDeltaRequest {
+		t.FailNow()
+	}
 }
 
 /* Block content */
@@ -41,7 +51,7 @@ func TestMessageTypeFromBytes(t *testing.T) {
 // testBlockContent_Dump checks that the dumped slice has the expected length
 func testBlockContentDump(t *testing.T, bc BlockContent) {
 	d := bc.Dump()
-	if len(d) != 28+len(bc.Content) || MessageType(d[0]) != MTBlockContent {
+	if len(d) != 36+len(bc.Content) || MessageType(d[0]) != MTBlockContent {
 		t.FailNow()
 	}
 }
@@ -59,6 +69,9 @@ func testBlockContentLoad(t *testing.T, bc BlockContent) {
 	// if !reflect.DeepEqual(*bcLoaded, bc) {
 	// 	t.FailNow()
 	// }
+	if bcLoaded.BlockN != bc.BlockN {
+		t.FailNow()
+	}
 
 	/* error cases */
 	if err = bc.Load([]byte{}); err == nil {
@@ -89,6 +102,47 @@ func TestBlockContent(t *testing.T) {
 
 	testBlockContentDump(t, bc)
 	testBlockContentLoad(t, bc)
+
+	// block numbers bigger than a byte
+	bc.BlockN = 256
+	bc.Content = make([]byte, 1024)
+	testBlockContentDump(t, bc)
+	testBlockContentLoad(t, bc)
+}
+
+// TestBlockContent_Codec sends compressible and incompressible blocks
+func TestBlockContent_Codec(t *testing.T) {
+	id, _ := uuid.NewV4()
+	text := bytes.Repeat([]byte("sakaban "), 1024)
+	bc := BlockContent{BlockSize: 8, Codec: CodecZstd, Content: text, FileID: id}
+	dump := bc.Dump()
+	if len(dump) >= 36+len(text) {
+		t.FailNow()
+	}
+	loaded := BlockContent{}
+	if err := loaded.Load(dump); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Codec != CodecZstd || !bytes.Equal(loaded.Content, text) {
+		t.FailNow()
+	}
+
+	// random content doesn't shrink and is sent uncompressed
+	bc.Content = make([]byte, 8*1024)
+	rand.Read(bc.Content)
+	if err := loaded.Load(bc.Dump()); err != nil || loaded.Codec != CodecNone {
+		t.FailNow()
+	}
+	if !bytes.Equal(loaded.Content, bc.Content) {
+		t.FailNow()
+	}
+
+	// decompressed content bigger than the block size
+	bc.Content = text
+	bc.BlockSize = 1
+	if err := loaded.Load(bc.Dump()); err == nil {
+		t.FailNow()
+	}
 }
 
 func TestBlockContent_Type(t *testing.T) {
@@ -103,22 +157,24 @@ func TestBlockContent_Type(t *testing.T) {
 func testBlockRequestDump(t *testing.T, br BlockRequest) {
 	d := br.Dump()
 	br.FilePathSize = uint16(len(br.FilePath))
-	if len(d) != 20+int(br.FilePathSize) || MessageType(d[0]) != MTBlockRequest {
+	if len(d) != 28+int(br.FilePathSize) || MessageType(d[0]) != MTBlockRequest {
 		t.FailNow()
 	}
 }
 
 func testBlockRequestLoad(t *testing.T, br BlockRequest) {
 	b := br.Dump()
-	if err := br.Load(b); err != nil {
+	blockN := br.BlockN
+	if err := br.Load(b); err != nil || br.BlockN != blockN {
 		t.FailNow()
 	}
 
 	/* error case */
 	wrongFilePathSize := make([]byte, 2)
 	binary.LittleEndian.PutUint16(wrongFilePathSize, uint16(0))
-	b1 := b[0:18]
-	b2 := b[20 : 20+br.FilePathSize]
+	pathIndex := 1 + sizeOfBlockN + sizeOfCodec + 16
+	b1 := b[0:pathIndex]
+	b2 := b[pathIndex+2 : pathIndex+2+int(br.FilePathSize)]
 	b = append(b1, wrongFilePathSize...)
 	b = append(b, b2...)
 
@@ -133,10 +189,19 @@ func testBlockRequestLoad(t *testing.T, br BlockRequest) {
 
 func TestBlockRequest(t *testing.T) {
 	id, _ := uuid.NewV4()
-	br := BlockRequest{BlockN: 0, FileID: id, FilePath: "filepath"}
+	br := BlockRequest{BlockN: 0, Codecs: SupportedCodecs, FileID: id, FilePath: "filepath"}
 
 	testBlockRequestDump(t, br)
 	testBlockRequestLoad(t, br)
+	loaded := BlockRequest{}
+	if err := loaded.Load(br.Dump()); err != nil || loaded.Codecs != SupportedCodecs {
+		t.FailNow()
+	}
+
+	// block numbers bigger than 32 bits
+	br.BlockN = 1 << 40
+	testBlockRequestDump(t, br)
+	testBlockRequestLoad(t, br)
 }
 
 func TestBlockRequest_Type(t *testing.T) {
@@ -146,6 +211,98 @@ func TestBlockRequest_Type(t *testing.T) {
 	}
 }
 
+/* Delta content */
+
+func TestDeltaContent(t *testing.T) {
+	id, _ := uuid.NewV4()
+	dc := DeltaContent{FileID: id, Delta: fs.Delta{
+		{BlockN: 1 << 40},
+		{Literal: []byte("literal")},
+		{Literal: []byte{}},
+		{BlockN: 0},
+	}}
+	dump := dc.Dump()
+	// header + 4 operations + literals
+	if len(dump) != 25+4*9+7 || MessageType(dump[0]) != MTDeltaContent {
+		t.FailNow()
+	}
+	loaded := DeltaContent{}
+	if err := loaded.Load(dump); err != nil || loaded.FileID != id {
+		t.FailNow()
+	}
+	if len(loaded.Delta) != len(dc.Delta) {
+		t.FailNow()
+	}
+	for i, op := range loaded.Delta {
+		if op.BlockN != dc.Delta[i].BlockN ||
+			(op.Literal == nil) != (dc.Delta[i].Literal == nil) ||
+			string(op.Literal) != string(dc.Delta[i].Literal) {
+			t.FailNow()
+		}
+	}
+
+	/* error cases */
+	if err := loaded.Load(dump[:len(dump)-1]); err == nil {
+		t.FailNow()
+	}
+	if err := loaded.Load(dump[1:]); err == nil {
+		t.FailNow()
+	}
+	// literal longer than the message
+	dump[sizeOfMessageType+sizeOfMessage+sizeOfFileID+sizeOfOperation+1] = 0xFF
+	if err := loaded.Load(dump); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestDeltaContent_Type(t *testing.T) {
+	dc := new(DeltaContent)
+	if dc.Type() != MTDeltaContent {
+		t.FailNow()
+	}
+}
+
+/* Delta request */
+
+func TestDeltaRequest(t *testing.T) {
+	id, _ := uuid.NewV4()
+	dr := DeltaRequest{FileID: id, FilePath: "filepath", Signature: fs.Signature{
+		BlockSize: fs.MinBlockSize,
+		Hash:      fs.HashSHA256,
+		Size:      10,
+		Weak:      []uint32{42},
+		Strong:    []string{"strong"},
+	}}
+	dump := dr.Dump()
+	if MessageType(dump[0]) != MTDeltaRequest {
+		t.FailNow()
+	}
+	loaded := DeltaRequest{}
+	if err := loaded.Load(dump); err != nil {
+		t.FailNow()
+	}
+	if loaded.FileID != id || loaded.FilePath != dr.FilePath ||
+		loaded.Signature.Size != 10 || loaded.Signature.Weak[0] != 42 ||
+		loaded.Signature.Strong[0] != "strong" {
+		t.FailNow()
+	}
+
+	/* error cases */
+	if err := loaded.Load(dump[:len(dump)-1]); err == nil {
+		t.FailNow()
+	}
+	if err := loaded.Load([]byte{}); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestDeltaRequest_Type(t *testing.T) {
+	dr := new(DeltaRequest)
+	if dr.Type() != MTDeltaRequest {
+		t.FailNow()
+	}
+}
+
 /* Index content*/
 
 func testIndexContentDump(t *testing.T, ic IndexContent) {
@@ -185,6 +342,30 @@ func TestIndexContent(t *testing.T) {
 
 	testIndexContentDump(t, ic)
 	testIndexContentLoad(t, ic)
+	testIndexContentWriteTo(t, ic)
+
+	// binary indices are detected when they are loaded
+	ic.Encoding = fs.IndexEncodingBinary
+	dump := ic.Dump()
+	if len(dump) >= len(IndexContent{Index: *index}.Dump()) {
+		t.FailNow()
+	}
+	loaded := new(IndexContent)
+	if err = loaded.Load(dump); err != nil || loaded.Encoding != fs.IndexEncodingBinary ||
+		!loaded.Index.Equals(index) || loaded.Index.Files[s.Path].Digest != s.Digest {
+		t.FailNow()
+	}
+	testIndexContentLoad(t, ic)
+	testIndexContentWriteTo(t, ic)
+}
+
+// testIndexContentWriteTo checks that WriteTo writes the same as Dump
+func testIndexContentWriteTo(t *testing.T, ic IndexContent) {
+	var buf bytes.Buffer
+	n, err := ic.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), ic.Dump()) {
+		t.FailNow()
+	}
 }
 
 func TestIndexContent_Type(t *testing.T) {
@@ -4,8 +4,27 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"io"
 )
 
+// countingWriter counts the bytes written to w, which may be nil to only
+// count them
+type countingWriter struct {
+	n int64
+	w io.Writer
+}
+
+// Write writes b to cw.w and counts the written bytes
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.w == nil {
+		cw.n += int64(len(b))
+		return len(b), nil
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
 // EmptyMessageFromMessageType returns an empty message given a message type
 func EmptyMessageFromMessageType(msgType MessageType) (Message, error) {
 	var msg Message
@@ -14,6 +33,10 @@ func EmptyMessageFromMessageType(msgType MessageType) (Message, error) {
 		msg = &BlockContent{}
 	case MTBlockRequest:
 		msg = &BlockRequest{}
+	case MTDeltaContent:
+		msg = &DeltaContent{}
+	case MTDeltaRequest:
+		msg = &DeltaRequest{}
 	case MTIndexContent:
 		msg = &IndexContent{}
 	case MTIndexRequest:
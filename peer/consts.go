@@ -11,5 +11,6 @@ const (
 	listenMultiAddr = "/ip4/0.0.0.0/tcp/3001"
 	permissionDir   = 0750
 	permissionFile  = 0750
-	protocolID      = "/sakaban/v0.0.0"
+	protocolID      = "/sakaban/v0.2.0"
+	protocolIDV0    = "/sakaban/v0.0.0" // FNV hashes and 8 bit block numbers, unsupported
 )
@@ -9,10 +9,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"bitbucket.org/mikelsr/sakaban-broker/auth"
 	"bitbucket.org/mikelsr/sakaban-broker/broker"
@@ -37,6 +40,7 @@ type Peer struct {
 	Contacts   []Contact                 `json:"contacts"` // List of trusted contacts
 	fileMap    map[string]*RequestedFile // Expected files mapped by fileID
 	Host       host.Host                 `json:"-"` // Host is the libp2p host
+	indices    map[string]*fs.Index      // Last index received from each contact, see PruneIndex
 	waiting    bool                      /* true if an index was requested and has not yet been
 	received */
 
@@ -45,8 +49,10 @@ type Peer struct {
 	PubKey *rsa.PublicKey  `json:"-"`
 
 	// fs
-	RootDir   string   `json:"root_dir"` // Directory to be synchronized
-	RootIndex fs.Index // Index of RootDir
+	RootDir   string       `json:"root_dir"` // Directory to be synchronized
+	RootIndex fs.Index     // Index of RootDir, see rootIndex and modifyIndex
+	mutex     sync.RWMutex // guards RootIndex
+	watcher   *fs.Watcher  // keeps RootIndex up to date, see Watch
 }
 
 // BrokerAddr returns the formatted address of the broker assigned to the peer
@@ -62,11 +68,16 @@ func CleanUp(dir string) {
 }
 
 // ConnectTo stablishes connection with another peer and returns the net.Stream
-func (p Peer) ConnectTo(c Contact) (net.Stream, error) {
-	s, err := p.Host.NewStream(context.Background(), c.ID(), protocolID)
+// peers that only speak the v0 protocol are rejected with an explicit error
+func (p *Peer) ConnectTo(c Contact) (net.Stream, error) {
+	s, err := p.Host.NewStream(context.Background(), c.ID(), protocolID, protocolIDV0)
 	if err != nil {
 		return nil, err
 	}
+	if string(s.Protocol()) == protocolIDV0 {
+		s.Close()
+		return nil, unsupportedProtocol(c.ID().String())
+	}
 	return s, nil
 }
 
@@ -113,7 +124,6 @@ func (p *Peer) HandleStream(s net.Stream) {
 	if err != nil {
 		panic(err)
 	}
-
 	recv, err := msg.Recv(buf)
 	if err != nil {
 		panic(err)
@@ -142,6 +152,13 @@ func Import(dir string) (*Peer, error) {
 	return p, nil
 }
 
+// Listen sets Peer.HandleStream as the handler of the current protocol and
+// rejects the v0 protocol
+func (p *Peer) Listen() {
+	p.Host.SetStreamHandler(protocolID, p.HandleStream)
+	p.Host.SetStreamHandler(protocolIDV0, p.handleLegacyStream)
+}
+
 // NewPeer creates a peer with a NEW PAIR OF KEYS
 // for creating a peer with an existing pair of keys, use MakePeer
 func NewPeer() (*Peer, error) {
@@ -189,6 +206,25 @@ func NewPeer() (*Peer, error) {
 	}, nil
 }
 
+// PruneIndex removes the parents and deletions of p.RootIndex its
+// retention policy doesn't keep and returns how many were removed. The
+// last index received from each contact confirms what is no longer used
+func (p *Peer) PruneIndex() int {
+	contacts := make([]*fs.Index, len(p.Contacts))
+	for n, c := range p.Contacts {
+		contacts[n] = p.indices[c.ID().String()]
+	}
+	pruned := 0
+	p.modifyIndex(func(i *fs.Index) {
+		pruned = i.Prune(i.Config.Retention, time.Now(), contacts...)
+	})
+	if pruned > 0 {
+		p.saveIndex()
+		p.collectGarbage()
+	}
+	return pruned
+}
+
 // Register updates info about peer 'p' at the Broker
 func (p *Peer) Register() error {
 	// create client
@@ -250,11 +286,38 @@ func (p *Peer) Register() error {
 	return nil
 }
 
-// ReloadIndex updates p.RootIndex by scanning p.RootDir
-func (p *Peer) ReloadIndex() {
-	scanner, _ := fs.MakeScanner(p.RootDir)
-	scanner.Scan(scanner.Root)
-	p.RootIndex = *scanner.NewIndex
+// ReloadIndex updates p.RootIndex by scanning p.RootDir with its Config,
+// the changes are recorded in the versions of the summaries. The Index
+// stored in p.RootDir is only read the first time. p.RootIndex is left
+// untouched if p.RootDir can't be scanned
+func (p *Peer) ReloadIndex() error {
+	release := p.holdStore()
+	var err error
+	p.modifyIndex(func(i *fs.Index) {
+		old := i.Copy()
+		if i.Files == nil {
+			old, _ = fs.MakeIndex()
+			if fs.SummaryExists(p.RootDir) {
+				if old, err = fs.ReadRootIndex(p.RootDir); err != nil {
+					return
+				}
+			}
+		}
+		var scanner *fs.Scanner
+		if scanner, err = fs.MakeScannerWithIndex(p.RootDir, old, nil); err != nil {
+			return
+		}
+		// unchanged files are compared with the summaries they were
+		// rehashed to
+		*i = *fs.Update(scanner.OldIndex, scanner.NewIndex)
+	})
+	release()
+	if err != nil {
+		return err
+	}
+	p.saveIndex()
+	p.collectGarbage()
+	return nil
 }
 
 // RequestBlock requests a block from a beer and writes it to c
@@ -263,22 +326,73 @@ func (p *Peer) ReloadIndex() {
 //	filepath:	path of the file the block belongs
 //	provider:	contact to request the block from
 //	c:		receiving channel
-func (p *Peer) RequestBlock(blockN uint8, fileID uuid.UUID, filepath string, provider Contact, c chan error) {
+func (p *Peer) RequestBlock(blockN uint64, fileID uuid.UUID, filepath string, provider Contact, c chan error) {
+	s, err := p.ConnectTo(provider)
+	if err != nil {
+		c <- err
+		return
+	}
 	br := comm.BlockRequest{
 		BlockN:   blockN,
+		Codecs:   comm.SupportedCodecs,
 		FileID:   fileID,
 		FilePath: filepath,
 	}
-	s, err := p.ConnectTo(provider)
-	if err != nil {
-		c <- err
-	}
 	if _, err = s.Write(br.Dump()); err != nil {
 		c <- err
+		return
 	}
 	c <- nil
 }
 
+// RequestDelta sends the signature of the local copy of a file to a peer,
+// which replies with the changes made to it, and rebuilds the file
+//	fileID:		id of the requested file
+//	filepath:	path of the file
+//	provider:	contact to request the delta from
+func (p *Peer) RequestDelta(fileID uuid.UUID, filepath string, provider Contact) error {
+	requestedFile, found := p.fileMap[fileID.String()]
+	if !found || requestedFile == nil {
+		return fmt.Errorf("File %s was not requested", fileID.String())
+	}
+	algorithm := requestedFile.summary.Hash
+	if !fs.StrongHash(algorithm) {
+		algorithm = fs.DefaultHash
+	}
+	signature, err := fs.MakeSignature(requestedFile.file.Path,
+		requestedFile.file.BlockSize, algorithm)
+	if err != nil {
+		return err
+	}
+	requestedFile.signature = signature
+
+	s, err := p.ConnectTo(provider)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	dr := comm.DeltaRequest{
+		FileID:    fileID,
+		FilePath:  filepath,
+		Signature: *signature,
+	}
+	dump := dr.Dump()
+	if _, err = s.Write(dump); err != nil {
+		return err
+	}
+
+	// the delta is sent back through the same stream
+	dc := new(comm.DeltaContent)
+	msg, err := dc.Recv(bufio.NewReader(s))
+	if err != nil {
+		return err
+	}
+	if err = dc.Load(msg); err != nil {
+		return err
+	}
+	return p.handleRequestMTDeltaContent(s, dc)
+}
+
 // RequestPeer obtains info about a peer from a broker given the public key
 // of the peer
 func (p *Peer) RequestPeer(publicKey string) (*Contact, error) {
@@ -318,3 +432,148 @@ func (p *Peer) SetRootDir(dir string) error {
 	p.RootDir = dir
 	return nil
 }
+
+// StopWatching stops updating p.RootIndex after Watch, once it returns
+// RootIndex is only changed by the peer
+func (p *Peer) StopWatching() error {
+	p.mutex.RLock()
+	w := p.watcher
+	p.mutex.RUnlock()
+	if w == nil {
+		return nil
+	}
+	// the watcher updates RootIndex until it is closed
+	err := w.Close()
+	p.mutex.Lock()
+	p.watcher = nil
+	p.mutex.Unlock()
+	return err
+}
+
+// Watch keeps p.RootIndex up to date with the changes made to p.RootDir
+// until StopWatching is called, instead of scanning it with ReloadIndex
+func (p *Peer) Watch() error {
+	// blocks stored by the first scan are kept until the watcher is set
+	release := p.holdStore()
+	defer release()
+	// a single watcher is started and its first Index can't replace a
+	// later one, as the callback waits for the lock
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.watcher != nil {
+		return nil
+	}
+	i := p.RootIndex
+	w, err := fs.NewWatcher(p.RootDir, &i, func(i *fs.Index, err error) {
+		if err != nil {
+			log.Printf("[P]\tError watching %s: %s", p.RootDir, err)
+			return
+		}
+		p.mutex.Lock()
+		p.RootIndex = *i
+		p.mutex.Unlock()
+		p.saveIndex()
+		// the watcher holds the store until this function returns
+		go p.collectGarbage()
+	})
+	if err != nil {
+		return err
+	}
+	p.RootIndex = *w.Index()
+	p.watcher = w
+	w.Start()
+	return nil
+}
+
+// collectGarbage removes the blocks of the store no summary of the current
+// Index uses, such as those of deleted files or pruned parents, once no one
+// holds the store. Without the store enabled it only holds the blocks of
+// merged files
+func (p *Peer) collectGarbage() {
+	if _, err := os.Stat(filepath.Join(p.RootDir, fs.SummaryDir, fs.StoreDir)); err != nil {
+		return
+	}
+	store, err := fs.OpenStore(p.RootDir)
+	if err == nil {
+		_, err = store.GC(p.currentIndex)
+	}
+	if err != nil {
+		log.Printf("[P]\tError removing unused blocks of %s: %s", p.RootDir, err)
+	}
+}
+
+// currentIndex returns the most recent Index of p.RootDir, which is the one
+// of the watcher while it is watched
+func (p *Peer) currentIndex() *fs.Index {
+	p.mutex.RLock()
+	w := p.watcher
+	p.mutex.RUnlock()
+	if w != nil {
+		return w.Index()
+	}
+	i := p.rootIndex()
+	return &i
+}
+
+// handleLegacyStream answers peers using the v0 protocol, whose indices
+// can't hold the current summaries, with an explicit error
+func (p *Peer) handleLegacyStream(s net.Stream) {
+	defer s.Close()
+	err := unsupportedProtocol(s.Conn().RemotePeer().String())
+	log.Printf("[P]\t%s", err)
+	s.Write([]byte(err.Error()))
+}
+
+// holdStore keeps collectGarbage from removing blocks until release is
+// called, see fs.Store.Hold. Nothing is held if the store is disabled
+func (p *Peer) holdStore() (release func()) {
+	if i := p.rootIndex(); !i.Config.Store {
+		return func() {}
+	}
+	store, err := fs.OpenStore(p.RootDir)
+	if err != nil {
+		return func() {}
+	}
+	return store.Hold()
+}
+
+// modifyIndex applies f to a copy of p.RootIndex that replaces it. While
+// p.RootDir is watched the Watcher makes the change, so it isn't undone by
+// its next update
+func (p *Peer) modifyIndex(f func(*fs.Index)) {
+	p.mutex.RLock()
+	w := p.watcher
+	p.mutex.RUnlock()
+	if w != nil {
+		w.Modify(f)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i := p.RootIndex.Copy()
+	f(i)
+	p.RootIndex = *i
+}
+
+// rootIndex returns p.RootIndex, which is replaced instead of modified so
+// it can be read after the lock is released
+func (p *Peer) rootIndex() fs.Index {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.RootIndex
+}
+
+// saveIndex writes p.RootIndex to p.RootDir, so the history of the files
+// isn't lost when the peer is restarted
+func (p *Peer) saveIndex() {
+	if err := fs.WriteRootIndex(p.rootIndex(), p.RootDir); err != nil {
+		log.Printf("[P]\tError writing the index of %s: %s", p.RootDir, err)
+	}
+}
+
+// unsupportedProtocol is the error given to and about peers that only speak
+// the v0 protocol
+func unsupportedProtocol(peerID string) error {
+	return fmt.Errorf("Unsupported protocol version: peer %s uses %s, %s is required",
+		peerID, protocolIDV0, protocolID)
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"bitbucket.org/mikelsr/sakaban/fs"
 	"bitbucket.org/mikelsr/sakaban/peer/comm"
@@ -27,6 +28,18 @@ func (p *Peer) handleRequest(s net.Stream, msgType comm.MessageType, msg []byte)
 			return errors.New("Error unmarshalling BlockRequest")
 		}
 		return p.handleRequestMTBlockRequest(s, br)
+	case comm.MTDeltaContent:
+		dc := new(comm.DeltaContent)
+		if err := dc.Load(msg); err != nil {
+			return errors.New("Error unmarshalling DeltaContent")
+		}
+		return p.handleRequestMTDeltaContent(s, dc)
+	case comm.MTDeltaRequest:
+		dr := new(comm.DeltaRequest)
+		if err := dr.Load(msg); err != nil {
+			return errors.New("Error unmarshalling DeltaRequest")
+		}
+		return p.handleRequestMTDeltaRequest(s, dr)
 	case comm.MTIndexContent:
 		ic := new(comm.IndexContent)
 		if err := ic.Load(msg); err != nil {
@@ -69,51 +82,114 @@ func (p *Peer) handleRequestMTBlockContent(s net.Stream, bc *comm.BlockContent)
 			file.ID.String(), eid)
 	}
 
-	if bc.BlockN > uint8(len(summary.Blocks)) {
+	// block was cut with the expected size
+	chunker, err := fs.GetChunker(summary.Chunker, summary.BlockSize)
+	if err != nil {
+		return err
+	}
+	if blockSize := uint16(chunker.MaxSize() / 1024); bc.BlockSize != blockSize {
+		return fmt.Errorf("Block sizes do not match: expected %dkB got %dkB",
+			blockSize, bc.BlockSize)
+	}
+
+	if bc.BlockN >= uint64(len(summary.Blocks)) {
 		return fmt.Errorf("Block index out of range: max is %d got %d",
-			len(file.Blocks), bc.BlockN)
+			len(summary.Blocks)-1, bc.BlockN)
+	}
+
+	if !requestedFile.pending[bc.BlockN] {
+		return fmt.Errorf("Block %d was unchanged or already received", bc.BlockN)
 	}
 
-	if summary.Blocks[bc.BlockN] == 0 {
-		return fmt.Errorf("Block %d was unchanged", bc.BlockN)
+	// verify the content of the block, decompressed by Load
+	if !fs.StrongHash(summary.Hash) {
+		return fmt.Errorf("File %s was not indexed with a cryptographic hash", eid)
+	}
+	block := &fs.Block{Content: bc.Content}
+	if block.HashWith(summary.Hash) != summary.Blocks[bc.BlockN] {
+		return fmt.Errorf("Hash of block %d does not match", bc.BlockN)
 	}
 
-	file.Blocks[bc.BlockN] = &fs.Block{Content: bc.Content}
+	requestedFile.receive(bc.BlockN, block)
 
 	// if file is not complete, return
-	for i := range file.Blocks {
-		if i != 0 {
-			if file.Blocks[i] == nil {
-				return nil
-			}
-		}
+	if len(requestedFile.Missing()) != 0 {
+		return nil
+	}
+	// concurrent changes are merged once every block is in the store
+	if requestedFile.merge {
+		p.fileMap[eid] = nil
+		return p.mergeFile(requestedFile)
+	}
+	// the whole file must match its digest before it replaces the local one
+	if summary.Digest == "" {
+		delete(p.fileMap, eid)
+		return fmt.Errorf("File %s has no digest", eid)
+	}
+	// links may have been created since the file was requested
+	if _, err := fs.SafePath(p.RootDir, summary.Path); err != nil {
+		delete(p.fileMap, eid)
+		return err
 	}
-	file.Write()
+	// the summary of the contact is indexed with the file, unchanged blocks
+	// are missing from the requested one
+	remote, err := p.remoteSummary(requestedFile)
+	if err != nil {
+		delete(p.fileMap, eid)
+		return err
+	}
+	if err := file.WriteVerified(remote); err != nil {
+		delete(p.fileMap, eid)
+		return fmt.Errorf("File %s was rebuilt incorrectly: %s", eid, err)
+	}
+	p.recordFiles(remote)
 	p.fileMap[file.ID.String()] = nil
+	if i := p.rootIndex(); i.Config.Store {
+		return p.storeFile(requestedFile)
+	}
 	return nil
 }
 
 func (p *Peer) handleRequestMTBlockRequest(s net.Stream, br comm.BlockRequest) error {
-	absPath := filepath.Join(p.RootDir, br.FilePath)
+	absPath, err := fs.AbsPath(p.RootDir, br.FilePath)
+	if err != nil {
+		return err
+	}
 	prettyID := p.Host.ID().Pretty()
 	prettyID = prettyID[len(prettyID)-4:]
-	if s, found := p.RootIndex.Files[absPath]; !found || s.ID != br.FileID.String() {
-		return errors.New("File not found")
+	i := p.rootIndex()
+	summary, found := i.Files[br.FilePath]
+	if !found || summary.ID != br.FileID.String() {
+		// older versions of the file can only be served from the store
+		summary, found = i.Parents[br.FileID.String()]
+		if !found || !i.Config.Store {
+			return errors.New("File not found")
+		}
 	}
-	f, err := fs.MakeFile(absPath)
+	chunker, err := fs.GetChunker(summary.Chunker, summary.BlockSize)
 	if err != nil {
-		return errors.New("Error loading file")
+		return err
 	}
-	if len(f.Blocks) <= int(br.BlockN) {
+	if uint64(len(summary.Blocks)) <= br.BlockN {
 		return errors.New("Invalid block number")
 	}
-	log.Printf("[P_%s]\tFile loaded: %s", prettyID, absPath)
-	blockSize := fs.BlockSize / 1024
+	block, err := p.readBlock(absPath, summary, int(br.BlockN))
+	if err != nil {
+		return errors.New("Error loading block")
+	}
+	log.Printf("[P_%s]\tBlock %d loaded: %s", prettyID, br.BlockN, absPath)
+	blockSize := chunker.MaxSize() / 1024
+	// compress the block with a codec accepted by the requester
+	codec := br.Codecs.Preferred()
+	if block.IsZero() && br.Codecs.Has(comm.CodecZero) {
+		codec = comm.CodecZero
+	}
 	bc := comm.BlockContent{
 		BlockN:    br.BlockN,
 		BlockSize: uint16(blockSize),
-		Content:   f.Blocks[br.BlockN].Content,
-		FileID:    f.ID,
+		Codec:     codec,
+		Content:   block.Content,
+		FileID:    br.FileID,
 	}
 	raw := bc.Dump()
 	log.Printf("[P_%s]\tSending block %d of file: %s", prettyID, bc.BlockN, absPath)
@@ -123,6 +199,72 @@ func (p *Peer) handleRequestMTBlockRequest(s net.Stream, br comm.BlockRequest) e
 	return nil
 }
 
+func (p *Peer) handleRequestMTDeltaContent(s net.Stream, dc *comm.DeltaContent) error {
+	eid := dc.FileID.String()
+	requestedFile, found := p.fileMap[eid]
+	if !found || requestedFile == nil {
+		return fmt.Errorf("Didn't expect a delta of file %s", eid)
+	}
+
+	// delta comes from expected peer
+	if s.Conn().RemotePeer().String() != requestedFile.contact.ID().String() {
+		return errors.New("Delta from unexpected peer")
+	}
+	if requestedFile.signature == nil {
+		return fmt.Errorf("Delta of file %s was not requested", eid)
+	}
+
+	// the rebuilt file is verified before replacing the old copy
+	summary := requestedFile.summary
+	if !fs.StrongHash(summary.Hash) {
+		return fmt.Errorf("File %s was not indexed with a cryptographic hash", eid)
+	}
+	// blocks the delta copies from the local file are only checked by the digest
+	if summary.Digest == "" {
+		return fmt.Errorf("File %s has no digest", eid)
+	}
+	if _, err := fs.SafePath(p.RootDir, summary.Path); err != nil {
+		return err
+	}
+	remote, err := p.remoteSummary(requestedFile)
+	if err != nil {
+		return err
+	}
+	file := requestedFile.file
+	if err := file.WriteDelta(dc.Delta, requestedFile.signature.BlockSize, remote); err != nil {
+		return err
+	}
+	p.recordFiles(remote)
+	delete(p.fileMap, eid)
+	return nil
+}
+
+func (p *Peer) handleRequestMTDeltaRequest(s net.Stream, dr *comm.DeltaRequest) error {
+	absPath, err := fs.AbsPath(p.RootDir, dr.FilePath)
+	if err != nil {
+		return err
+	}
+	prettyID := p.Host.ID().Pretty()
+	prettyID = prettyID[len(prettyID)-4:]
+	i := p.rootIndex()
+	summary, found := i.Files[dr.FilePath]
+	if !found || summary.ID != dr.FileID.String() {
+		return errors.New("File not found")
+	}
+	delta, err := fs.MakeDelta(absPath, &dr.Signature)
+	if err != nil {
+		return err
+	}
+	log.Printf("[P_%s]\tSending delta with %dB of literals: %s", prettyID,
+		delta.Literals(), absPath)
+	dc := comm.DeltaContent{Delta: delta, FileID: dr.FileID}
+	raw := dc.Dump()
+	if n, err := s.Write(raw); n != len(raw) || err != nil {
+		return errors.New("Error writing to steam")
+	}
+	return nil
+}
+
 func (p *Peer) handleRequestMTIndexContent(s net.Stream, ir *comm.IndexContent) error {
 	if !p.waiting {
 		return errors.New("Unexpected index received")
@@ -140,33 +282,265 @@ func (p *Peer) handleRequestMTIndexContent(s net.Stream, ir *comm.IndexContent)
 		return errors.New("Unknown contact")
 	}
 
-	i := p.RootIndex
+	i := p.rootIndex()
 	ni := &ir.Index
+	// agree on the settings of the directory or refuse to synchronize
+	config, err := fs.NegotiateConfig(&i, ni)
+	if err != nil {
+		return err
+	}
+	p.modifyIndex(func(i *fs.Index) {
+		i.Config = config
+	})
+	// later scans use the negotiated settings, see ReloadIndex
+	p.saveIndex()
+	if p.indices == nil {
+		p.indices = make(map[string]*fs.Index)
+	}
+	p.indices[contact.ID().String()] = ni
 	comparison := i.Compare(ni)
+	// directories are removed after their content and only if they are
+	// empty, so untracked and ignored files are kept
 	for _, path := range comparison.Deletions {
-		// TODO: delete path
-		os.Remove(path)
+		if absPath, err := fs.SafePath(p.RootDir, path); err == nil {
+			os.Remove(absPath)
+		}
+	}
+
+	// files changed concurrently by both peers are not replaced, the change
+	// of the contact is requested to merge it, see mergeFile
+	for _, path := range comparison.Conflicts {
+		requestedFile, err := MakeRequestedFile(ni.Files[path], "", contact)
+		if err != nil {
+			return err
+		}
+		requestedFile.merge = true
+		if err = p.fillFromStore(requestedFile); err != nil {
+			return err
+		}
+		if len(requestedFile.Missing()) == 0 {
+			if err = p.mergeFile(requestedFile); err != nil {
+				return err
+			}
+			continue
+		}
+		p.fileMap[ni.Files[path].ID] = requestedFile
 	}
 
-	for _, sum := range comparison.Additions {
-		requestedFile, err := MakeRequestedFile(sum, contact)
+	// directories are created before the files they contain are requested
+	paths := make([]string, 0, len(comparison.Additions))
+	for path := range comparison.Additions {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		sum := comparison.Additions[path]
+		// files are never written through linked directories
+		absPath, err := fs.SafePath(p.RootDir, sum.Path)
+		if err != nil {
+			return err
+		}
+		if sum.IsDir() {
+			if err = fs.MakeDir(absPath, sum.Perm); err != nil {
+				return err
+			}
+			continue
+		}
+		// links could be used to write outside of the directory
+		if sum.IsSymlink() {
+			if err = fs.CheckLink(p.RootDir, sum.Path, sum.Target); err != nil {
+				return err
+			}
+			if err = fs.MakeLink(absPath, sum.Target); err != nil {
+				return err
+			}
+			continue
+		}
+		requestedFile, err := MakeRequestedFile(sum, absPath, contact)
 		if err != nil {
 			return err
 		}
+		// blocks of other files don't need to be requested
+		if config.Store {
+			if err = p.fillFromStore(requestedFile); err != nil {
+				return err
+			}
+		}
 		p.fileMap[sum.ID] = requestedFile
+		// local copies are rebuilt from a delta, files whose delta fails
+		// are left to be requested by blocks
+		if fs.IsFile(absPath) && len(requestedFile.Missing()) > 0 {
+			err = p.RequestDelta(requestedFile.file.ID, sum.Path, *contact)
+			if err != nil {
+				prettyID := p.Host.ID().Pretty()
+				log.Printf("[P_%s]\tError requesting delta: %s: %s",
+					prettyID[len(prettyID)-4:], err, absPath)
+			}
+		}
 	}
 
 	// TODO: fileMap is not empty, request and update files of stack
+	p.PruneIndex()
 	p.waiting = false
 	return nil
 }
 
 func (p *Peer) handleRequestMTIndexRequest(s net.Stream, ir comm.IndexRequest) error {
 	// TODO: ReloadIndex as a background routine
-	ic := comm.IndexContent{Index: p.RootIndex}
-	raw := ic.Dump()
-	if n, err := s.Write(raw); n != len(raw) || err != nil {
+	ic := comm.IndexContent{Encoding: fs.IndexEncodingBinary, Index: p.rootIndex()}
+	if _, err := ic.WriteTo(s); err != nil {
 		return errors.New("Error writing to steam")
 	}
 	return nil
 }
+
+// fillFromStore copies the missing blocks of a requested file from the store
+func (p *Peer) fillFromStore(rf *RequestedFile) error {
+	store, err := fs.OpenStore(p.RootDir)
+	if err != nil {
+		return err
+	}
+	for _, n := range rf.Missing() {
+		hash := rf.summary.Blocks[n]
+		if hash == "" || !store.Has(rf.summary.Hash, hash) {
+			continue
+		}
+		if b, err := store.Get(rf.summary.Hash, hash); err == nil {
+			rf.receive(n, b)
+		}
+	}
+	return nil
+}
+
+// mergeFile stores the change of a contact received in rf, merges it with
+// the local file and writes the files that replace it, read from the store.
+// Blocks are stored to be merged even if the store is disabled
+func (p *Peer) mergeFile(rf *RequestedFile) error {
+	store, err := fs.OpenStore(p.RootDir)
+	if err != nil {
+		return err
+	}
+	// the stored and merged blocks are kept until the merge is indexed
+	defer store.Hold()()
+	for _, b := range rf.file.Blocks {
+		if _, err = store.Put(rf.summary.Hash, b); err != nil {
+			return err
+		}
+	}
+	ni, found := p.indices[rf.contact.ID().String()]
+	if !found {
+		return fmt.Errorf("No index of contact %s", rf.contact.ID().String())
+	}
+	i := p.rootIndex()
+	i.Store = store
+	summaries, err := fs.MergeFile(&i, ni, rf.summary.Path)
+	if err != nil {
+		return err
+	}
+	for _, s := range summaries {
+		if local, found := i.Files[s.Path]; !found || local.ID != s.ID {
+			if err = p.writeFromStore(s, rf.contact); err != nil {
+				return err
+			}
+		}
+	}
+	p.recordFiles(summaries...)
+	return nil
+}
+
+// readBlock reads a block of a file, zero blocks are not read and blocks
+// that changed on disk since the file was indexed are read from the store
+// if it is enabled
+func (p *Peer) readBlock(absPath string, summary *fs.Summary, n int) (*fs.Block, error) {
+	if summary.IsZero(n) {
+		_, size, err := summary.Offset(n)
+		if err != nil {
+			return nil, err
+		}
+		return fs.ZeroBlock(size), nil
+	}
+	block, err := fs.ReadBlock(absPath, summary, n)
+	if i := p.rootIndex(); err == nil || !i.Config.Store {
+		return block, err
+	}
+	store, err := fs.OpenStore(p.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(summary.Hash, summary.Blocks[n])
+}
+
+// recordFiles adds the summaries of written files to p.RootIndex, with the
+// versions they were written with so they aren't seen as local changes,
+// and saves it. The replaced summaries become parents
+func (p *Peer) recordFiles(summaries ...*fs.Summary) {
+	p.modifyIndex(func(i *fs.Index) {
+		for _, s := range summaries {
+			if local, found := i.Files[s.Path]; found {
+				// already indexed by the watcher
+				if local.ID == s.ID {
+					continue
+				}
+				i.AddParent(local)
+			}
+			i.Files[s.Path] = s
+		}
+	})
+	p.saveIndex()
+}
+
+// remoteSummary returns the summary of the file requested in rf as it is
+// in the index of the contact
+func (p *Peer) remoteSummary(rf *RequestedFile) (*fs.Summary, error) {
+	id := rf.contact.ID().String()
+	ni, found := p.indices[id]
+	if !found {
+		return nil, fmt.Errorf("No index of contact %s", id)
+	}
+	s, found := ni.Files[rf.summary.Path]
+	if !found || s.ID != rf.summary.ID {
+		return nil, fmt.Errorf("File %s is not in the index of contact %s", rf.summary.ID, id)
+	}
+	return s, nil
+}
+
+// storeFile adds the blocks of a received file to the store
+func (p *Peer) storeFile(rf *RequestedFile) error {
+	store, err := fs.OpenStore(p.RootDir)
+	if err != nil {
+		return err
+	}
+	// unchanged blocks are not in memory, read the written file
+	s, err := fs.MakeSummaryFromPath(rf.file.Path, fs.Config{
+		BlockSize: rf.summary.BlockSize,
+		Chunker:   rf.summary.Chunker,
+		Hash:      rf.summary.Hash,
+	})
+	if err != nil {
+		return err
+	}
+	return store.AddFile(rf.file.Path, s)
+}
+
+// writeFromStore writes the file described by s with the blocks in the store
+func (p *Peer) writeFromStore(s *fs.Summary, c *Contact) error {
+	// files are never written through linked directories
+	absPath, err := fs.SafePath(p.RootDir, s.Path)
+	if err != nil {
+		return err
+	}
+	rf, err := MakeRequestedFile(s, absPath, c)
+	if err != nil {
+		return err
+	}
+	if err = p.fillFromStore(rf); err != nil {
+		return err
+	}
+	if missing := rf.Missing(); len(missing) != 0 {
+		return fmt.Errorf("%d blocks of '%s' are not stored", len(missing), s.Path)
+	}
+	if err = os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	return rf.file.WriteVerified(s)
+}
@@ -8,7 +8,6 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
-	"strings"
 	"testing"
 	"time"
 
@@ -23,20 +22,26 @@ func TestPeer_HandleRequestMTBlockContent(t *testing.T) {
 	fileID, _ := uuid.NewV4()
 	fid := fileID.String()
 
-	requestedFile1, _ := MakeRequestedFile(&fs.Summary{
-		ID:     fileID.String(),
-		Parent: "",
-		Path:   fileName,
-		Perm:   os.FileMode(0755),
-		Blocks: []uint64{1, 1},
-	}, &testIntPeer1.Contacts[0 /* testIntPeer2 */])
-	testIntPeer1.fileMap[fid] = requestedFile1
-
 	content1 := make([]byte, fs.BlockSize)
 	content2 := make([]byte, fs.BlockSize)
 	rand.Read(content1)
 	rand.Read(content2)
 
+	summary := fs.MakeSummary(&fs.File{
+		ID:     fileID,
+		Path:   fileName,
+		Perm:   os.FileMode(0755),
+		Hash:   fs.DefaultHash,
+		Blocks: []*fs.Block{&fs.Block{Content: content1}, &fs.Block{Content: content2}},
+	})
+	requestedFile1, _ := MakeRequestedFile(summary, fileName, &testIntPeer1.Contacts[0 /* testIntPeer2 */])
+	testIntPeer1.fileMap[fid] = requestedFile1
+	// received files are indexed with the summary sent by the contact
+	index, _ := fs.MakeIndex(summary)
+	testIntPeer1.indices = map[string]*fs.Index{
+		testIntPeer1.Contacts[0 /* testIntPeer2 */].ID().String(): index,
+	}
+
 	bc1 := comm.BlockContent{
 		BlockN:    0,
 		BlockSize: uint16(fs.BlockSize / 1024),
@@ -107,17 +112,18 @@ func TestPeer_HandleRequestMTBlockRequest(t *testing.T) {
 	if err != nil {
 		t.FailNow()
 	}
-	summary, found := testIntPeer1.RootIndex.Files[muffinPath]
+	summary, found := testIntPeer1.RootIndex.Files[filepath.Base(muffinPath)]
 	if !found {
 		t.FailNow()
 	}
-	absPath := summary.Path
-	relPath := strings.Replace(absPath, testIntPeer2.RootDir+"/", "", 1)
+	absPath := muffinPath
+	relPath := summary.Path
 	id, _ := uuid.FromString(summary.ID)
 
-	blockN := uint8(1)
+	blockN := uint64(1)
 	br := comm.BlockRequest{
 		BlockN:   blockN,
+		Codecs:   comm.SupportedCodecs,
 		FileID:   id,
 		FilePath: relPath,
 	}
@@ -143,6 +149,50 @@ func TestPeer_HandleRequestMTBlockRequest(t *testing.T) {
 	}
 }
 
+func TestPeer_HandleRequestMTDeltaRequest(t *testing.T) {
+	s, err := testIntPeer2.ConnectTo(testIntPeer2.Contacts[0 /* testIntPeer1 */])
+	if err != nil {
+		t.FailNow()
+	}
+	summary, found := testIntPeer1.RootIndex.Files[filepath.Base(muffinPath)]
+	if !found {
+		t.FailNow()
+	}
+	absPath := muffinPath
+	relPath := summary.Path
+	id, _ := uuid.FromString(summary.ID)
+
+	// signature of an identical copy, no literals are expected
+	signature, err := fs.MakeSignature(absPath, fs.MinBlockSize, fs.DefaultHash)
+	if err != nil {
+		t.FailNow()
+	}
+	dr := comm.DeltaRequest{
+		FileID:    id,
+		FilePath:  relPath,
+		Signature: *signature,
+	}
+	payload := dr.Dump()
+	n, err := s.Write(payload)
+	if err != nil || n != len(payload) {
+		t.FailNow()
+	}
+
+	buf := bufio.NewReader(s)
+	dc := comm.DeltaContent{}
+	msg, err := dc.Recv(buf)
+	if err != nil {
+		t.FailNow()
+	}
+	if err = dc.Load(msg); err != nil {
+		t.FailNow()
+	}
+	if dc.FileID != id || dc.Delta.Literals() != 0 ||
+		len(dc.Delta) != len(signature.Weak) {
+		t.FailNow()
+	}
+}
+
 func TestPeer_HandleRequestMTIndexContent(t *testing.T) {
 	c, _ := testIntPeer4.RequestPeer(auth.PrintPubKey(testIntPeer3.PubKey))
 	testIntPeer4.Contacts = []Contact{*c}
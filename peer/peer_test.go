@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"bitbucket.org/mikelsr/sakaban-broker/auth"
@@ -124,7 +126,7 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		os.Exit(1)
 	}
-	testPeer = *tp
+	testPeer = tp
 
 	// create test directories
 	err = os.MkdirAll(testDir, 0755)
@@ -169,6 +171,56 @@ func TestImport(t *testing.T) {
 	}
 }
 
+// TestMakeRequestedFile requests a file chunked by content that was edited
+// in the middle, only the blocks missing from the local file are pending
+func TestMakeRequestedFile(t *testing.T) {
+	fileName := filepath.Join(testDir, "MakeRequestedFile")
+	content := make([]byte, 4*fs.BlockSize)
+	rand.New(rand.NewSource(1)).Read(content)
+	ioutil.WriteFile(fileName, content, 0644)
+	c := fs.Config{Chunker: fs.ChunkerCDC, Hash: fs.DefaultHash}
+	local, err := fs.MakeSummaryFromPath(fileName, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := append(append(append([]byte{}, content[:2*fs.BlockSize]...), 1, 2, 3),
+		content[2*fs.BlockSize:]...)
+	editedName := filepath.Join(testDir, "MakeRequestedFile_edited")
+	ioutil.WriteFile(editedName, edited, 0644)
+	remote, _ := fs.MakeSummaryFromPath(editedName, c)
+
+	rf, err := MakeRequestedFile(remote, fileName, &Contact{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, h := range local.Blocks {
+		found[h] = true
+	}
+	if len(rf.pending) == 0 || len(rf.pending) == len(remote.Blocks) {
+		t.FailNow()
+	}
+	for i, h := range remote.Blocks {
+		if rf.pending[uint64(i)] == found[h] {
+			t.FailNow()
+		}
+		if !found[h] {
+			continue
+		}
+		offset, size, _ := remote.Offset(i)
+		if !reflect.DeepEqual(rf.file.Blocks[i].Content, edited[offset:offset+size]) {
+			t.FailNow()
+		}
+	}
+
+	// unreadable chunker
+	remote.Chunker = "unknown"
+	if _, err = MakeRequestedFile(remote, fileName, &Contact{}); err == nil {
+		t.FailNow()
+	}
+}
+
 func TestPeer_ConnectTo(t *testing.T) {
 	// create incorrect peer
 	p, _ := NewPeer()
@@ -204,6 +256,16 @@ func TestPeer_ConnectTo(t *testing.T) {
 	if err != nil {
 		t.FailNow()
 	}
+
+	// peers only speaking the v0 protocol are rejected
+	p.Host.Close()
+	h, _ = libp2p.New(context.Background(), options...)
+	p.Host = h
+	p.Host.SetStreamHandler(protocolIDV0, p.handleLegacyStream)
+	_, err = testPeer.ConnectTo(*c)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported protocol version") {
+		t.FailNow()
+	}
 }
 
 func TestPeer_Export(t *testing.T) {
@@ -304,6 +366,42 @@ func TestPeer_ReloadPeer(t *testing.T) {
 	}
 }
 
+// TestPeer_ReloadIndex_Rehash reloads an index hashed with FNV-1a, unchanged
+// files are rehashed instead of modified, and checks that the index is left
+// untouched if the directory can't be scanned
+func TestPeer_ReloadIndex_Rehash(t *testing.T) {
+	dir := filepath.Join(testDir, "peer", "rehash")
+	os.MkdirAll(dir, 0755)
+	filename := filepath.Join(dir, "file")
+	ioutil.WriteFile(filename, []byte{1, 2, 3}, 0644)
+	c := fs.MakeConfig()
+	c.Hash = fs.HashFNV64a
+	sum, err := fs.MakeSummaryFromPath(filename, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum.Path = "file"
+	sum.Version = fs.Version{"device": 1}
+	i, _ := fs.MakeIndex(sum)
+	i.Config = fs.MakeConfig()
+
+	p := &Peer{RootDir: dir, RootIndex: *i}
+	if err = p.ReloadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	s := p.RootIndex.Files["file"]
+	if len(p.RootIndex.Parents) != 0 || s.Hash != fs.DefaultHash ||
+		s.Version.Compare(sum.Version) != fs.VersionEqual {
+		t.FailNow()
+	}
+
+	reloaded := p.RootIndex
+	p.RootDir = filepath.Join(dir, "missing")
+	if err = p.ReloadIndex(); err == nil || !reflect.DeepEqual(p.RootIndex, reloaded) {
+		t.FailNow()
+	}
+}
+
 func TestPeer_SetRootDir(t *testing.T) {
 	if err := testPeer.SetRootDir(""); err == nil {
 		t.FailNow()
@@ -2,6 +2,8 @@ package peer
 
 import (
 	"errors"
+	"io"
+	"sort"
 
 	"bitbucket.org/mikelsr/sakaban/fs"
 	uuid "github.com/satori/go.uuid"
@@ -9,56 +11,128 @@ import (
 
 // RequestedFile stores a file requested to a peer and the contact of that peer
 type RequestedFile struct {
-	contact *Contact
-	file    *fs.File
-	summary *fs.Summary
+	contact   *Contact
+	file      *fs.File
+	merge     bool            // merged with the local file instead of replacing it
+	pending   map[uint64]bool // blocks that haven't been received yet
+	signature *fs.Signature   // sent to the peer if a delta was requested
+	summary   *fs.Summary
 }
 
-// MakeRequestedFile creates a RequestFile given a contact and a file summary
-func MakeRequestedFile(s *fs.Summary, c *Contact) (*RequestedFile, error) {
+// MakeRequestedFile creates a RequestFile given a contact, a file summary and
+// the local path of the file. Unchanged blocks of files cut in blocks of fixed size are left nil and
+// copied from the local file when it is written
+func MakeRequestedFile(s *fs.Summary, path string, c *Contact) (*RequestedFile, error) {
 	if c == nil || s == nil {
 		return nil, errors.New("Nil parameter")
 	}
 
-	f, err := fs.MakeFileFromSummary(s)
-	// if file doesn't exist
+	id, err := uuid.FromString(s.ID)
 	if err != nil {
-		id, err := uuid.FromString(s.ID)
+		return nil, err
+	}
+	var parentID uuid.UUID
+	if s.Parent == "" {
+		parentID = uuid.Nil
+	} else {
+		parentID, err = uuid.FromString(s.Parent)
 		if err != nil {
 			return nil, err
 		}
-		var parentID uuid.UUID
-		if s.Parent == "" {
-			parentID = uuid.Nil
-		} else {
-			parentID, err = uuid.FromString(s.Parent)
+	}
+	f := &fs.File{
+		ID:        id,
+		Parent:    parentID,
+		Path:      path,
+		Perm:      s.Perm,
+		Chunker:   s.Chunker,
+		Hash:      s.Hash,
+		BlockSize: s.BlockSize,
+		Blocks:    make([]*fs.Block, len(s.Blocks)),
+	}
+	rf := &RequestedFile{
+		contact: c,
+		file:    f,
+		pending: make(map[uint64]bool),
+		summary: s,
+	}
+
+	exists := fs.IsFile(path)
+	local := make(map[string]*fs.Block)
+	if exists && !s.FixedSize() {
+		// blocks cut by content may have moved, look them up by hash
+		if local, err = localBlocks(path, s); err != nil {
+			return nil, err
+		}
+	}
+	for i, h := range s.Blocks {
+		switch {
+		case exists && s.FixedSize() && h == "":
+			// unchanged, kept in the local file
+		case s.IsZero(i):
+			// zero blocks are not transferred
+			_, size, err := s.Offset(i)
 			if err != nil {
 				return nil, err
 			}
+			f.Blocks[i] = fs.ZeroBlock(size)
+		case local[h] != nil:
+			f.Blocks[i] = local[h]
+		default:
+			rf.pending[uint64(i)] = true
+		}
+	}
+	return rf, nil
+}
+
+// Missing returns the numbers of the blocks that haven't been received yet
+func (rf *RequestedFile) Missing() []uint64 {
+	missing := make([]uint64, 0, len(rf.pending))
+	for n := range rf.pending {
+		missing = append(missing, n)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
+
+// localBlocks reads the file in path one block at a time, cut as described
+// by s, and keeps the blocks of s it finds, indexed by hash
+func localBlocks(path string, s *fs.Summary) (map[string]*fs.Block, error) {
+	wanted := make(map[string]bool)
+	for i, h := range s.Blocks {
+		if h != "" && !s.IsZero(i) {
+			wanted[h] = true
 		}
-		f = &fs.File{
-			ID:     id,
-			Parent: parentID,
-			Path:   s.Path,
-			Perm:   s.Perm,
-			Blocks: make([]*fs.Block, len(s.Blocks)),
+	}
+	local := make(map[string]*fs.Block)
+	if len(wanted) == 0 {
+		return local, nil
+	}
+	chunker, err := fs.GetChunker(s.Chunker, s.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.OpenBlockReader(path, chunker)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		b, err := r.Next()
+		if err == io.EOF {
+			return local, nil
 		}
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		// empty changed blocks
-		for i := range f.Blocks {
-			if s.Blocks[i] != 0 {
-				f.Blocks[i] = nil
-			}
+		if h := b.HashWith(s.Hash); wanted[h] {
+			local[h] = b
 		}
-
 	}
+}
 
-	return &RequestedFile{
-		contact: c,
-		file:    f,
-		summary: s,
-	}, nil
+// receive stores block n of the file
+func (rf *RequestedFile) receive(n uint64, b *fs.Block) {
+	rf.file.Blocks[n] = b
+	delete(rf.pending, n)
 }
@@ -24,7 +24,7 @@ var (
 	testIntPeer2           *Peer // used for integration testing
 	testIntPeer3           *Peer // used for integration testing
 	testIntPeer4           *Peer // used for integration testing
-	testPeer               Peer
+	testPeer               *Peer
 	testPeerRootDir        = fmt.Sprintf("%s/res", fs.ProjectPath())
 	testListenMultiAddr1   = "/ip4/0.0.0.0/tcp/3011"
 	testListenMultiAddr2   = "/ip4/0.0.0.0/tcp/3012"